@@ -0,0 +1,82 @@
+package gitkit
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// accessRecorder counts the status and bytes of a response for the access log
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets git responses be streamed through the recorder, see newWriteFlusher
+func (w *accessRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *accessRecorder) EnableFullDuplex() error {
+	if !enableFullDuplex(w.ResponseWriter, nil) {
+		return fmt.Errorf("full duplex is not supported")
+	}
+	return nil
+}
+
+// logAccess writes a line in the Combined Log Format to Config.AccessLog,
+// followed by the duration of the request in seconds
+func (s *Server) logAccess(r *http.Request, w *accessRecorder, start time.Time) {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	user := "-"
+	if name, _, ok := r.BasicAuth(); ok && name != "" {
+		user = name
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] %q %d %d %q %q %.3f\n",
+		s.clientIP(r),
+		user,
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.URL.RequestURI()+" "+r.Proto,
+		status,
+		w.bytes,
+		orDash(r.Referer()),
+		orDash(r.UserAgent()),
+		time.Since(start).Seconds(),
+	)
+
+	s.accessLogLock.Lock()
+	defer s.accessLogLock.Unlock()
+	io.WriteString(s.config.AccessLog, line)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,88 @@
+package gitkit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// lockedBuffer is a bytes.Buffer that handlers and tests can share
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) lines() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return strings.Split(strings.TrimSuffix(b.buf.String(), "\n"), "\n")
+}
+
+var accessLineRegex = regexp.MustCompile(`^(\S+) - (\S+) \[([^\]]+)\] "([^"]*)" (\d{3}) (\d+) "([^"]*)" "([^"]*)" (\d+\.\d{3})$`)
+
+func TestAccessLog(t *testing.T) {
+	dir := t.TempDir()
+	log := &lockedBuffer{}
+	server := httptest.NewServer(New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true, AccessLog: log}))
+	defer server.Close()
+
+	pushSampleCommit(t, dir, server.URL+"/test.git")
+
+	req, _ := http.NewRequest("GET", server.URL+"/test.git/info/refs?service=git-upload-pack", nil)
+	req.SetBasicAuth("alice", "secret")
+	req.Header.Set("User-Agent", "git/2.40.0")
+	req.Header.Set("Accept-Encoding", "gzip") // Keeps the body compressed, as sent
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+
+	resp, err = http.Get(server.URL + "/test.git/missing")
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	var lines []string
+	assert.True(t, waitFor(time.Second, func() bool {
+		lines = log.lines()
+		return len(lines) >= 2 && strings.Contains(lines[len(lines)-1], "/missing")
+	}), "access log lines are missing")
+	for _, line := range lines {
+		assert.Regexp(t, accessLineRegex, line)
+	}
+
+	// The streamed advertisement is counted byte for byte, as compressed
+	refs := accessLineRegex.FindStringSubmatch(lines[len(lines)-2])
+	if assert.NotNil(t, refs) {
+		assert.Equal(t, "127.0.0.1", refs[1])
+		assert.Equal(t, "alice", refs[2])
+		assert.Equal(t, "GET /test.git/info/refs?service=git-upload-pack HTTP/1.1", refs[4])
+		assert.Equal(t, "200", refs[5])
+		assert.Equal(t, strconv.Itoa(len(body)), refs[6])
+		assert.Equal(t, "-", refs[7])
+		assert.Equal(t, "git/2.40.0", refs[8])
+	}
+
+	missing := accessLineRegex.FindStringSubmatch(lines[len(lines)-1])
+	if assert.NotNil(t, missing) {
+		assert.Equal(t, "-", missing[2])
+		assert.Equal(t, "GET /test.git/missing HTTP/1.1", missing[4])
+		assert.Equal(t, "404", missing[5])
+	}
+}
@@ -0,0 +1,92 @@
+package gitkit
+
+import (
+	"sync"
+	"time"
+)
+
+// advertiseCache remembers the ref advertisements of repositories, see
+// Config.AdvertiseCacheTTL. Cached advertisements are never modified, so
+// they are written to clients without holding the lock.
+type advertiseCache struct {
+	now func() time.Time
+
+	lock      sync.RWMutex
+	repos     map[string]map[string]advertiseCacheEntry // By repository path and key
+	lastSweep time.Time
+}
+
+type advertiseCacheEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// advertiseCacheKey identifies an advertisement of a repository by service
+// and protocol version, which change its content
+func advertiseCacheKey(rpc string, protocolV2 bool) string {
+	if protocolV2 {
+		return rpc + " v2"
+	}
+	return rpc
+}
+
+func (c *advertiseCache) get(repoPath string, key string) ([]byte, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	entry, ok := c.repos[repoPath][key]
+	if !ok || !c.now().Before(entry.expires) {
+		return nil, false
+	}
+	return entry.data, true
+}
+
+func (c *advertiseCache) set(repoPath string, key string, data []byte, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	c.sweep(now)
+	if c.repos == nil {
+		c.repos = map[string]map[string]advertiseCacheEntry{}
+	}
+	if c.repos[repoPath] == nil {
+		c.repos[repoPath] = map[string]advertiseCacheEntry{}
+	}
+	c.repos[repoPath][key] = advertiseCacheEntry{data: data, expires: now.Add(ttl)}
+}
+
+// invalidate drops the advertisements of a repository, once its refs may
+// have changed
+func (c *advertiseCache) invalidate(repoPath string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.repos, repoPath)
+}
+
+func (c *advertiseCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.repos = nil
+}
+
+// sweep drops expired entries, at most once a minute
+func (c *advertiseCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	c.lastSweep = now
+
+	for repoPath, entries := range c.repos {
+		for key, entry := range entries {
+			if !now.Before(entry.expires) {
+				delete(entries, key)
+			}
+		}
+		if len(entries) == 0 {
+			delete(c.repos, repoPath)
+		}
+	}
+}
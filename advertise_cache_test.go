@@ -0,0 +1,129 @@
+package gitkit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdvertiseCache(t *testing.T) {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	gitPath := writeGitStub(t, dir, fmt.Sprintf(`case "$*" in *--advertise-refs*) echo >> %s ;; esac
+exec git "$@"
+`, calls))
+
+	now := time.Unix(0, 0)
+	server := New(Config{Dir: filepath.Join(dir, "repos"), GitPath: gitPath, AutoCreate: true, AdvertiseCacheTTL: time.Minute})
+	server.advertiseCache.now = func() time.Time { return now }
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	advertise := func() string {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/test.git/info/refs?service=git-upload-pack", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+	gitCalls := func() int {
+		data, _ := ioutil.ReadFile(calls)
+		return strings.Count(string(data), "\n")
+	}
+
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+	first := advertise()
+	assert.Contains(t, first, "refs/heads/master")
+	before := gitCalls()
+	assert.Equal(t, first, advertise())
+	assert.Equal(t, before, gitCalls())
+
+	// Pushes drop the cached advertisement
+	work := filepath.Join(dir, "work")
+	for _, args := range [][]string{
+		{"commit", "-q", "--allow-empty", "-m", "second commit"},
+		{"push", "-q", ts.URL + "/test.git", "HEAD:refs/heads/feature"},
+	} {
+		out, err := runGit(work, args...)
+		assert.NoError(t, err, out)
+	}
+	second := advertise()
+	assert.Contains(t, second, "refs/heads/feature")
+	before = gitCalls()
+	assert.Equal(t, second, advertise())
+	assert.Equal(t, before, gitCalls())
+
+	// So does time
+	now = now.Add(time.Minute)
+	assert.Equal(t, second, advertise())
+	assert.Equal(t, before+1, gitCalls())
+
+	// Cached advertisements are kept per service
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/test.git/info/refs?service=git-receive-pack", nil))
+	assert.Contains(t, w.Body.String(), "# service=git-receive-pack")
+	assert.Equal(t, before+2, gitCalls())
+
+	// Deleted repositories are not advertised
+	assert.NoError(t, os.RemoveAll(filepath.Join(dir, "work")))
+	assert.NoError(t, server.DeleteRepo("test.git"))
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/test.git/info/refs?service=git-upload-pack", nil))
+	assert.NotContains(t, w.Body.String(), "refs/heads/feature")
+}
+
+func TestAdvertiseCacheGitEnv(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true, AdvertiseCacheTTL: time.Minute})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+
+	// Refs outside of the namespace of a client are hidden from it
+	server.GitEnvFunc = func(r *Request) []string {
+		return []string{"GIT_NAMESPACE=" + r.URL.Query().Get("ns")}
+	}
+	advertise := func(namespace string) string {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/test.git/info/refs?service=git-upload-pack&ns="+namespace, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	assert.Contains(t, advertise(""), "refs/heads/master")
+	assert.NotContains(t, advertise("other"), "refs/heads/master")
+}
+
+func BenchmarkAdvertiseCache(b *testing.B) {
+	dir := b.TempDir()
+	work := filepath.Join(dir, "work")
+	for _, args := range [][]string{
+		{"init", "-q", work},
+		{"-C", work, "commit", "-q", "--allow-empty", "-m", "initial commit"},
+		{"clone", "-q", "--bare", work, filepath.Join(dir, "test.git")},
+	} {
+		if out, err := runGit(dir, args...); err != nil {
+			b.Fatal(err, out)
+		}
+	}
+
+	for _, ttl := range []time.Duration{0, time.Minute} {
+		server := New(Config{Dir: dir, AdvertiseCacheTTL: ttl})
+		b.Run(fmt.Sprintf("ttl=%s", ttl), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				w := httptest.NewRecorder()
+				server.ServeHTTP(w, httptest.NewRequest("GET", "/test.git/info/refs?service=git-upload-pack", nil))
+				if w.Code != http.StatusOK {
+					b.Fatalf("unexpected status %d", w.Code)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package gitkit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authCache remembers the decisions of AuthFunc, see Config.AuthCacheTTL
+type authCache struct {
+	now func() time.Time
+
+	lock      sync.Mutex
+	entries   map[string]authCacheEntry
+	lastSweep time.Time
+}
+
+type authCacheEntry struct {
+	allow   bool
+	err     error // ErrForbidden or nil
+	expires time.Time
+}
+
+// authCacheKey identifies a decision by credential, secrets included so that
+// a wrong password never hits the entry of the right one, repository and
+// operation. Only a hash of it is kept.
+func authCacheKey(cred Credential, req *Request) string {
+	h := sha256.New()
+	for _, part := range []string{cred.Scheme, cred.Username, cred.Password, cred.Token, cred.ClientCN, req.RepoName, req.Operation} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *authCache) get(key string) (entry authCacheEntry, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok = c.entries[key]
+	if !ok || !c.now().Before(entry.expires) {
+		return authCacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *authCache) set(key string, allow bool, err error, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	c.sweep(now)
+	if c.entries == nil {
+		c.entries = map[string]authCacheEntry{}
+	}
+	c.entries[key] = authCacheEntry{allow: allow, err: err, expires: now.Add(ttl)}
+}
+
+func (c *authCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries = nil
+}
+
+// sweep drops expired entries, at most once a minute
+func (c *authCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	c.lastSweep = now
+
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// authorize asks AuthFunc, or AuthFuncs, whether the request is allowed, or
+// the cache of its decisions when Config.AuthCacheTTL is set. Errors other
+// than ErrForbidden are never cached and rejections only for a tenth of the
+// TTL, so that fixed credentials or permissions work again soon.
+func (s *Server) authorize(cred Credential, req *Request) (bool, error) {
+	ttl := s.config.AuthCacheTTL
+	if ttl <= 0 || s.AuthCacheBypassFunc != nil && s.AuthCacheBypassFunc(req) {
+		return s.askAuthTimeout(cred, req)
+	}
+
+	key := authCacheKey(cred, req)
+	if entry, ok := s.authCache.get(key); ok {
+		return entry.allow, entry.err
+	}
+
+	allow, err := s.askAuthTimeout(cred, req)
+	if err != nil && err != ErrForbidden {
+		return allow, err
+	}
+	if err != nil {
+		allow = false
+	}
+	if !allow {
+		ttl /= 10
+	}
+	s.authCache.set(key, allow, err, ttl)
+	return allow, err
+}
+
+// errAuthTimeout is returned by askAuthTimeout when AuthFunc does not answer
+// within Config.AuthTimeout
+var errAuthTimeout = errors.New("auth timed out")
+
+// askAuthTimeout asks AuthFunc, giving up after Config.AuthTimeout. AuthFunc
+// keeps running when it is late, its answer is dropped.
+func (s *Server) askAuthTimeout(cred Credential, req *Request) (bool, error) {
+	if s.config.AuthTimeout <= 0 {
+		return s.askAuthFuncs(cred, req)
+	}
+
+	type answer struct {
+		allow bool
+		err   error
+	}
+	answers := make(chan answer, 1)
+	go func() {
+		allow, err := s.askAuthFuncs(cred, req)
+		answers <- answer{allow, err}
+	}()
+
+	timer := time.NewTimer(s.config.AuthTimeout)
+	defer timer.Stop()
+	select {
+	case a := <-answers:
+		return a.allow, a.err
+	case <-timer.C:
+		return false, errAuthTimeout
+	}
+}
+
+// askAuthFuncs asks AuthFuncs in order whether the request is allowed, or
+// AuthFunc if there are none
+func (s *Server) askAuthFuncs(cred Credential, req *Request) (bool, error) {
+	if len(s.AuthFuncs) == 0 {
+		return s.AuthFunc(cred, req)
+	}
+
+	forbidden := false
+	var errs authErrors
+	for _, authFunc := range s.AuthFuncs {
+		allow, err := authFunc(cred, req)
+		switch {
+		case err == ErrForbidden:
+			forbidden = true
+		case err != nil:
+			errs = append(errs, err)
+		case allow:
+			return true, nil
+		}
+	}
+
+	if len(errs) > 0 {
+		return false, errs
+	}
+	if forbidden {
+		return false, ErrForbidden
+	}
+	return false, nil
+}
+
+// authErrors are the errors of the AuthFuncs that did not answer
+type authErrors []error
+
+func (errs authErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ClearAuthCache forgets the cached decisions of AuthFunc, e.g. after
+// permissions have been revoked
+func (s *Server) ClearAuthCache() {
+	s.authCache.clear()
+}
@@ -0,0 +1,79 @@
+package gitkit
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthCache(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "test.git")
+	makeRepo(t, dir, "other.git")
+
+	now := time.Unix(0, 0)
+	server := New(Config{Dir: dir, Auth: true, AuthCacheTTL: time.Minute})
+	server.authCache.now = func() time.Time { return now }
+
+	calls := 0
+	var authErr error
+	server.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		calls++
+		return cred.Password == "secret" && req.RepoName == "test.git", authErr
+	}
+
+	request := func(repo string, password string) int {
+		r := httptest.NewRequest("GET", "/"+repo+"/repo/description", nil)
+		r.SetBasicAuth("alice", password)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request("test.git", "secret"))
+	assert.Equal(t, http.StatusOK, request("test.git", "secret"))
+	assert.Equal(t, 1, calls)
+
+	// Other passwords and repositories are decided separately
+	assert.Equal(t, http.StatusUnauthorized, request("test.git", "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, request("other.git", "secret"))
+	assert.Equal(t, 3, calls)
+
+	// Rejections expire sooner than successes
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, http.StatusUnauthorized, request("test.git", "wrong"))
+	assert.Equal(t, http.StatusOK, request("test.git", "secret"))
+	assert.Equal(t, 4, calls)
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, http.StatusOK, request("test.git", "secret"))
+	assert.Equal(t, 5, calls)
+
+	// Errors are not cached
+	authErr = errors.New("directory unavailable")
+	assert.Equal(t, http.StatusUnauthorized, request("other.git", "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, request("other.git", "wrong"))
+	assert.Equal(t, 7, calls)
+	authErr = nil
+
+	// Forbidden users are cached like other rejections
+	authErr = ErrForbidden
+	assert.Equal(t, http.StatusForbidden, request("other.git", "secret"))
+	authErr = nil
+	assert.Equal(t, http.StatusForbidden, request("other.git", "secret"))
+	assert.Equal(t, 8, calls)
+
+	// The cache can be bypassed or cleared
+	server.AuthCacheBypassFunc = func(req *Request) bool { return true }
+	assert.Equal(t, http.StatusOK, request("test.git", "secret"))
+	assert.Equal(t, 9, calls)
+	server.AuthCacheBypassFunc = nil
+
+	server.ClearAuthCache()
+	assert.Equal(t, http.StatusOK, request("test.git", "secret"))
+	assert.Equal(t, 10, calls)
+}
@@ -0,0 +1,284 @@
+package gitkit
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rawFile sends the contents of the file at ?path= as of ?ref=, which
+// defaults to HEAD. Range requests are supported, e.g. to resume downloads,
+// the blob id is the ETag of the response.
+func (s *Server) rawFile(_ string, w http.ResponseWriter, r *Request) error {
+	context := "raw-file"
+	query := r.URL.Query()
+	ref := query.Get("ref")
+	if ref == "" {
+		ref = "HEAD"
+	}
+	filePath := strings.TrimPrefix(query.Get("path"), "/")
+
+	// Refs starting with a dash would be taken as options by git
+	if filePath == "" || strings.HasPrefix(ref, "-") {
+		s.httpError(w, r.Request, http.StatusBadRequest, "Bad Request")
+		return nil
+	}
+
+	// Missing refs and paths, as well as directories, are not found. The
+	// blob is resolved once so that every read sees the same contents.
+	blob, err := s.gitOutput(r.Context(), "--git-dir", r.RepoPath, "rev-parse", "--verify", "--quiet", ref+":"+filePath)
+	if err != nil {
+		s.httpError(w, r.Request, http.StatusNotFound, "Not Found")
+		return nil
+	}
+	blob = strings.TrimSpace(blob)
+	objectType, err := s.gitOutput(r.Context(), "--git-dir", r.RepoPath, "cat-file", "-t", blob)
+	if err != nil || strings.TrimSpace(objectType) != "blob" {
+		s.httpError(w, r.Request, http.StatusNotFound, "Not Found")
+		return nil
+	}
+
+	size, err := s.gitOutput(r.Context(), "--git-dir", r.RepoPath, "cat-file", "-s", blob)
+	if err != nil {
+		s.fail500(w, r.Request, context, err)
+		return err
+	}
+	content := &blobReader{open: func() (io.ReadCloser, error) {
+		return s.catBlob(r, blob)
+	}}
+	if content.size, err = strconv.ParseInt(strings.TrimSpace(size), 10, 64); err != nil {
+		s.fail500(w, r.Request, context, err)
+		return err
+	}
+	defer content.Close()
+
+	// Unknown types are sniffed from the contents by ServeContent
+	if contentType := mime.TypeByExtension(path.Ext(filePath)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", `"`+blob+`"`)
+	http.ServeContent(w, r.Request, filePath, time.Time{}, content)
+
+	if content.err != nil {
+		s.logError(r.Request, context, content.err)
+		return content.err
+	}
+	return nil
+}
+
+// catBlob starts git cat-file to read a blob
+func (s *Server) catBlob(r *Request, blob string) (io.ReadCloser, error) {
+	cmd, pipe, stderr := s.gitCommand(r, "--git-dir", r.RepoPath, "cat-file", "blob", blob)
+	if err := s.startCommand(cmd); err != nil {
+		pipe.Close()
+		return nil, err
+	}
+	return &commandReader{s: s, cmd: cmd, pipe: pipe, stderr: stderr, stop: watchProcessGroup(r.Context(), cmd)}, nil
+}
+
+// commandReader reads the output of a started git process. It fails with the
+// error of the process at the end of the output, and Close stops the process
+// if it is still running.
+type commandReader struct {
+	s      *Server
+	cmd    *exec.Cmd
+	pipe   io.ReadCloser
+	stderr *bytes.Buffer
+	stop   func()
+	done   bool
+}
+
+func (c *commandReader) Read(p []byte) (int, error) {
+	n, err := c.pipe.Read(p)
+	if err == io.EOF && !c.done {
+		c.done = true
+		if waitErr := c.cmd.Wait(); waitErr != nil {
+			return n, commandError(waitErr, c.stderr)
+		}
+	}
+	return n, err
+}
+
+func (c *commandReader) Close() error {
+	c.pipe.Close()
+	c.stop()
+	if !c.done {
+		c.done = true
+		killProcessGroup(c.cmd)
+		c.cmd.Wait()
+	}
+	c.s.releaseCommand(c.cmd)
+	return nil
+}
+
+// Bytes at the start of blobs that are kept, as many as http.ServeContent
+// sniffs to detect the content type
+const blobHeadSize = 512
+
+// blobReader lets http.ServeContent seek in a blob of known size streamed by
+// git. Reads start the stream when they need it, from the beginning, and
+// skip to the position. The start of the stream is kept, so that seeking
+// back after ServeContent sniffed it does not run git again. Seeking back
+// further restarts the stream.
+type blobReader struct {
+	open func() (io.ReadCloser, error)
+	size int64
+	pos  int64
+
+	rc    io.ReadCloser
+	rcPos int64
+	head  []byte // First bytes of the stream, up to blobHeadSize
+	err   error  // First error of the stream, for logging
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	if b.pos >= b.size {
+		return 0, io.EOF
+	}
+
+	if b.pos < int64(len(b.head)) {
+		n := copy(p, b.head[b.pos:])
+		b.pos += int64(n)
+		return n, nil
+	}
+
+	if b.rc == nil || b.rcPos > b.pos {
+		b.Close()
+		rc, err := b.open()
+		if err != nil {
+			return 0, b.fail(err)
+		}
+		b.rc, b.rcPos = rc, 0
+	}
+
+	if skip := b.pos - b.rcPos; skip > 0 {
+		n, err := io.CopyN(ioutil.Discard, b.rc, skip)
+		b.rcPos += n
+		if err != nil {
+			return 0, b.fail(err)
+		}
+	}
+
+	if remaining := b.size - b.pos; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := b.rc.Read(p)
+	if b.rcPos == int64(len(b.head)) && b.rcPos < blobHeadSize {
+		keep := n
+		if keep > blobHeadSize-len(b.head) {
+			keep = blobHeadSize - len(b.head)
+		}
+		b.head = append(b.head, p[:keep]...)
+	}
+	b.pos += int64(n)
+	b.rcPos += int64(n)
+	if err == io.EOF && b.pos < b.size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		return n, b.fail(err)
+	}
+	return n, err
+}
+
+func (b *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.pos
+	case io.SeekEnd:
+		offset += b.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the blob")
+	}
+	b.pos = offset
+	return offset, nil
+}
+
+func (b *blobReader) Close() error {
+	if b.rc != nil {
+		b.rc.Close()
+		b.rc = nil
+	}
+	return nil
+}
+
+func (b *blobReader) fail(err error) error {
+	if b.err == nil {
+		b.err = err
+	}
+	return err
+}
+
+// Content types of the archive formats supported by git archive
+var archiveTypes = map[string]string{
+	"tar":    "application/x-tar",
+	"tar.gz": "application/gzip",
+	"zip":    "application/zip",
+}
+
+// archive streams a snapshot of ?ref=, HEAD by default, in ?format=. Its
+// size is not known up front, so range requests are not supported and
+// downloads cannot be resumed.
+func (s *Server) archive(_ string, w http.ResponseWriter, r *Request) error {
+	context := "archive"
+	query := r.URL.Query()
+	ref := query.Get("ref")
+	if ref == "" {
+		ref = "HEAD"
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = "tar.gz"
+	}
+
+	contentType, ok := archiveTypes[format]
+	if !ok || strings.HasPrefix(ref, "-") {
+		s.httpError(w, r.Request, http.StatusBadRequest, "Bad Request")
+		return nil
+	}
+
+	if _, err := s.gitOutput(r.Context(), "--git-dir", r.RepoPath, "rev-parse", "--verify", "--quiet", ref+"^{tree}"); err != nil {
+		s.httpError(w, r.Request, http.StatusNotFound, "Not Found")
+		return nil
+	}
+
+	// e.g. project-v1.0/ for ref v1.0 of team/project.git
+	name := strings.TrimSuffix(path.Base(r.RepoName), s.config.bareSuffix()) + "-" + strings.Replace(ref, "/", "-", -1)
+	cmd, pipe, stderr := s.gitCommand(r, "--git-dir", r.RepoPath, "archive", "--format="+format, "--prefix="+name+"/", ref)
+	defer pipe.Close()
+
+	if err := s.startCommand(cmd); err != nil {
+		s.fail500(w, r.Request, context, err)
+		return err
+	}
+	defer s.releaseCommand(cmd)
+	defer cleanUpProcessGroup(cmd)
+	defer watchProcessGroup(r.Context(), cmd)()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Accept-Ranges", "none")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + format}))
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(newWriteFlusher(w), pipe); err != nil {
+		s.logError(r.Request, context, err)
+		return err
+	}
+
+	if err := cmd.Wait(); err != nil {
+		err = commandError(err, stderr)
+		s.logError(r.Request, context, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package gitkit
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRawFile(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+
+	// Add a second revision with names git must not interpret
+	work := filepath.Join(dir, "work")
+	assert.NoError(t, os.MkdirAll(filepath.Join(work, "docs"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(work, "README"), []byte("updated"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(work, "docs", "$(id); rm -rf .json"), []byte(`{"a": 1}`), 0644))
+	for _, args := range [][]string{
+		{"add", "."},
+		{"commit", "-q", "-m", "second commit"},
+		{"push", "-q", ts.URL + "/test.git", "HEAD:refs/heads/master"},
+	} {
+		out, err := runGit(work, args...)
+		assert.NoError(t, err, out)
+	}
+
+	tests := []struct {
+		ref         string
+		path        string
+		code        int
+		body        string
+		contentType string
+	}{
+		{"", "README", http.StatusOK, "updated", "text/plain; charset=utf-8"},
+		{"master~1", "README", http.StatusOK, "hello", "text/plain; charset=utf-8"},
+		{"master", "/docs/$(id); rm -rf .json", http.StatusOK, `{"a": 1}`, "application/json"},
+		{"master~1", "docs/$(id); rm -rf .json", http.StatusNotFound, "", ""},
+		{"master", "docs", http.StatusNotFound, "", ""},
+		{"missing", "README", http.StatusNotFound, "", ""},
+		{"--output=/tmp/x", "README", http.StatusBadRequest, "", ""},
+		{"master", "", http.StatusBadRequest, "", ""},
+	}
+
+	for _, test := range tests {
+		query := url.Values{"ref": {test.ref}, "path": {test.path}}
+		resp, err := http.Get(ts.URL + "/test.git/repo/raw?" + query.Encode())
+		if !assert.NoError(t, err) {
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, test.code, resp.StatusCode, test.ref+":"+test.path)
+		if test.code == http.StatusOK {
+			assert.Equal(t, test.body, string(body))
+			assert.Equal(t, test.contentType, resp.Header.Get("Content-Type"))
+		}
+	}
+}
+
+func TestRawFileRange(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+	blob, err := runGit(dir, "--git-dir", filepath.Join(dir, "repos", "test.git"), "rev-parse", "HEAD:README")
+	assert.NoError(t, err, blob)
+	etag := `"` + strings.TrimSpace(blob) + `"`
+
+	get := func(header map[string]string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", ts.URL+"/test.git/repo/raw?path=README", nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return &http.Response{}, ""
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	resp, body := get(nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+	assert.Equal(t, "5", resp.Header.Get("Content-Length"))
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	resp, body = get(map[string]string{"Range": "bytes=1-3"})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "ell", body)
+	assert.Equal(t, "bytes 1-3/5", resp.Header.Get("Content-Range"))
+
+	resp, body = get(map[string]string{"Range": "bytes=-2"})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "lo", body)
+
+	// Ranges out of order
+	resp, body = get(map[string]string{"Range": "bytes=3-4,0-1"})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Contains(t, body, "lo")
+	assert.Contains(t, body, "he")
+
+	resp, _ = get(map[string]string{"Range": "bytes=10-"})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+
+	// Resuming a download of the same blob
+	resp, body = get(map[string]string{"Range": "bytes=2-", "If-Range": etag})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "llo", body)
+
+	resp, body = get(map[string]string{"Range": "bytes=2-", "If-Range": `"0000"`})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", body)
+
+	resp, _ = get(map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+}
+
+func TestRawFileSniff(t *testing.T) {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	gitPath := writeGitStub(t, dir, fmt.Sprintf(`case "$*" in *"cat-file blob"*) echo >> %s ;; esac
+exec git "$@"
+`, calls))
+	server := New(Config{Dir: filepath.Join(dir, "repos"), GitPath: gitPath, AutoCreate: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+	work := filepath.Join(dir, "work")
+	large := strings.Repeat("0123456789", 100)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(work, "LARGE"), []byte(large), 0644))
+	for _, args := range [][]string{
+		{"add", "."},
+		{"commit", "-q", "-m", "second commit"},
+		{"push", "-q", ts.URL + "/test.git", "HEAD:refs/heads/master"},
+	} {
+		out, err := runGit(work, args...)
+		assert.NoError(t, err, out)
+	}
+
+	// The content type of files without extension is sniffed from the
+	// blob read by git once
+	for _, test := range []struct {
+		path string
+		rng  string
+		body string
+	}{
+		{"README", "", "hello"},
+		{"LARGE", "", large},
+		{"LARGE", "bytes=600-609", large[600:610]},
+	} {
+		assert.NoError(t, os.RemoveAll(calls))
+		req, _ := http.NewRequest("GET", ts.URL+"/test.git/repo/raw?path="+test.path, nil)
+		if test.rng != "" {
+			req.Header.Set("Range", test.rng)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"), test.path)
+		assert.Equal(t, test.body, string(body), test.path)
+		data, _ := ioutil.ReadFile(calls)
+		assert.Equal(t, 1, strings.Count(string(data), "\n"), test.path+" "+test.rng)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/team/project.git")
+	out, err := runGit(filepath.Join(dir, "work"), "push", "-q", ts.URL+"/team/project.git", "HEAD:refs/heads/feature/x")
+	assert.NoError(t, err, out)
+
+	get := func(query string) (*http.Response, []byte) {
+		resp, err := http.Get(ts.URL + "/team/project.git/repo/archive" + query)
+		if !assert.NoError(t, err, query) {
+			return &http.Response{}, nil
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, body
+	}
+
+	resp, body := get("")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/gzip", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=project-HEAD.tar.gz`, resp.Header.Get("Content-Disposition"))
+
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if assert.NoError(t, err) {
+		files := map[string]string{}
+		archive := tar.NewReader(gz)
+		for {
+			header, err := archive.Next()
+			if err != nil {
+				break
+			}
+			data, _ := ioutil.ReadAll(archive)
+			files[header.Name] = string(data)
+		}
+		assert.Equal(t, "hello", files["project-HEAD/README"])
+	}
+
+	resp, body = get("?ref=feature/x&format=zip")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/zip", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=project-feature-x.zip`, resp.Header.Get("Content-Disposition"))
+
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if assert.NoError(t, err) {
+		names := []string{}
+		for _, f := range archive.File {
+			names = append(names, f.Name)
+		}
+		assert.Contains(t, names, "project-feature-x/README")
+	}
+
+	resp, _ = get("?ref=missing")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = get("?format=rar")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = get("?ref=--output=/tmp/x")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestArchiveClientDisconnect(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	pidFile := filepath.Join(dir, "pid")
+	makeRepo(t, repos, "test.git")
+
+	// rev-parse succeeds, archive never finishes
+	gitPath := writeGitStub(t, dir, fmt.Sprintf("[ \"$3\" = rev-parse ] && exit 0\necho $$ > %s\nprintf data\nexec sleep 30\n", pidFile))
+	server := httptest.NewServer(New(Config{Dir: repos, GitPath: gitPath}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/test.git/repo/archive")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	buf := make([]byte, 4)
+	io.ReadFull(resp.Body, buf)
+	resp.Body.Close()
+
+	data, _ := ioutil.ReadFile(pidFile)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	assert.NotEqual(t, 0, pid)
+	assert.True(t, waitFor(5*time.Second, func() bool {
+		return syscall.Kill(pid, 0) != nil
+	}), "git process is still running after disconnect")
+}
@@ -0,0 +1,172 @@
+package gitkit
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KitCommit is an entry of the commit log
+type KitCommit struct {
+	SHA     string    `json:"sha" protobuf:"1"`
+	Author  string    `json:"author" protobuf:"2"`
+	Email   string    `json:"email" protobuf:"3"`
+	Date    time.Time `json:"date" protobuf:"4"`
+	Message string    `json:"message" protobuf:"5"`
+}
+
+// KitCompareResponse tells how far two refs have diverged
+type KitCompareResponse struct {
+	Base    string      `json:"base" protobuf:"1"`
+	Head    string      `json:"head" protobuf:"2"`
+	Ahead   int         `json:"ahead" protobuf:"3"`  // Commits of head missing from base
+	Behind  int         `json:"behind" protobuf:"4"` // Commits of base missing from head
+	Commits []KitCommit `json:"commits,omitempty" protobuf:"5"`
+}
+
+// Number of commits listed without ?limit= and at most
+const (
+	defaultCommitLimit = 30
+	maxCommitLimit     = 100
+)
+
+// Fields of a commit, separated by NUL bytes like the commits themselves
+// with -z, as they may contain anything else
+const commitFormat = "%H%x00%an%x00%ae%x00%aI%x00%B"
+
+// commits lists the commits reachable from ?ref=, HEAD by default, newest
+// first. ?limit= and ?skip= page through the log. Repositories without
+// commits have an empty log.
+func (s *Server) commits(_ string, w http.ResponseWriter, r *Request) error {
+	context := "commits"
+	query := r.URL.Query()
+	ref := query.Get("ref")
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	limit, skip := defaultCommitLimit, 0
+	var err error
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxCommitLimit {
+			s.httpError(w, r.Request, http.StatusBadRequest, "Bad Request")
+			return nil
+		}
+	}
+	if v := query.Get("skip"); v != "" {
+		if skip, err = strconv.Atoi(v); err != nil || skip < 0 {
+			s.httpError(w, r.Request, http.StatusBadRequest, "Bad Request")
+			return nil
+		}
+	}
+	if strings.HasPrefix(ref, "-") {
+		s.httpError(w, r.Request, http.StatusBadRequest, "Bad Request")
+		return nil
+	}
+
+	// The log starts at the resolved commit, so that refs cannot be taken
+	// as options. HEAD of empty repositories points to an unborn branch.
+	sha, err := s.gitOutput(r.Context(), "--git-dir", r.RepoPath, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil && ref == "HEAD" {
+		s.formatResponse(w, r.Request, &KitResponse{Data: []KitCommit{}}, http.StatusOK)
+		return nil
+	}
+	if err != nil {
+		s.httpError(w, r.Request, http.StatusNotFound, "Not Found")
+		return nil
+	}
+
+	out, err := s.gitOutput(r.Context(), "--git-dir", r.RepoPath, "log", "-z", "--format="+commitFormat,
+		"-n", strconv.Itoa(limit), "--skip="+strconv.Itoa(skip), strings.TrimSpace(sha))
+	if err != nil {
+		s.fail500(w, r.Request, context, err)
+		return err
+	}
+
+	commits, err := parseCommits(out)
+	if err != nil {
+		s.fail500(w, r.Request, context, err)
+		return err
+	}
+
+	s.formatResponse(w, r.Request, &KitResponse{Data: commits}, http.StatusOK)
+	return nil
+}
+
+// compare counts the commits ?head= is ahead of and behind ?base=, e.g. a
+// branch and the one it is to be merged into. With ?commits=true the commits
+// it is ahead are listed too, newest first and at most maxCommitLimit of them.
+func (s *Server) compare(_ string, w http.ResponseWriter, r *Request) error {
+	context := "compare"
+	query := r.URL.Query()
+
+	for _, ref := range []string{query.Get("base"), query.Get("head")} {
+		if ref == "" || strings.HasPrefix(ref, "-") {
+			s.httpError(w, r.Request, http.StatusBadRequest, "Bad Request")
+			return nil
+		}
+	}
+	// Refs are resolved first, so that they cannot be taken as options
+	shas := make([]string, 2)
+	for i, ref := range []string{query.Get("base"), query.Get("head")} {
+		sha, err := s.gitOutput(r.Context(), "--git-dir", r.RepoPath, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+		if err != nil {
+			s.httpError(w, r.Request, http.StatusNotFound, "Not Found")
+			return nil
+		}
+		shas[i] = strings.TrimSpace(sha)
+	}
+
+	out, err := s.gitOutput(r.Context(), "--git-dir", r.RepoPath, "rev-list", "--left-right", "--count", shas[0]+"..."+shas[1])
+	if err != nil {
+		s.fail500(w, r.Request, context, err)
+		return err
+	}
+	res := KitCompareResponse{Base: query.Get("base"), Head: query.Get("head")}
+	if _, err := fmt.Sscan(out, &res.Behind, &res.Ahead); err != nil {
+		s.fail500(w, r.Request, context, err)
+		return err
+	}
+
+	if query.Get("commits") == "true" {
+		out, err := s.gitOutput(r.Context(), "--git-dir", r.RepoPath, "log", "-z", "--format="+commitFormat,
+			"-n", strconv.Itoa(maxCommitLimit), shas[0]+".."+shas[1])
+		if err != nil {
+			s.fail500(w, r.Request, context, err)
+			return err
+		}
+		if res.Commits, err = parseCommits(out); err != nil {
+			s.fail500(w, r.Request, context, err)
+			return err
+		}
+	}
+
+	s.formatResponse(w, r.Request, &KitResponse{Data: res}, http.StatusOK)
+	return nil
+}
+
+// parseCommits parses the output of git log -z --format=commitFormat
+func parseCommits(out string) ([]KitCommit, error) {
+	commits := []KitCommit{}
+	if out == "" {
+		return commits, nil
+	}
+
+	fields := strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+	for i := 0; i+5 <= len(fields); i += 5 {
+		date, err := time.Parse(time.RFC3339, fields[i+3])
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, KitCommit{
+			SHA:     fields[i],
+			Author:  fields[i+1],
+			Email:   fields[i+2],
+			Date:    date,
+			Message: strings.TrimRight(fields[i+4], "\n"),
+		})
+	}
+	return commits, nil
+}
@@ -0,0 +1,152 @@
+package gitkit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommits(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	get := func(query string) (int, []KitCommit) {
+		resp, err := http.Get(ts.URL + "/test.git/repo/commits" + query)
+		if !assert.NoError(t, err, query) {
+			return 0, nil
+		}
+		defer resp.Body.Close()
+
+		var body struct {
+			Data []KitCommit `json:"data"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body), query)
+		}
+		return resp.StatusCode, body.Data
+	}
+
+	assert.NoError(t, server.CreateRepo("test.git"))
+	code, commits := get("")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []KitCommit{}, commits)
+
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+	work := filepath.Join(dir, "work")
+	for _, args := range [][]string{
+		{"commit", "-q", "--allow-empty", "-m", "second commit\n\nwith a body\x01 and | separators"},
+		{"commit", "-q", "--allow-empty", "-m", "third commit"},
+		{"push", "-q", ts.URL + "/test.git", "HEAD:refs/heads/master"},
+		{"push", "-q", ts.URL + "/test.git", "HEAD~2:refs/heads/old"},
+	} {
+		out, err := runGit(work, args...)
+		assert.NoError(t, err, out)
+	}
+	head, _ := runGit(work, "rev-parse", "HEAD")
+
+	code, commits = get("")
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, commits, 3) {
+		assert.Equal(t, head[:40], commits[0].SHA)
+		assert.Equal(t, "third commit", commits[0].Message)
+		assert.Equal(t, "second commit\n\nwith a body\x01 and | separators", commits[1].Message)
+		assert.Equal(t, "initial commit", commits[2].Message)
+		assert.Equal(t, "gitkit", commits[2].Author)
+		assert.Equal(t, "gitkit@localhost", commits[2].Email)
+		assert.False(t, commits[2].Date.IsZero())
+	}
+
+	code, commits = get("?limit=1&skip=1")
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, commits, 1) {
+		assert.Equal(t, "second commit\n\nwith a body\x01 and | separators", commits[0].Message)
+	}
+
+	code, commits = get("?ref=old")
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, commits, 1) {
+		assert.Equal(t, "initial commit", commits[0].Message)
+	}
+
+	code, commits = get("?skip=10")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []KitCommit{}, commits)
+
+	for _, query := range []string{"?ref=missing", "?ref=master:README"} {
+		code, _ = get(query)
+		assert.Equal(t, http.StatusNotFound, code, query)
+	}
+	for _, query := range []string{"?ref=--all", "?limit=0", "?limit=1000", "?limit=x", "?skip=-1"} {
+		code, _ = get(query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	get := func(query string) (int, KitCompareResponse) {
+		resp, err := http.Get(ts.URL + "/test.git/repo/compare" + query)
+		if !assert.NoError(t, err, query) {
+			return 0, KitCompareResponse{}
+		}
+		defer resp.Body.Close()
+
+		var body struct {
+			Data KitCompareResponse `json:"data"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body), query)
+		}
+		return resp.StatusCode, body.Data
+	}
+
+	// feature is two commits ahead of master and one behind
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+	work := filepath.Join(dir, "work")
+	for _, args := range [][]string{
+		{"checkout", "-q", "-b", "feature"},
+		{"commit", "-q", "--allow-empty", "-m", "first feature commit"},
+		{"commit", "-q", "--allow-empty", "-m", "second feature commit"},
+		{"checkout", "-q", "master"},
+		{"commit", "-q", "--allow-empty", "-m", "fix"},
+		{"push", "-q", ts.URL + "/test.git", "master", "feature"},
+	} {
+		out, err := runGit(work, args...)
+		assert.NoError(t, err, out)
+	}
+
+	code, res := get("?base=master&head=feature")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, KitCompareResponse{Base: "master", Head: "feature", Ahead: 2, Behind: 1}, res)
+
+	code, res = get("?base=feature&head=master&commits=true")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, res.Ahead)
+	assert.Equal(t, 2, res.Behind)
+	if assert.Len(t, res.Commits, 1) {
+		assert.Equal(t, "fix", res.Commits[0].Message)
+	}
+
+	code, res = get("?base=master&head=master&commits=true")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, KitCompareResponse{Base: "master", Head: "master"}, res)
+
+	for _, query := range []string{"?base=master&head=missing", "?base=missing&head=master"} {
+		code, _ = get(query)
+		assert.Equal(t, http.StatusNotFound, code, query)
+	}
+	for _, query := range []string{"", "?base=master", "?base=--all&head=master", "?base=master&head=-n1"} {
+		code, _ = get(query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+}
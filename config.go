@@ -1,22 +1,258 @@
 package gitkit
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type Config struct {
-	KeyDir     string       // Directory for server ssh keys. Only used in SSH strategy.
-	Dir        string       // Directory that contains repositories
-	GitPath    string       // Path to git binary
-	GitUser    string       // User for ssh connections
-	AutoCreate bool         // Automatically create repostories
-	AutoHooks  bool         // Automatically setup git hooks
-	Hooks      *HookScripts // Scripts for hooks/* directory
-	Auth       bool         // Require authentication
+	KeyDir       string       // Directory for server ssh keys. Only used in SSH strategy.
+	Dir          string       // Directory that contains repositories
+	CreateDir    bool         // Create Dir and Dirs in Setup if they are missing
+	GitPath      string       // Path to git binary
+	GitUser      string       // User for ssh connections
+	AutoCreate   bool         // Automatically create repostories on push
+	AutoHooks    bool         // Automatically setup git hooks
+	Hooks        *HookScripts // Scripts for hooks/* directory
+	Auth         bool         // Require authentication
+	ProtocolV2   bool         // Allow clients to use git wire protocol version 2
+	MaxListDepth int          // Maximum directory depth searched when listing repositories
+	ReadOnly     bool         // Reject pushes and repository changes
+	DumbHTTP     bool         // Serve repository files to clients of the dumb HTTP protocol
+
+	// User and group ids git processes of the HTTP server run as, e.g. to
+	// keep tenants from reading files of the server. The server needs the
+	// privilege to switch users, usually by running as root, and the
+	// repository directories have to be writable by them. The processes get
+	// no supplementary groups. Zero keeps the ids of the server.
+	RunAsUID int
+	RunAsGID int
+
+	// Interval of the keepalive packets git sends over the side-band while
+	// it prepares a pack for a fetch or runs the hooks of a push, so that
+	// clients and proxies do not time out on large repositories. Git sends
+	// them every 5 seconds by default, negative values turn them off.
+	KeepAlive time.Duration
+
+	// Bytes per second git output is sent at to each client, for fetches,
+	// clones and ref advertisements. Zero means no limit.
+	MaxBytesPerSec int64
+
+	// Directory git processes keep temporary files in, passed to them as
+	// TMPDIR, e.g. on hosts with a small /tmp. It has to exist and be
+	// writable by them. Empty keeps the TMPDIR of the server.
+	TempDir string
+
+	// How long the ref advertisements of repositories, sent to clients before
+	// fetches and pushes, are reused instead of asking git, e.g. for busy CI
+	// fetching the same repositories. Changes made through the server, pushes
+	// included, drop them right away, others, e.g. over SSH, may be missed
+	// until they expire. Advertisements are shared by all clients, so the
+	// cache is not used when Server.GitEnvFunc is set, as its environment
+	// may hide refs from some of them. Zero means git is always asked.
+	AdvertiseCacheTTL time.Duration
+
+	// Maximum number of git processes serving fetches, clones and archives at
+	// once, and of pushes, which are counted apart so that a rush of clones
+	// does not hold them up. Requests beyond it get 503 Service Unavailable
+	// and Retry-After instead of waiting. Zero means no limit.
+	MaxConcurrentProcs  int
+	MaxConcurrentPushes int
+
+	// Maximum duration of a request. Git processes still running are killed
+	// and the connection is closed once it passes. Zero means no limit.
+	RequestTimeout time.Duration
+
+	// Services to turn off, matched by rpc name ("git-receive-pack"), path
+	// suffix ("/repo") or method and suffix ("DELETE /repo")
+	DisabledServices []string
+
+	// Regular expression the names of new repositories, namespace included,
+	// have to match. Defaults to DefaultRepoNamePattern, New panics if the
+	// pattern does not compile.
+	RepoNamePattern string
+
+	// Directories repositories are stored in, searched in order, instead of
+	// Dir alone. New repositories go to the first writable one. Only used by
+	// the HTTP server.
+	Dirs []string
+
+	// Computes where a repository is stored instead of Dir/namespace/name,
+	// e.g. for sharded layouts. Request.RepoName keeps the name used by the
+	// client. Only used by the HTTP server. Listings only include the
+	// repositories found where it puts them, so layouts whose directories do
+	// not follow the names, e.g. sharded ones, list nothing.
+	RepoPathFunc func(namespace, name string) string
+
+	// Suffix of the directory names of repositories, ".git" by default.
+	// Listings look for it, and names without it resolve to the repository
+	// with it, e.g. "project" to "project.git".
+	BareSuffix string
+
+	// Lists repositories whatever the name of their directory, ignoring
+	// BareSuffix, e.g. for layouts with plain directory names
+	AnyRepoName bool
+
+	// How long the decisions of AuthFunc are reused for requests with the same
+	// credentials, repository and operation. Rejections are kept for a tenth
+	// of it and errors not at all. Zero means AuthFunc is always asked.
+	AuthCacheTTL time.Duration
+
+	// How long AuthFunc may take, e.g. with an unresponsive LDAP server.
+	// Requests get 503 Service Unavailable once it passes and the request
+	// context is cancelled, which AuthFunc should watch to give up. Zero
+	// means no limit.
+	AuthTimeout time.Duration
+
+	// How clients authenticate when Auth is set, AuthMethodHeader by default.
+	// AuthMethodMTLS relies on the certificate verification of the TLS server,
+	// which has to be set up with tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}.
+	AuthMethod string
+
+	// Realm of the Basic challenge sent to clients without credentials,
+	// "Git" by default. Credential helpers may store passwords per realm.
+	AuthRealm string
+
+	// Permissions of new repositories, passed to git init --shared, e.g.
+	// "group" so that several users in the group of the repositories can
+	// push, or an octal mode like "0660". Empty keeps the umask of the
+	// server, New panics if git would not accept the value.
+	SharedRepo string
+
+	// Branch HEAD of new repositories points to, unless another one is
+	// requested on creation. Empty keeps the default of the git binary.
+	DefaultBranch string
+
+	// Maximum size of a push in bytes, after decompression. Larger pushes are
+	// aborted with 413 Request Entity Too Large. Zero means no limit.
+	MaxPushSize int64
+
+	// Maximum depth of shallow clones and fetches. Deeper ones, and those by
+	// date or ref, are rejected with an error shown by git. Full clones are
+	// not affected. Zero means no limit.
+	MaxCloneDepth int
+
+	// Turn off partial clones, e.g. git clone --filter=blob:none, which are
+	// served to clients speaking protocol v2, see ProtocolV2. Clients then
+	// fetch whole repositories, as upload-pack no longer offers filtering,
+	// and requests with a filter anyway are rejected with an error shown by
+	// git. Protocol v0 clients always fetch whole repositories.
+	DisablePartialClone bool
+
+	// Check the objects of pushes with git fsck, rejecting pushes with
+	// corrupt or malformed ones. Every pushed object is parsed, which makes
+	// large pushes take noticeably longer and use more memory.
+	FsckOnReceive bool
+
+	// Directory holding repository templates, one directory each. New
+	// repositories created with a template get its files as initial commit
+	// on their default branch, empty templates are ignored.
+	TemplateDir string
+
+	// Git config keys POST /repo may set in new repositories, e.g.
+	// "core.compression" or "core.bigFileThreshold". Keys are matched
+	// ignoring case. Requests setting other keys are rejected, all of them
+	// if there are none, as keys like core.fsmonitor run commands.
+	AllowedRepoConfigKeys []string
+
+	// Endpoints notified after successful pushes
+	Webhooks []WebhookConfig
+
+	// Path the server is mounted at, e.g. "/git". It is removed from request
+	// paths before they are parsed, other paths are not found.
+	PathPrefix string
+
+	// Returns the hook scripts of a repository, named with its namespace,
+	// e.g. stricter ones for some namespaces. Hooks is used when it returns
+	// nil or is not set.
+	HooksFunc func(repoName string) *HookScripts
+
+	// Returns the upstream of a repository, named with its namespace, that
+	// POST /repo/sync and Server.SyncMirror fetch from. Repositories it
+	// returns nil for are not mirrors.
+	MirrorFunc func(repoName string) *MirrorConfig
+
+	// Take client addresses from the X-Forwarded-For or X-Real-IP headers of
+	// a reverse proxy, for logs and rate limiting, and the URL of the server
+	// from X-Forwarded-Proto and X-Forwarded-Host, for LFS links. Only set it
+	// when every request comes through a proxy setting them.
+	TrustProxy bool
+
+	// Networks clients may connect from, in CIDR notation, e.g.
+	// "10.0.0.0/8" or "2001:db8::/32", and networks they may not. Denied
+	// ones win, any network is allowed if none are. Addresses come from
+	// proxy headers with TrustProxy. New panics on invalid networks, so that
+	// a typo cannot leave the server open.
+	AllowedCIDRs []string
+	DeniedCIDRs  []string
+
+	// Reject git requests compressed with gzip, fetches and pushes alike,
+	// with 415 Unsupported Media Type instead of decompressing them, which a
+	// small body can make costly. Gzip requests are accepted by default: the
+	// option is the inverse of an AllowGzipRequests option defaulting to
+	// true, which the zero value of a bool could not express.
+	RejectGzipRequests bool
+
+	// Maximum size of a fetch request compressed with gzip in bytes, after
+	// decompression. Larger ones are aborted with 413 Request Entity Too
+	// Large. Zero means no limit. Pushes are limited by MaxPushSize.
+	MaxGzipRequestSize int64
+
+	// Compression level of info/refs responses to clients accepting gzip,
+	// from gzip.HuffmanOnly to gzip.BestCompression. Zero means
+	// gzip.DefaultCompression, New panics if the level is invalid.
+	GzipLevel int
+
+	// Send info/refs responses uncompressed even to clients accepting gzip,
+	// e.g. when a proxy compresses them already
+	DisableGzip bool
+
+	// Requests allowed per minute and client, users when authenticated and
+	// addresses otherwise, in bursts of up to as many. Further requests are
+	// rejected with 429 Too Many Requests. Zero means no limit.
+	RateLimit int
+
+	// Serve the Git LFS batch API, storing objects in the lfs directory of
+	// repositories
+	LFS bool
+
+	// Serve git upload-archive over HTTP at POST /git-upload-archive. It is
+	// off by default as it lets clients read any tree reachable from the
+	// refs, down to single paths, without fetching. See
+	// uploadArchive.allowUnreachable in git-config(1).
+	AllowUploadArchive bool
+
+	// Refuse git archive --remote over SSH, which the SSH server has always
+	// accepted
+	DisableSSHUploadArchive bool
+
+	// Receives a line per HTTP request in the Combined Log Format, followed
+	// by the duration of the request in seconds, e.g. for log pipelines made
+	// for web servers. Nothing is written if it is not set.
+	AccessLog io.Writer
+
+	// Send errors as JSON KitResponse bodies with a KitErrorResponse, instead
+	// of plain text. Responses to git clients stay plain text.
+	JSONErrors bool
+
+	// Headers set on every HTTP response, e.g. X-Content-Type-Options:
+	// nosniff, before the request is handled. Headers the handlers set
+	// themselves, like Content-Type and Cache-Control, should be left out.
+	ExtraHeaders map[string]string
 }
 
+// Authentication methods, see Config.AuthMethod
+const (
+	AuthMethodHeader = "header" // Basic or bearer credentials in the Authorization header
+	AuthMethodMTLS   = "mtls"   // TLS client certificates
+)
+
 // HookScripts represents all repository server-size git hooks
 type HookScripts struct {
 	PreReceive  string
@@ -53,7 +289,6 @@ func (c *HookScripts) setupInDir(path string) error {
 		}
 
 		if err := ioutil.WriteFile(fullPath, []byte(script), 0755); err != nil {
-			logError("hook-update", err)
 			return err
 		}
 	}
@@ -61,17 +296,94 @@ func (c *HookScripts) setupInDir(path string) error {
 	return nil
 }
 
+// credential returns the user git processes run as, nil to keep the user of
+// the server
+func (c *Config) credential() *syscall.Credential {
+	if c.RunAsUID == 0 && c.RunAsGID == 0 {
+		return nil
+	}
+
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	if c.RunAsUID != 0 {
+		uid = uint32(c.RunAsUID)
+	}
+	if c.RunAsGID != 0 {
+		gid = uint32(c.RunAsGID)
+	}
+	// No supplementary groups, those of the server would be kept otherwise
+	return &syscall.Credential{Uid: uid, Gid: gid, Groups: []uint32{}}
+}
+
+// authenticate returns the WWW-Authenticate challenge of the server
+func (c *Config) authenticate() string {
+	realm := c.AuthRealm
+	if realm == "" {
+		realm = "Git"
+	}
+	realm = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(realm)
+	return `Basic realm="` + realm + `"`
+}
+
+// bareSuffix returns the suffix of repository directory names, empty if any
+// name goes
+func (c *Config) bareSuffix() string {
+	if c.AnyRepoName {
+		return ""
+	}
+	if c.BareSuffix == "" {
+		return ".git"
+	}
+	return c.BareSuffix
+}
+
+// repoConfigAllowed reports whether POST /repo may set the git config key,
+// see AllowedRepoConfigKeys
+func (c *Config) repoConfigAllowed(key string) bool {
+	for _, allowed := range c.AllowedRepoConfigKeys {
+		if strings.EqualFold(key, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// hooksFor returns the hook scripts of a repository, nil if there are none
+func (c *Config) hooksFor(repoName string) *HookScripts {
+	if c.HooksFunc != nil {
+		if hooks := c.HooksFunc(repoName); hooks != nil {
+			return hooks
+		}
+	}
+	return c.Hooks
+}
+
 func (c *Config) KeyPath() string {
 	return filepath.Join(c.KeyDir, "gitkit.rsa")
 }
 
 func (c *Config) Setup() error {
-	if _, err := os.Stat(c.Dir); err != nil {
-		if err = os.Mkdir(c.Dir, 0755); err != nil {
+	for _, dir := range c.roots() {
+		_, err := os.Stat(dir)
+		if os.IsNotExist(err) && c.CreateDir {
+			err = os.MkdirAll(dir, 0755)
+		} else if os.IsNotExist(err) {
+			err = fmt.Errorf("repositories directory %s does not exist, create it or set Config.CreateDir", dir)
+		}
+		if err != nil {
 			return err
 		}
 	}
 
+	if c.TempDir != "" {
+		info, err := os.Stat(c.TempDir)
+		if err != nil {
+			return fmt.Errorf("temporary directory: %v", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("temporary directory %s is not a directory", c.TempDir)
+		}
+	}
+
 	if c.AutoHooks == true {
 		return c.setupHooks()
 	}
@@ -80,20 +392,27 @@ func (c *Config) Setup() error {
 }
 
 func (c *Config) setupHooks() error {
-	files, err := ioutil.ReadDir(c.Dir)
-	if err != nil {
-		return err
-	}
-
-	for _, file := range files {
-		if !file.IsDir() {
-			continue
+	for _, dir := range c.roots() {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
 		}
 
-		path := filepath.Join(c.Dir, file.Name())
+		for _, file := range files {
+			if !file.IsDir() {
+				continue
+			}
 
-		if err := c.Hooks.setupInDir(path); err != nil {
-			return err
+			hooks := c.hooksFor(file.Name())
+			if hooks == nil {
+				continue
+			}
+
+			path := filepath.Join(dir, file.Name())
+
+			if err := hooks.setupInDir(path); err != nil {
+				return err
+			}
 		}
 	}
 
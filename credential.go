@@ -1,24 +1,48 @@
 package gitkit
 
 import (
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 )
 
+const (
+	BasicScheme       = "basic"
+	BearerScheme      = "bearer"
+	CertificateScheme = "certificate"
+)
+
+// ErrForbidden is returned by AuthFunc to reject users it has recognized but
+// who lack access to the repository or operation. They get 403 Forbidden
+// instead of 401 Unauthorized, so that git does not ask for other credentials.
+var ErrForbidden = errors.New("forbidden")
+
 type Credential struct {
 	Username string
 	Password string
 	Token    string
+	Scheme   string // One of BasicScheme, BearerScheme or CertificateScheme
+
+	// Verified TLS client certificate, if the client sent one
+	ClientCN    string
+	Certificate *x509.Certificate
 }
 
 func getCredential(req *http.Request) (Credential, error) {
 	cred := Credential{}
+	if cert := peerCertificate(req); cert != nil {
+		cred.ClientCN = cert.Subject.CommonName
+		cred.Certificate = cert
+	}
 
 	user, pass, ok := req.BasicAuth()
 	if !ok {
 		// return auth
 		if token, ok := tokenAuth(req); ok {
 			cred.Token = token
+			cred.Scheme = BearerScheme
 			return cred, nil
 		}
 		return cred, fmt.Errorf("authentication failed")
@@ -26,13 +50,45 @@ func getCredential(req *http.Request) (Credential, error) {
 
 	cred.Username = user
 	cred.Password = pass
+	cred.Scheme = BasicScheme
 
 	return cred, nil
 }
 
+// getCertificateCredential authenticates the client by its TLS certificate
+func getCertificateCredential(req *http.Request) (Credential, error) {
+	cert := peerCertificate(req)
+	if cert == nil {
+		return Credential{}, fmt.Errorf("no client certificate provided")
+	}
+
+	return Credential{
+		Scheme:      CertificateScheme,
+		ClientCN:    cert.Subject.CommonName,
+		Certificate: cert,
+	}, nil
+}
+
+// peerCertificate returns the leaf certificate sent by the client, if any
+func peerCertificate(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return req.TLS.PeerCertificates[0]
+}
+
+// tokenAuth returns the token from the Authorization header. Both "Bearer"
+// and "token" schemes are accepted, a header without a scheme is taken as is.
 func tokenAuth(req *http.Request) (string, bool) {
-	if token := req.Header.Get("Authorization"); token != "" {
-		return token, true
+	header := strings.TrimSpace(req.Header.Get("Authorization"))
+	if header == "" {
+		return "", false
 	}
-	return "", false
+
+	scheme := strings.Fields(header)[0]
+	if strings.EqualFold(scheme, "bearer") || strings.EqualFold(scheme, "token") {
+		header = strings.TrimSpace(header[len(scheme):])
+	}
+
+	return header, header != ""
 }
@@ -1,6 +1,9 @@
 package gitkit
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"net/http"
 	"testing"
 
@@ -21,3 +24,63 @@ func Test_getCredential(t *testing.T) {
 	assert.Equal(t, "Alladin", cred.Username)
 	assert.Equal(t, "OpenSesame", cred.Password)
 }
+
+func Test_getCredentialToken(t *testing.T) {
+	cases := map[string]string{
+		"Bearer abc.def.ghi": "abc.def.ghi",
+		"bearer abc.def.ghi": "abc.def.ghi",
+		"BEARER  abc":        "abc",
+		"token abc123":       "abc123",
+		"Token abc123":       "abc123",
+		"abc123":             "abc123",
+		"Bearerabc":          "Bearerabc",
+	}
+
+	for header, expected := range cases {
+		req, _ := http.NewRequest("get", "http://localhost", nil)
+		req.Header.Set("Authorization", header)
+		cred, err := getCredential(req)
+
+		assert.NoError(t, err)
+		assert.Equal(t, expected, cred.Token, header)
+		assert.Equal(t, BearerScheme, cred.Scheme)
+		assert.Equal(t, "", cred.Username)
+	}
+
+	req, _ := http.NewRequest("get", "http://localhost", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	_, err := getCredential(req)
+	assert.Error(t, err)
+
+	req, _ = http.NewRequest("get", "http://localhost", nil)
+	req.SetBasicAuth("Alladin", "OpenSesame")
+	cred, err := getCredential(req)
+	assert.NoError(t, err)
+	assert.Equal(t, BasicScheme, cred.Scheme)
+	assert.Equal(t, "", cred.Token)
+}
+
+func Test_getCertificateCredential(t *testing.T) {
+	req, _ := http.NewRequest("get", "https://localhost", nil)
+	_, err := getCertificateCredential(req)
+	assert.Error(t, err)
+
+	req.TLS = &tls.ConnectionState{}
+	_, err = getCertificateCredential(req)
+	assert.Error(t, err)
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "ci-runner"}}
+	req.TLS.PeerCertificates = []*x509.Certificate{cert}
+	cred, err := getCertificateCredential(req)
+	assert.NoError(t, err)
+	assert.Equal(t, CertificateScheme, cred.Scheme)
+	assert.Equal(t, "ci-runner", cred.ClientCN)
+	assert.Equal(t, cert, cred.Certificate)
+
+	// Certificates are also reported along with header credentials
+	req.SetBasicAuth("Alladin", "OpenSesame")
+	cred, err = getCredential(req)
+	assert.NoError(t, err)
+	assert.Equal(t, BasicScheme, cred.Scheme)
+	assert.Equal(t, "ci-runner", cred.ClientCN)
+}
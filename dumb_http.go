@@ -0,0 +1,94 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Files requested by clients speaking the dumb HTTP protocol. The first group
+// is the repository path, the second one is the file within the repository.
+var dumbFileRegex = regexp.MustCompile(`^(.*)/(HEAD|objects/info/(?:alternates|http-alternates|packs)|objects/[0-9a-f]{2}/[0-9a-f]{38,62}|objects/pack/pack-[0-9a-f]{40,64}\.(?:pack|idx))$`)
+
+// findDumbService matches requests for static repository files
+func (s *Server) findDumbService(req *http.Request) (*service, string) {
+	if !s.config.DumbHTTP || req.Method != http.MethodGet {
+		return nil, ""
+	}
+
+	matches := dumbFileRegex.FindStringSubmatch(req.URL.Path)
+	if matches == nil {
+		return nil, ""
+	}
+	return &service{http.MethodGet, "/" + matches[2], (*Server).getDumbFile, "", "file"}, matches[1]
+}
+
+func (s *Server) getDumbFile(_ string, w http.ResponseWriter, r *Request) error {
+	matches := dumbFileRegex.FindStringSubmatch(r.URL.Path)
+	if matches == nil {
+		s.httpError(w, r.Request, http.StatusNotFound, "Not Found")
+		return nil
+	}
+	s.serveDumbFile(w, r, matches[2])
+	return nil
+}
+
+// serveDumbFile sends a file from the repository with the headers
+// git-http-backend uses for it
+func (s *Server) serveDumbFile(w http.ResponseWriter, r *Request, name string) error {
+	f, err := os.Open(path.Join(r.RepoPath, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.httpError(w, r.Request, http.StatusNotFound, "Not Found")
+			return nil
+		}
+		s.fail500(w, r.Request, "dumb-http", err)
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		s.fail500(w, r.Request, "dumb-http", err)
+		return err
+	}
+	if info.IsDir() {
+		s.httpError(w, r.Request, http.StatusNotFound, "Not Found")
+		return nil
+	}
+
+	contentType := "text/plain"
+	cacheControl := "no-cache"
+	switch {
+	case name == "objects/info/packs":
+		contentType = "text/plain; charset=utf-8"
+	case strings.HasSuffix(name, ".pack"):
+		contentType = "application/x-git-packed-objects"
+		cacheControl = "public, max-age=31536000"
+	case strings.HasSuffix(name, ".idx"):
+		contentType = "application/x-git-packed-objects-toc"
+		cacheControl = "public, max-age=31536000"
+	case strings.HasPrefix(name, "objects/") && !strings.HasPrefix(name, "objects/info/"):
+		contentType = "application/x-git-loose-object"
+		cacheControl = "public, max-age=31536000"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", cacheControl)
+	http.ServeContent(w, r.Request, name, info.ModTime(), f)
+	return nil
+}
+
+// updateServerInfo refreshes the auxiliary files dumb clients rely on
+func updateServerInfo(ctx context.Context, gitPath string, repoPath string) error {
+	out, err := exec.CommandContext(ctx, gitPath, "--git-dir", repoPath, "update-server-info").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
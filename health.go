@@ -0,0 +1,48 @@
+package gitkit
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type KitHealthResponse struct {
+	Status     string `json:"status" protobuf:"1"` // "ok" or "unavailable"
+	GitVersion string `json:"gitVersion,omitempty" protobuf:"2"`
+	Error      string `json:"error,omitempty" protobuf:"3"`
+}
+
+// healthz reports whether the server can serve requests: the git binary has
+// to run and the repository directory has to be writable. It does not
+// require authentication, so it tells nothing about repositories.
+func (s *Server) healthz(_ string, w http.ResponseWriter, r *Request) error {
+	health := KitHealthResponse{Status: "ok"}
+
+	err := s.checkHealth(r, &health)
+	code := http.StatusOK
+	if err != nil {
+		s.logError(r.Request, "healthz", err)
+		health.Status = "unavailable"
+		health.Error = err.Error()
+		code = http.StatusServiceUnavailable
+	}
+
+	body := &KitResponse{
+		Data: health,
+	}
+	s.formatResponse(w, r.Request, body, code)
+	return err
+}
+
+func (s *Server) checkHealth(r *Request, health *KitHealthResponse) error {
+	version, err := s.gitOutput(r.Context(), "--version")
+	if err != nil {
+		return err
+	}
+	health.GitVersion = strings.TrimPrefix(strings.TrimSpace(version), "git version ")
+
+	if err := checkWritable(s.createRoot()); err != nil {
+		return fmt.Errorf("repository directory is not writable: %v", err)
+	}
+	return nil
+}
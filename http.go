@@ -1,373 +1,2115 @@
 package gitkit
 
 import (
+	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
+)
+
+// DefaultRepoNamePattern allows letters, digits, dashes and underscores in
+// slash-separated names, optionally ending with ".git"
+const DefaultRepoNamePattern = `^[A-Za-z0-9_-]+(/[A-Za-z0-9_-]+)*(\.git)?$`
+
+// Errors of CreateRepo and DeleteRepo
+var (
+	ErrInvalidRepoName = errors.New("invalid repository name")
+	ErrRepoExists      = errors.New("repository already exists")
+	ErrRepoNotFound    = errors.New("repository not found")
+	ErrRepoNotEmpty    = errors.New("repository is not empty")
 )
 
 type service struct {
 	method  string
 	suffix  string
-	handler func(string, http.ResponseWriter, *Request)
+	handler func(*Server, string, http.ResponseWriter, *Request) error
 	rpc     string
+	op      string
 }
 
 type Server struct {
-	config         Config
-	services       []service
-	AuthFunc       func(Credential, *Request) (bool, error)
-	FilterRepoFunc func([]string, *Request) []string
+	config           Config
+	services         []service
+	disabledServices []service
+	repoNameRegex    *regexp.Regexp
+	AuthFunc         func(Credential, *Request) (bool, error)
+	FilterRepoFunc   func([]string, *Request) []string
+	PostReceiveFunc  func(*Request) error
+	RefUpdateFunc    func(*Request, []RefUpdate) error
+	Logger           Logger
+
+	// GitEnvFunc returns extra KEY=VALUE pairs for the environment of the git
+	// processes serving a request, and so of the hooks they run, e.g. to tell
+	// hooks who pushed
+	GitEnvFunc func(*Request) []string
+
+	// AuthFuncs are asked in order instead of AuthFunc, until one of them
+	// allows the request, e.g. to accept static tokens and LDAP users. The
+	// request is forbidden if none allows it and one returned ErrForbidden,
+	// and fails with the errors of the others if they did not answer.
+	AuthFuncs []func(Credential, *Request) (bool, error)
+
+	// AuthCacheBypassFunc tells which requests ask AuthFunc even though its
+	// decision is cached, see Config.AuthCacheTTL
+	AuthCacheBypassFunc func(*Request) bool
+
+	// RateLimiter is asked before each request once it is authenticated,
+	// with the user name or client address as key. New sets it up from
+	// Config.RateLimit, it can be replaced, e.g. to share limits between
+	// servers.
+	RateLimiter RateLimiter
+
+	// MetricsFunc is called once an operation has been handled, with the
+	// error that made it fail, e.g. git exiting with a non-zero status
+	MetricsFunc func(op string, repo string, duration time.Duration, err error)
+
+	// Parsed Config.AllowedCIDRs and Config.DeniedCIDRs
+	allowedNets []*net.IPNet
+	deniedNets  []*net.IPNet
+
+	*serverState
+}
+
+// serverState is shared by a Server and the copies of it requests are served
+// with, see UpdateConfig
+type serverState struct {
+	// Guards the configuration of the Server, see UpdateConfig
+	configLock sync.RWMutex
+
+	// Requests and git processes in flight, tracked for Shutdown
+	lock     sync.Mutex
+	closing  bool
+	active   sync.WaitGroup
+	commands map[*exec.Cmd]struct{}
+
+	// Git transfers running, see Config.MaxConcurrentProcs
+	procs  int
+	pushes int
+
+	// Repositories being garbage collected, keyed by path
+	gcs sync.Map
+
+	// Locks of repositories, keyed by path, see repoLock
+	repoLocksLock sync.Mutex
+	repoLocks     map[string]*pathLock
+
+	// Decisions of AuthFunc, see Config.AuthCacheTTL
+	authCache authCache
+
+	// Ref advertisements, see Config.AdvertiseCacheTTL
+	advertiseCache advertiseCache
+
+	// Serializes lines written to Config.AccessLog
+	accessLogLock sync.Mutex
 }
 
+// Operations a request can perform, see Request.Operation
+const (
+	OperationDownload  = "download"
+	OperationUpload    = "upload"
+	OperationList      = "list"
+	OperationCreate    = "create"
+	OperationRename    = "rename"
+	OperationFork      = "fork" // Then download of the source and upload of the fork
+	OperationDelete    = "delete"
+	OperationGC        = "gc"
+	OperationHooks     = "hooks"
+	OperationSetHead   = "set-head"
+	OperationSync      = "sync"
+	OperationSetConfig = "set-config"
+)
+
+// Request is a request to the server. RepoName, Namespace, RepoPath and
+// Operation are set before AuthFunc is called, and before the repository is
+// checked to exist or auto-created, so they may name a missing repository.
 type Request struct {
 	*http.Request
 	RepoName string
 	RepoPath string
+
+	// Namespace is the directory part of RepoName, e.g. "team" for
+	// team/project.git, and empty for top level repositories
+	Namespace string
+
+	// Operation tells what the request does, e.g. OperationDownload for
+	// fetches and clones or OperationUpload for pushes. It is set before
+	// AuthFunc is called so that access can be granted per operation.
+	Operation string
+
+	// ID identifies the request in logs, it is taken from the X-Request-ID
+	// header of the client or generated, and sent back in the response
+	ID string
+
+	// Credentials of the client when Config.Auth is set, for handlers that
+	// authorize the repositories named in the request body
+	credential Credential
+
+	// Body of LFS batch requests, parsed once for Operation and the handler,
+	// see readLFSBatch
+	lfsBatch    *lfsBatchRequest
+	lfsBatchErr error
 }
 
 type KitResponse struct {
-	Code int         `json:"code"`
-	Data interface{} `json:"data"`
+	Code int         `json:"code" protobuf:"1"`
+	Data interface{} `json:"data" protobuf:"2"`
 }
 
 type KitRepoResponse struct {
-	RepoPath string `json:"repoPath"`
+	RepoPath string `json:"repoPath" protobuf:"1"`
 }
 
 type KitListRepoResponse struct {
-	RepoPath []string `json:"repoPath"`
+	RepoPath []string `json:"repoPath" protobuf:"1"`
+	Total    int      `json:"total" protobuf:"2"`
+
+	// Details of the listed repositories, only with ?detail=true
+	Repos []KitRepoDetail `json:"repos,omitempty" protobuf:"3"`
+}
+
+// KitRepoDetail describes a repository of a listing. LastModified is when its
+// refs last changed, e.g. by a push.
+type KitRepoDetail struct {
+	Path         string    `json:"path" protobuf:"1"`
+	LastModified time.Time `json:"lastModified" protobuf:"2"`
+}
+
+type KitRepoSizeResponse struct {
+	RepoPath string `json:"repoPath" protobuf:"1"`
+	Size     int64  `json:"size" protobuf:"2"`    // Bytes used by objects, packed or loose
+	Garbage  int64  `json:"garbage" protobuf:"3"` // Bytes used by files git does not recognize
+}
+
+type KitCreateRepoRequest struct {
+	DefaultBranch string            `json:"defaultBranch"`
+	Description   string            `json:"description"`
+	Template      string            `json:"template"` // Directory in Config.TemplateDir
+	Config        map[string]string `json:"config"`   // Git config, see Config.AllowedRepoConfigKeys
+}
+
+type KitDescriptionResponse struct {
+	RepoPath    string `json:"repoPath" protobuf:"1"`
+	Description string `json:"description" protobuf:"2"`
+}
+
+// KitErrorResponse is the data of error responses, see Config.JSONErrors
+type KitErrorResponse struct {
+	Message string `json:"message" protobuf:"1"`
+}
+
+type KitReinstallHooksResponse struct {
+	Updated int               `json:"updated" protobuf:"1"`
+	Failed  []KitHooksFailure `json:"failed" protobuf:"2"`
+}
+
+type KitHooksFailure struct {
+	RepoPath string `json:"repoPath" protobuf:"1"`
+	Error    string `json:"error" protobuf:"2"`
+}
+
+type KitRenameRepoRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type KitForkRepoRequest struct {
+	Source string `json:"source"`
+	Dest   string `json:"dest"`
 }
 
 func New(cfg Config) *Server {
-	s := Server{config: cfg}
-	s.services = []service{
-		{"GET", "/info/refs", s.getInfoRefs, ""},
-		{"POST", "/git-upload-pack", s.postRPC, "git-upload-pack"},
-		{"POST", "/git-receive-pack", s.postRPC, "git-receive-pack"},
-		{"GET", "/repos", s.listRepo, ""},
-		{"POST", "/repo", s.createRepo, ""},
-		{"DELETE", "/repo", s.deleteRepo, ""},
+	s := &Server{serverState: &serverState{}}
+	s.authCache.now = time.Now
+	s.advertiseCache.now = time.Now
+
+	if err := s.configure(cfg); err != nil {
+		panic("gitkit: " + err.Error())
 	}
 
-	// Use PATH if full path is not specified
-	if s.config.GitPath == "" {
-		s.config.GitPath = "git"
+	if s.config.RateLimit > 0 {
+		s.RateLimiter = NewRateLimiter(s.config.RateLimit)
 	}
 
-	return &s
+	return s
 }
 
-// findService returns a matching git subservice and parsed repository name
-func (s *Server) findService(req *http.Request) (*service, string) {
-	for _, svc := range s.services {
-		if svc.method == req.Method && strings.HasSuffix(req.URL.Path, svc.suffix) {
-			path := strings.Replace(req.URL.Path, svc.suffix, "", 1)
-			return &svc, path
+// configure validates cfg, fills in its defaults and sets up the services it
+// enables. The server is left untouched if cfg is invalid.
+func (s *Server) configure(cfg Config) error {
+	services := []service{
+		{"GET", "/info/refs", (*Server).getInfoRefs, "", "info-refs"},
+		{"POST", "/git-upload-pack", (*Server).postRPC, "git-upload-pack", "upload-pack"},
+		{"POST", "/git-receive-pack", (*Server).postRPC, "git-receive-pack", "receive-pack"},
+		{"GET", "/repos", (*Server).listRepo, "", "list"},
+		{"POST", "/repo", (*Server).createRepo, "", "create"},
+		{"POST", "/repo/rename", (*Server).renameRepo, "", "rename"},
+		{"POST", "/repo/fork", (*Server).forkRepo, "", "fork"},
+		{"DELETE", "/repo", (*Server).deleteRepo, "", "delete"},
+		{"GET", "/repo/description", (*Server).getDescription, "", "description"},
+		{"GET", "/repo/branches", (*Server).listBranches, "", "branches"},
+		{"GET", "/repo/tags", (*Server).listTags, "", "tags"},
+		{"POST", "/repo/head", (*Server).setHead, "", "head"},
+		{"GET", "/repo/size", (*Server).repoSize, "", "size"},
+		{"POST", "/repo/gc", (*Server).gcRepo, "", "gc"},
+		{"POST", "/repo/sync", (*Server).syncMirrorRepo, "", "sync"},
+		{"POST", "/repo/hooks", (*Server).installHooks, "", "hooks"},
+		{"POST", "/admin/hooks/reinstall", (*Server).reinstallAllHooks, "", "reinstall-hooks"},
+		{"GET", "/repo/raw", (*Server).rawFile, "", "raw"},
+		{"GET", "/repo/archive", (*Server).archive, "", "archive"},
+		{"GET", "/repo/commits", (*Server).commits, "", "commits"},
+		{"GET", "/repo/compare", (*Server).compare, "", "compare"},
+		{"GET", "/repo/config", (*Server).getRepoConfig, "", "config"},
+		{"PUT", "/repo/config", (*Server).setRepoConfig, "", "set-config"},
+		{"GET", "/healthz", (*Server).healthz, "", "healthz"},
+	}
+
+	if cfg.LFS {
+		services = append(services, service{"POST", "/info/lfs/objects/batch", (*Server).lfsBatch, "", "lfs-batch"})
+	}
+
+	if cfg.AllowUploadArchive {
+		services = append(services, service{"POST", "/git-upload-archive", (*Server).postUploadArchive, "git-upload-archive", "upload-archive"})
+	}
+
+	var disabled []service
+	if len(cfg.DisabledServices) > 0 {
+		enabled := []service{}
+		for _, svc := range services {
+			if !svc.matchesAny(cfg.DisabledServices) {
+				enabled = append(enabled, svc)
+			} else {
+				disabled = append(disabled, svc)
+			}
 		}
+		services = enabled
 	}
-	return nil, ""
-}
 
-func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	logInfo("request", r.Method+" "+r.Host+r.URL.String())
+	// Use PATH if full path is not specified
+	if cfg.GitPath == "" {
+		cfg.GitPath = "git"
+	}
 
-	// Find the git subservice to handle the request
-	svc, repoUrlPath := s.findService(r)
-	if svc == nil {
-		http.Error(w, "Forbidden", http.StatusForbidden)
-		return
+	if cfg.MaxListDepth <= 0 {
+		cfg.MaxListDepth = 3
 	}
 
-	// Determine namespace and repo name from request path
-	repoNamespace, repoName := getNamespaceAndRepo(repoUrlPath)
-	if r.Method == http.MethodGet && strings.HasSuffix(r.RequestURI, "/repos") {
-		// skip list repos
-	} else if repoName == "" {
-		logError("auth", fmt.Errorf("no repo name provided"))
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	// Keep the prefix in its canonical form, e.g. "/git" or none at all
+	cfg.PathPrefix = strings.TrimRight("/"+strings.Trim(cfg.PathPrefix, "/"), "/")
+
+	if cfg.RepoNamePattern == "" {
+		cfg.RepoNamePattern = DefaultRepoNamePattern
+	}
+	repoNameRegex, err := regexp.Compile(cfg.RepoNamePattern)
+	if err != nil {
+		return err
 	}
 
-	req := &Request{
-		Request:  r,
-		RepoName: path.Join(repoNamespace, repoName),
-		RepoPath: path.Join(s.config.Dir, repoNamespace, repoName),
+	if cfg.GzipLevel == 0 {
+		cfg.GzipLevel = gzip.DefaultCompression
+	}
+	if cfg.GzipLevel < gzip.HuffmanOnly || cfg.GzipLevel > gzip.BestCompression {
+		return fmt.Errorf("invalid gzip level %d", cfg.GzipLevel)
 	}
 
-	if s.config.Auth {
-		if s.AuthFunc == nil {
-			logError("auth", fmt.Errorf("no auth backend provided"))
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+	if cfg.SharedRepo != "" && !validSharedRepo(cfg.SharedRepo) {
+		return fmt.Errorf("invalid shared repository value %q", cfg.SharedRepo)
+	}
 
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			w.Header()["WWW-Authenticate"] = []string{`Basic realm=""`}
-			w.WriteHeader(http.StatusUnauthorized)
-			return
+	allowedNets, err := parseCIDRs(cfg.AllowedCIDRs)
+	if err != nil {
+		return fmt.Errorf("allowed networks: %v", err)
+	}
+	deniedNets, err := parseCIDRs(cfg.DeniedCIDRs)
+	if err != nil {
+		return fmt.Errorf("denied networks: %v", err)
+	}
+
+	s.config = cfg
+	s.services = services
+	s.disabledServices = disabled
+	s.repoNameRegex = repoNameRegex
+	s.allowedNets = allowedNets
+	s.deniedNets = deniedNets
+	return nil
+}
+
+// matchesAny reports whether the service is referred to by any of the names
+func (svc service) matchesAny(names []string) bool {
+	for _, name := range names {
+		if name == svc.suffix || name == svc.method+" "+svc.suffix || svc.rpc != "" && name == svc.rpc {
+			return true
 		}
+	}
+	return false
+}
 
-		cred, err := getCredential(r)
-		if err != nil {
-			logError("auth", err)
-			w.WriteHeader(http.StatusUnauthorized)
-			return
+// operation returns what a request to the service does, see Request.Operation
+func (svc service) operation(req *Request) string {
+	switch svc.op {
+	case "info-refs":
+		if req.URL.Query().Get("service") == "git-receive-pack" {
+			return OperationUpload
 		}
+		return OperationDownload
+	case "receive-pack", "lfs-upload":
+		return OperationUpload
+	case "lfs-batch":
+		return lfsBatchOperation(req)
+	case "list":
+		return OperationList
+	case "create":
+		return OperationCreate
+	case "rename":
+		return OperationRename
+	case "fork":
+		return OperationFork
+	case "delete":
+		return OperationDelete
+	case "gc":
+		return OperationGC
+	case "hooks", "reinstall-hooks":
+		return OperationHooks
+	case "head":
+		return OperationSetHead
+	case "sync":
+		return OperationSync
+	case "set-config":
+		return OperationSetConfig
+	}
+	return OperationDownload
+}
 
-		allow, err := s.AuthFunc(cred, req)
-		if !allow || err != nil {
-			if err != nil {
-				logError("auth", err)
-			}
+// modifies reports whether the request to the service changes repositories
+func (svc service) modifies(req *Request) bool {
+	switch req.Operation {
+	case OperationDownload, OperationList:
+		return false
+	}
+	return true
+}
 
-			logError("auth", fmt.Errorf("rejected user %s", cred.Username))
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+// namedInBody reports whether the service takes the names of the repositories
+// it works on from the request body, if any, rather than from the path
+func (svc service) namedInBody() bool {
+	switch svc.op {
+	case "list", "rename", "fork", "reinstall-hooks":
+		return true
 	}
+	return false
+}
 
-	if req.Method == http.MethodPost && strings.HasSuffix(req.RequestURI, "/repo") ||
-		req.Method == http.MethodGet && strings.HasSuffix(req.RequestURI, "/repos") {
-		// skip create repo
-		svc.handler(svc.rpc, w, req)
-		return
+// transfer reports whether the request runs git to transfer objects, see
+// Config.MaxConcurrentProcs, and whether it is a push
+func (svc service) transfer(req *Request) (push bool, ok bool) {
+	switch svc.op {
+	case "info-refs", "upload-pack", "receive-pack", "upload-archive", "archive":
+		return req.Operation == OperationUpload, true
 	}
+	return false, false
+}
 
-	if !repoExists(req.RepoPath) && s.config.AutoCreate {
-		err := initRepo(req.RepoName, &s.config)
-		if err != nil {
-			logError("repo-init", err)
+// rpcEnabled reports whether the git rpc is served
+func (s *Server) rpcEnabled(rpc string) bool {
+	for _, svc := range s.services {
+		if svc.rpc == rpc {
+			return true
 		}
 	}
+	return false
+}
 
-	if !repoExists(req.RepoPath) {
-		logError("repo-init", fmt.Errorf("%s does not exist", req.RepoPath))
-		http.NotFound(w, r)
-		return
+// isDisabled reports whether the request is for a service turned off with
+// Config.DisabledServices
+func (s *Server) isDisabled(req *http.Request) bool {
+	for _, svc := range s.disabledServices {
+		if svc.method == req.Method && strings.HasSuffix(req.URL.Path, svc.suffix) {
+			return true
+		}
 	}
+	return false
+}
 
-	svc.handler(svc.rpc, w, req)
+// findService returns a matching git subservice and parsed repository name
+func (s *Server) findService(req *http.Request) (*service, string) {
+	for _, svc := range s.services {
+		if svc.method == req.Method && strings.HasSuffix(req.URL.Path, svc.suffix) {
+			path := strings.Replace(req.URL.Path, svc.suffix, "", 1)
+			return &svc, path
+		}
+	}
+	if svc, path := s.findDumbService(req); svc != nil {
+		return svc, path
+	}
+	return s.findLFSService(req)
 }
 
-func (s *Server) getInfoRefs(_ string, w http.ResponseWriter, r *Request) {
-	context := "get-info-refs"
-	rpc := r.URL.Query().Get("service")
+func (s *Server) logger() Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return defaultLogger
+}
 
-	if !(rpc == "git-upload-pack" || rpc == "git-receive-pack") {
-		http.Error(w, "Not Found", 404)
+// logError logs an error, tagged with the ID of the request it occurred in
+// unless r is nil
+func (s *Server) logError(r *http.Request, context string, err error) {
+	if id := requestID(r); id != "" {
+		s.logger().Errorf("%s: %v [%s]", context, err, id)
 		return
 	}
+	s.logger().Errorf("%s: %v", context, err)
+}
 
-	cmd, pipe := gitCommand(s.config.GitPath, subCommand(rpc), "--stateless-rpc", "--advertise-refs", r.RepoPath)
-	if err := cmd.Start(); err != nil {
-		fail500(w, context, err)
+func (s *Server) logInfo(r *http.Request, context string, message string) {
+	if id := requestID(r); id != "" {
+		s.logger().Infof("%s: %s [%s]", context, message, id)
 		return
 	}
-	defer cleanUpProcessGroup(cmd)
+	s.logger().Infof("%s: %s", context, message)
+}
 
-	w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-advertisement", rpc))
-	w.Header().Add("Cache-Control", "no-cache")
-	w.WriteHeader(200)
+func (s *Server) fail500(w http.ResponseWriter, r *http.Request, context string, err error) {
+	s.httpError(w, r, 500, "Internal server error")
+	s.logError(r, context, err)
+}
 
-	if err := packLine(w, fmt.Sprintf("# service=%s\n", rpc)); err != nil {
-		logError(context, err)
+// httpError responds with a plain text error, or with a KitResponse when
+// Config.JSONErrors is set. Git clients always get plain text.
+func (s *Server) httpError(w http.ResponseWriter, r *http.Request, code int, message string) {
+	if s.config.JSONErrors && !isGitRequest(r) {
+		body := &KitResponse{
+			Data: KitErrorResponse{Message: message},
+		}
+		s.formatResponse(w, r, body, code)
 		return
 	}
+	http.Error(w, message, code)
+}
 
-	if err := packFlush(w); err != nil {
-		logError(context, err)
-		return
+// isGitRequest reports whether the request is part of the git protocol,
+// smart or dumb, or of the LFS API
+func isGitRequest(r *http.Request) bool {
+	p := r.URL.Path
+	return strings.HasSuffix(p, "/info/refs") ||
+		strings.HasSuffix(p, "/git-upload-pack") ||
+		strings.HasSuffix(p, "/git-receive-pack") ||
+		strings.HasSuffix(p, "/git-upload-archive") ||
+		strings.Contains(p, "/info/lfs/") ||
+		dumbFileRegex.MatchString(p)
+}
+
+// formatResponse sends body as JSON with the status code, which is also the
+// code of KitResponse bodies that do not set one. Clients that prefer
+// protocol buffers in their Accept header get them instead.
+func (s *Server) formatResponse(w http.ResponseWriter, r *http.Request, body interface{}, code int) {
+	if kit, ok := body.(*KitResponse); ok && kit.Code == 0 {
+		kit.Code = code
 	}
 
-	if _, err := io.Copy(w, pipe); err != nil {
-		logError(context, err)
-		return
+	contentType := "application/json"
+	marshal := json.Marshal
+	if acceptsProtobuf(r) {
+		contentType = protobufContentType
+		marshal = marshalProtobuf
 	}
+	w.Header().Add("Vary", "Accept")
 
-	if err := cmd.Wait(); err != nil {
-		logError(context, err)
+	data, err := marshal(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		s.logError(r, "marshal response", err)
 		return
 	}
+
+	w.Header().Add("Content-Type", contentType)
+	w.Header().Add("Cache-Control", "no-cache")
+	w.WriteHeader(code)
+	w.Write(data)
 }
 
-func (s *Server) postRPC(rpc string, w http.ResponseWriter, r *Request) {
-	context := "post-rpc"
-	body := r.Body
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Requests are served with the configuration they started with
+	s = s.snapshot()
 
-	if r.Header.Get("Content-Encoding") == "gzip" {
-		var err error
-		body, err = gzip.NewReader(r.Body)
-		if err != nil {
-			fail500(w, context, err)
-			return
-		}
+	if s.config.AccessLog != nil {
+		rec := &accessRecorder{ResponseWriter: w}
+		defer s.logAccess(r, rec, time.Now())
+		w = rec
 	}
 
-	cmd, pipe := gitCommand(s.config.GitPath, subCommand(rpc), "--stateless-rpc", r.RepoPath)
-	defer pipe.Close()
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		fail500(w, context, err)
-		return
+	for key, value := range s.config.ExtraHeaders {
+		w.Header().Set(key, value)
 	}
-	defer stdin.Close()
 
-	if err := cmd.Start(); err != nil {
-		fail500(w, context, err)
+	r = withRequestID(w, r)
+	s.logInfo(r, "request", r.Method+" "+r.Host+r.URL.String()+" from "+s.clientIP(r))
+
+	if !s.beginRequest() {
+		s.httpError(w, r, http.StatusServiceUnavailable, "Service Unavailable")
 		return
 	}
-	defer cleanUpProcessGroup(cmd)
+	defer s.active.Done()
 
-	if _, err := io.Copy(stdin, body); err != nil {
-		fail500(w, context, err)
+	if ip := s.clientIP(r); !s.allowedIP(ip) {
+		s.logError(r, "request", fmt.Errorf("rejected client %s", ip))
+		s.httpError(w, r, http.StatusForbidden, "Forbidden")
 		return
 	}
-	stdin.Close()
 
-	w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-result", rpc))
-	w.Header().Add("Cache-Control", "no-cache")
-	w.WriteHeader(200)
+	if s.config.PathPrefix != "" {
+		p := strings.TrimPrefix(r.URL.Path, s.config.PathPrefix)
+		if len(p) == len(r.URL.Path) || p != "" && p[0] != '/' {
+			s.httpError(w, r, http.StatusNotFound, "Not Found")
+			return
+		}
 
-	if _, err := io.Copy(newWriteFlusher(w), pipe); err != nil {
-		logError(context, err)
-		return
+		// Leave the URL of the caller untouched
+		u := *r.URL
+		u.Path = p
+		u.RawPath = ""
+		r = r.WithContext(r.Context())
+		r.URL = &u
 	}
-	if err := cmd.Wait(); err != nil {
-		logError(context, err)
-		return
+
+	if s.config.RequestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), s.config.RequestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		// Drop the connection so that clients do not take a response cut
+		// short by the timeout for a complete one
+		defer func() {
+			if ctx.Err() == context.DeadlineExceeded {
+				s.logError(r, "request", fmt.Errorf("timed out after %v", s.config.RequestTimeout))
+				panic(http.ErrAbortHandler)
+			}
+		}()
 	}
-}
 
-func (s *Server) createRepo(_ string, w http.ResponseWriter, req *Request) {
-	if !repoExists(req.RepoPath) {
-		err := initRepo(req.RepoName, &s.config)
-		if err != nil {
-			fail500(w, "repo-init", err)
+	// Find the git subservice to handle the request
+	svc, repoUrlPath := s.findService(r)
+	if svc == nil {
+		// Unknown git requests and disabled services are refused, other
+		// paths are no endpoint of the API
+		if isGitRequest(r) || s.isDisabled(r) {
+			s.httpError(w, r, http.StatusForbidden, "Forbidden")
 			return
 		}
-
 		body := &KitResponse{
-			Code: 201,
-			Data: KitRepoResponse{
-				RepoPath: req.RepoName,
-			},
+			Data: KitErrorResponse{Message: "Not Found"},
 		}
-		formatResponse(w, body, http.StatusCreated)
+		s.formatResponse(w, r, body, http.StatusNotFound)
 		return
 	}
-	body := &KitResponse{
-		Code: 409,
-		Data: KitRepoResponse{
-			RepoPath: req.RepoName,
-		},
+
+	// Health checks are served at the root only, for anyone
+	if svc.op == "healthz" {
+		if repoUrlPath != "" {
+			s.httpError(w, r, http.StatusNotFound, "Not Found")
+			return
+		}
+		s.serve(svc, w, &Request{Request: r, Operation: OperationDownload, ID: requestID(r)})
+		return
 	}
-	formatResponse(w, body, http.StatusConflict)
-}
 
-func (s *Server) listRepo(_ string, w http.ResponseWriter, r *Request) {
-	fullPath := s.config.Dir
-	dirs, err := os.ReadDir(fullPath)
-	if err != nil {
-		fail500(w, "list repo", err)
+	req := &Request{Request: r, ID: requestID(r)}
+	req.Operation = svc.operation(req)
+
+	if s.config.ReadOnly && svc.modifies(req) {
+		s.logError(r, "read-only", fmt.Errorf("rejected %s %s", r.Method, r.URL.Path))
+		s.httpError(w, r, http.StatusForbidden, "Forbidden")
 		return
 	}
-	repos := make([]string, 0)
-	for _, repoDir := range dirs {
-		if repoDir.IsDir() {
-			subDirs, err := os.ReadDir(path.Join(fullPath, repoDir.Name()))
-			if err != nil {
-				fail500(w, "list repo", err)
+
+	// Determine namespace and repo name from request path
+	repoNamespace, repoName := getNamespaceAndRepo(repoUrlPath)
+	if repoName == "" && !svc.namedInBody() {
+		s.logError(r, "auth", fmt.Errorf("no repo name provided"))
+		s.httpError(w, r, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	// Do not let the repo name escape the repos directory, e.g. with ".."
+	if root := s.config.roots()[0]; repoName != "" && !isSubPath(root, path.Join(root, repoNamespace, repoName)) {
+		s.logError(r, "request", fmt.Errorf("repo %s is outside of %s", path.Join(repoNamespace, repoName), root))
+		s.httpError(w, r, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	req.RepoName = path.Join(repoNamespace, repoName)
+	req.Namespace = repoNamespace
+	req.RepoPath = s.repoPath(repoNamespace, repoName)
+
+	var cred Credential
+	if s.config.Auth {
+		if s.AuthFunc == nil && len(s.AuthFuncs) == 0 {
+			s.logError(r, "auth", fmt.Errorf("no auth backend provided"))
+			s.httpError(w, r, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		var err error
+		if s.config.AuthMethod == AuthMethodMTLS {
+			cred, err = getCertificateCredential(r)
+		} else {
+			authHeader := r.Header.Get("Authorization")
+			if authHeader == "" {
+				w.Header()["WWW-Authenticate"] = []string{s.config.authenticate()}
+				s.httpError(w, r, http.StatusUnauthorized, "Unauthorized")
 				return
 			}
-			for _, d := range subDirs {
-				if d.IsDir() && strings.HasSuffix(d.Name(), ".git") {
-					repos = append(repos, path.Join(repoDir.Name(), d.Name()))
-				}
-			}
+
+			cred, err = getCredential(r)
+		}
+		if err != nil {
+			s.logError(r, "auth", err)
+			s.httpError(w, r, http.StatusUnauthorized, "Unauthorized")
+			return
 		}
-	}
 
-	repos = s.FilterRepoFunc(repos, r)
-	body := &KitResponse{
-		Code: 200,
-		Data: KitListRepoResponse{
-			repos,
-		},
+		allow, err := s.authorize(cred, req)
+		if err == errAuthTimeout {
+			s.logError(r, "auth", err)
+			s.httpError(w, r, http.StatusServiceUnavailable, "Service Unavailable")
+			return
+		}
+		if !allow || err != nil {
+			if err != nil && err != ErrForbidden {
+				s.logError(r, "auth", err)
+			}
+
+			user := cred.Username
+			if cred.Scheme == CertificateScheme {
+				user = cred.ClientCN
+			}
+			s.logError(r, "auth", fmt.Errorf("rejected user %s from %s", user, s.clientIP(r)))
+
+			// Known users without access are not asked for other credentials
+			if err == ErrForbidden {
+				s.httpError(w, r, http.StatusForbidden, "Forbidden")
+				return
+			}
+			s.httpError(w, r, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		req.credential = cred
 	}
-	formatResponse(w, body, http.StatusOK)
-}
 
-func (s *Server) deleteRepo(_ string, w http.ResponseWriter, r *Request) {
-	if r.RepoName == "" {
-		body := &KitResponse{
-			Code: 400,
-			Data: KitRepoResponse{
-				r.RepoName,
-			},
+	if s.RateLimiter != nil {
+		key := s.rateLimitKey(r, cred)
+		if ok, wait := s.RateLimiter.Allow(key); !ok {
+			s.logError(r, "rate-limit", fmt.Errorf("rejected %s", key))
+			w.Header().Set("Retry-After", retryAfter(wait))
+			s.httpError(w, r, http.StatusTooManyRequests, "Too Many Requests")
+			return
 		}
-		formatResponse(w, body, http.StatusBadRequest)
-		return
 	}
-	fullPath := path.Join(s.config.Dir, r.RepoName)
-	f, err := os.Lstat(fullPath)
-	if err != nil || f == nil {
-		fail500(w, "find repo", err)
+
+	// The repository of the path does not have to exist for creations and
+	// the requests naming none
+	if svc.op == "create" || svc.namedInBody() {
+		s.serve(svc, w, req)
 		return
 	}
 
-	err = os.RemoveAll(fullPath)
-	if err != nil || f == nil {
-		fail500(w, "find repo", err)
-		return
+	// Only pushes create repositories, fetching a missing one is an error
+	if !repoExists(req.RepoPath) && s.config.AutoCreate && req.Operation == OperationUpload && s.validRepoName(req.RepoName) {
+		if err := s.autoCreateRepo(req); err != nil {
+			s.fail500(w, r, "repo-init", err)
+			return
+		}
 	}
 
-	body := &KitResponse{
-		Code: 202,
-		Data: KitRepoResponse{
-			r.RepoName,
-		},
+	if !repoExists(req.RepoPath) {
+		s.logError(r, "repo-init", fmt.Errorf("%s does not exist", req.RepoPath))
+		s.httpError(w, r, http.StatusNotFound, "Not Found")
+		return
 	}
-	formatResponse(w, body, http.StatusAccepted)
-}
 
-func (s *Server) Setup() error {
-	return s.config.Setup()
+	s.serve(svc, w, req)
 }
 
-func initRepo(name string, config *Config) error {
-	fullPath := path.Join(config.Dir, name)
+// autoCreateRepo creates the repository of a push. Concurrent pushes to the
+// same missing repository create it once, the others find it in place.
+func (s *Server) autoCreateRepo(req *Request) error {
+	lock := s.repoLock(req.RepoPath)
+	lock.Lock()
+	defer lock.Unlock()
 
-	if err := exec.Command(config.GitPath, "init", "--bare", fullPath).Run(); err != nil {
-		return err
+	if repoExists(req.RepoPath) {
+		return nil
 	}
 
-	if config.AutoHooks && config.Hooks != nil {
-		return config.Hooks.setupInDir(fullPath)
+	// Directories that are no repository are not ours to remove
+	_, err := os.Lstat(req.RepoPath)
+	created := os.IsNotExist(err)
+	if err := initRepo(req.RepoPath, req.RepoName, s.config.DefaultBranch, &s.config); err != nil {
+		if created {
+			os.RemoveAll(req.RepoPath)
+		}
+		return err
 	}
-
 	return nil
 }
 
-func repoExists(p string) bool {
-	_, err := os.Stat(path.Join(p, "objects"))
-	return err == nil
-}
+// serve runs the service handler and reports the outcome to MetricsFunc
+func (s *Server) serve(svc *service, w http.ResponseWriter, req *Request) {
+	start := time.Now()
 
-func gitCommand(name string, args ...string) (*exec.Cmd, io.ReadCloser) {
-	cmd := exec.Command(name, args...)
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	cmd.Env = os.Environ()
+	// Git transfers beyond the limits are turned away rather than queued
+	if push, ok := svc.transfer(req); ok {
+		if !s.acquireProc(push) {
+			s.logError(req.Request, "proc-limit", fmt.Errorf("rejected %s %s", req.Method, req.URL.Path))
+			w.Header().Set("Retry-After", retryAfter(time.Second))
+			s.httpError(w, req.Request, http.StatusServiceUnavailable, "Service Unavailable")
+			return
+		}
+		defer s.releaseProc(push)
+	}
+
+	// Requests changing the repository run alone, gc, rename, fork and sync
+	// take the locks they need themselves
+	switch svc.op {
+	case "receive-pack", "create", "delete", "hooks", "head", "set-config":
+		lock := s.repoLock(req.RepoPath)
+		lock.Lock()
+		defer lock.Unlock()
+	case "info-refs", "upload-pack", "file", "description", "branches", "tags", "size", "raw", "archive", "commits", "compare", "config", "upload-archive",
+		"lfs-batch", "lfs-download", "lfs-upload":
+		lock := s.repoLock(req.RepoPath)
+		lock.RLock()
+		defer lock.RUnlock()
+	}
+
+	err := svc.handler(s, svc.rpc, w, req)
+
+	// Cached advertisements are dropped before the repository is unlocked
+	if svc.modifies(req) && req.RepoPath != "" {
+		s.advertiseCache.invalidate(req.RepoPath)
+	}
+
+	if s.MetricsFunc != nil {
+		s.MetricsFunc(svc.op, req.RepoName, time.Since(start), err)
+	}
+}
+
+// repoLock returns the lock guarding the repository at repoPath. It is held
+// for writing while the repository changes, e.g. during pushes, so that reads
+// and other changes do not race with it. Different repositories are not
+// locked against each other.
+//
+// Pushes hold it while their body streams in, so a slow client delays the
+// reads of its repository, up to Config.RequestTimeout. Buffering pushes
+// before locking would cost as much memory or disk as the pushes are large.
+//
+// The lock must be locked and unlocked once, for reading or writing. It is
+// dropped once nobody holds or waits for it, so that locks do not pile up
+// for every path ever requested.
+func (s *Server) repoLock(repoPath string) *pathLock {
+	s.repoLocksLock.Lock()
+	defer s.repoLocksLock.Unlock()
+
+	lock := s.repoLocks[repoPath]
+	if lock == nil {
+		if s.repoLocks == nil {
+			s.repoLocks = map[string]*pathLock{}
+		}
+		lock = &pathLock{s: s.serverState, path: repoPath}
+		s.repoLocks[repoPath] = lock
+	}
+	lock.refs++
+	return lock
+}
+
+// pathLock is the lock of a repository, see repoLock
+type pathLock struct {
+	sync.RWMutex
+	s    *serverState
+	path string
+	refs int // Guarded by serverState.repoLocksLock
+}
+
+func (l *pathLock) Unlock() {
+	l.RWMutex.Unlock()
+	l.release()
+}
+
+func (l *pathLock) RUnlock() {
+	l.RWMutex.RUnlock()
+	l.release()
+}
+
+func (l *pathLock) release() {
+	l.s.repoLocksLock.Lock()
+	defer l.s.repoLocksLock.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(l.s.repoLocks, l.path)
+	}
+}
+
+func (s *Server) getInfoRefs(_ string, w http.ResponseWriter, r *Request) error {
+	context := "get-info-refs"
+	rpc := r.URL.Query().Get("service")
+
+	// Dumb clients do not ask for a service and read the file directly
+	if rpc == "" && s.config.DumbHTTP {
+		return s.serveDumbFile(w, r, "info/refs")
+	}
+
+	if !(rpc == "git-upload-pack" || rpc == "git-receive-pack") {
+		s.httpError(w, r.Request, 404, "Not Found")
+		return nil
+	}
+
+	if !s.rpcEnabled(rpc) {
+		s.httpError(w, r.Request, http.StatusForbidden, "Forbidden")
+		return nil
+	}
+
+	protocolV2 := s.isProtocolV2(r)
+
+	// Advertisements come from the cache if they were computed recently,
+	// see Config.AdvertiseCacheTTL, or from git. The environment GitEnvFunc
+	// sets may change which refs git advertises, e.g. with GIT_NAMESPACE,
+	// so they are not shared between requests then.
+	var cmd *exec.Cmd
+	var stderr *bytes.Buffer
+	var advertisement io.Reader
+	var cached *bytes.Buffer
+	cacheKey := advertiseCacheKey(rpc, protocolV2)
+	useCache := s.config.AdvertiseCacheTTL > 0 && s.GitEnvFunc == nil
+	if useCache {
+		if data, ok := s.advertiseCache.get(r.RepoPath, cacheKey); ok {
+			advertisement = bytes.NewReader(data)
+		}
+	}
+	if advertisement == nil {
+		args := append(s.filterArgs(rpc, protocolV2), subCommand(rpc), "--stateless-rpc", "--advertise-refs", r.RepoPath)
+		var pipe io.ReadCloser
+		cmd, pipe, stderr = s.gitCommand(r, args...)
+		if protocolV2 {
+			cmd.Env = append(cmd.Env, "GIT_PROTOCOL=version=2")
+		}
+		if err := s.startCommand(cmd); err != nil {
+			s.fail500(w, r.Request, context, err)
+			return err
+		}
+		defer s.releaseCommand(cmd)
+		defer cleanUpProcessGroup(cmd)
+		defer watchProcessGroup(r.Context(), cmd)()
+
+		advertisement = pipe
+		if useCache {
+			cached = &bytes.Buffer{}
+			advertisement = io.TeeReader(pipe, cached)
+		}
+	}
+
+	w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-advertisement", rpc))
+	w.Header().Add("Cache-Control", "no-cache")
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	// Flush as the advertisement comes, proxies may hold on to it otherwise
+	var out io.Writer = s.throttle(r.Context(), newWriteFlusher(w))
+	var gz *gzip.Writer
+	if !s.config.DisableGzip && acceptsGzip(r.Request) {
+		var err error
+		if gz, err = gzip.NewWriterLevel(out, s.config.GzipLevel); err != nil {
+			s.fail500(w, r.Request, context, err)
+			return err
+		}
+		w.Header().Add("Content-Encoding", "gzip")
+		defer gz.Close()
+		out = gz
+	}
+
+	w.WriteHeader(200)
+
+	// Protocol v2 starts with the capability advertisement right away
+	if !protocolV2 {
+		if err := packLine(out, fmt.Sprintf("# service=%s\n", rpc)); err != nil {
+			s.logError(r.Request, context, err)
+			return err
+		}
+
+		if err := packFlush(out); err != nil {
+			s.logError(r.Request, context, err)
+			return err
+		}
+
+		if gz != nil {
+			if err := gz.Flush(); err != nil {
+				s.logError(r.Request, context, err)
+				return err
+			}
+		}
+	}
+
+	if _, err := io.Copy(out, advertisement); err != nil {
+		s.logError(r.Request, context, err)
+		return err
+	}
+	if cmd == nil {
+		return nil
+	}
+
+	if err := cmd.Wait(); err != nil {
+		err = commandError(err, stderr)
+		s.logError(r.Request, context, err)
+		return err
+	}
+	if cached != nil {
+		s.advertiseCache.set(r.RepoPath, cacheKey, cached.Bytes(), s.config.AdvertiseCacheTTL)
+	}
+	return nil
+}
+
+func (s *Server) postRPC(rpc string, w http.ResponseWriter, r *Request) error {
+	context := "post-rpc"
+	var body io.Reader = r.Body
+
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		if s.config.RejectGzipRequests {
+			s.logError(r.Request, context, fmt.Errorf("rejected gzip encoded request"))
+			s.httpError(w, r.Request, http.StatusUnsupportedMediaType, "Unsupported Media Type")
+			return nil
+		}
+
+		var err error
+		body, err = gzip.NewReader(r.Body)
+		if err == io.EOF {
+			s.logError(r.Request, context, errEmptyBody)
+			s.httpError(w, r.Request, http.StatusBadRequest, "Bad Request")
+			return nil
+		}
+		if err != nil {
+			s.fail500(w, r.Request, context, err)
+			return err
+		}
+		if rpc == "git-upload-pack" && s.config.MaxGzipRequestSize > 0 {
+			body = &maxSizeReader{r: body, n: s.config.MaxGzipRequestSize}
+		}
+	}
+
+	protocolV2 := s.isProtocolV2(r)
+	args := append(append(append(s.keepAliveArgs(rpc), s.filterArgs(rpc, protocolV2)...), s.fsckArgs(rpc)...), subCommand(rpc), "--stateless-rpc", r.RepoPath)
+	cmd, pipe, stderr := s.gitCommand(r, args...)
+	if protocolV2 {
+		cmd.Env = append(cmd.Env, "GIT_PROTOCOL=version=2")
+	}
+	defer pipe.Close()
+
+	// Hook output of pushes is relayed to the client over the side-band once
+	// git is done
+	var updates []RefUpdate
+	sideband, reportStatus := false, false
+	if rpc == "git-receive-pack" {
+		// The limit applies to the decompressed pack, checking the length
+		// up front only saves starting git for plain bodies
+		if s.config.MaxPushSize > 0 {
+			if body == r.Body && r.ContentLength > s.config.MaxPushSize {
+				s.logError(r.Request, context, errBodyTooLarge)
+				s.httpError(w, r.Request, http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+				return nil
+			}
+			body = &maxSizeReader{r: body, n: s.config.MaxPushSize}
+		}
+
+		// Peek at the push commands to find out which capabilities the client
+		// has requested. Malformed input is passed on to git as is.
+		head := &bytes.Buffer{}
+		commands, _ := readPktSection(io.TeeReader(body, head))
+		if len(commands) > 0 {
+			caps := commands[0].capabilities()
+			sideband = hasCapability(caps, "side-band-64k") || hasCapability(caps, "side-band")
+			reportStatus = hasCapability(caps, "report-status") || hasCapability(caps, "report-status-v2")
+		}
+		updates = parseRefUpdates(commands)
+		body = io.MultiReader(head, body)
+
+		// Clients always send commands, a flush at least, git would fail
+		// without telling why
+		if head.Len() == 0 {
+			s.logError(r.Request, context, errEmptyBody)
+			s.httpError(w, r.Request, http.StatusBadRequest, "Bad Request")
+			return nil
+		}
+	}
+
+	// Over-deep shallow fetches and filters of partial clones that are not
+	// allowed are refused with an error git shows to the user. Malformed
+	// input is passed on to git as is.
+	if rpc == "git-upload-pack" && (s.config.MaxCloneDepth > 0 || s.config.DisablePartialClone) {
+		head := &bytes.Buffer{}
+		args, _ := readPktSection(io.TeeReader(body, head))
+		err := checkFilter(args, !s.config.DisablePartialClone)
+		if err == nil && s.config.MaxCloneDepth > 0 {
+			err = checkDeepen(args, s.config.MaxCloneDepth)
+		}
+		if err != nil {
+			s.logError(r.Request, context, err)
+			w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-result", rpc))
+			w.Header().Add("Cache-Control", "no-cache")
+			w.WriteHeader(200)
+			return packLine(w, "ERR "+err.Error()+"\n")
+		}
+		body = io.MultiReader(head, body)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		s.fail500(w, r.Request, context, err)
+		return err
+	}
+	defer stdin.Close()
+
+	if err := s.startCommand(cmd); err != nil {
+		s.fail500(w, r.Request, context, err)
+		return err
+	}
+	defer s.releaseCommand(cmd)
+	defer cleanUpProcessGroup(cmd)
+	defer watchProcessGroup(r.Context(), cmd)()
+
+	// Feed git while its output is relayed. Git may start writing before it
+	// has read all of its input and would block on a full pipe otherwise.
+	// Servers that cannot read the request body once the response has started
+	// get all of it first.
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(stdin, body)
+		if err == errBodyTooLarge {
+			// Do not let git act on the truncated input
+			killProcessGroup(cmd)
+		}
+		stdin.Close()
+		copied <- err
+	}()
+	if !enableFullDuplex(w, r.Request) {
+		if err := <-copied; err != nil {
+			if err == errBodyTooLarge {
+				s.logError(r.Request, context, err)
+				s.httpError(w, r.Request, http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+				return nil
+			}
+			s.fail500(w, r.Request, context, err)
+			return err
+		}
+		close(copied)
+	}
+
+	w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-result", rpc))
+	w.Header().Add("Cache-Control", "no-cache")
+
+	out := s.throttle(r.Context(), newWriteFlusher(w))
+
+	if rpc != "git-receive-pack" {
+		w.WriteHeader(200)
+
+		if _, err := io.Copy(out, pipe); err != nil {
+			s.logError(r.Request, context, err)
+			return err
+		}
+		if err := <-copied; err != nil {
+			s.logError(r.Request, context, err)
+			return err
+		}
+		if err := cmd.Wait(); err != nil {
+			err = commandError(err, stderr)
+			s.logError(r.Request, context, err)
+			return err
+		}
+		return nil
+	}
+
+	// Keep a copy of the status report to tell which refs have been updated.
+	// With side-band enabled it is carried in band 1. The response status is
+	// sent along with the first packet, so that oversized pushes still get 413.
+	report := &bytes.Buffer{}
+	written := false
+	pending, err := copyPktLines(out, pipe, func(line pktLine) {
+		written = true
+		if !sideband {
+			report.Write(line)
+		} else if data := line.payload(); len(data) > 0 && data[0] == 1 {
+			report.Write(data[1:])
+		}
+	})
+	if err != nil {
+		s.logError(r.Request, context, err)
+		return err
+	}
+	if err := <-copied; err != nil {
+		s.logError(r.Request, context, err)
+		if err == errBodyTooLarge && !written {
+			s.httpError(w, r.Request, http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+			return nil
+		}
+		return err
+	}
+	waitErr := cmd.Wait()
+
+	// Messages have to go before the final flush-pkt to be shown by the client
+	if stderr.Len() > 0 {
+		if sideband {
+			if err := packSideband(out, 2, stderr.Bytes()); err != nil {
+				s.logError(r.Request, context, err)
+				return err
+			}
+		} else {
+			s.logError(r.Request, context, fmt.Errorf("%s", bytes.TrimSpace(stderr.Bytes())))
+		}
+	}
+
+	if pending {
+		if err := packFlush(out); err != nil {
+			s.logError(r.Request, context, err)
+			return err
+		}
+	}
+
+	if waitErr != nil {
+		s.logError(r.Request, context, waitErr)
+		return waitErr
+	}
+
+	if s.config.DumbHTTP {
+		if err := updateServerInfo(r.Context(), s.config.GitPath, r.RepoPath); err != nil {
+			s.logError(r.Request, "update-server-info", err)
+		}
+	}
+
+	// Response is complete at this point, callback errors are only logged
+	if s.PostReceiveFunc != nil {
+		if err := s.PostReceiveFunc(r); err != nil {
+			s.logError(r.Request, "post-receive", err)
+		}
+	}
+
+	if reportStatus {
+		status := parseReportStatus(report)
+		accepted := []RefUpdate{}
+		for _, update := range updates {
+			if status[update.Ref] {
+				accepted = append(accepted, update)
+			}
+		}
+		updates = accepted
+	}
+
+	if s.RefUpdateFunc != nil && len(updates) > 0 {
+		if err := s.RefUpdateFunc(r, updates); err != nil {
+			s.logError(r.Request, "post-receive", err)
+		}
+	}
+
+	if len(updates) > 0 {
+		s.dispatchWebhooks(r, WebhookEventPush, updates)
+	}
+	return nil
+}
+
+// isProtocolV2 reports whether the client asked for git protocol v2 and the
+// server is allowed to speak it.
+func (s *Server) isProtocolV2(r *Request) bool {
+	if !s.config.ProtocolV2 {
+		return false
+	}
+
+	// Git-Protocol holds colon-separated parameters, e.g. "version=2"
+	for _, param := range strings.Split(r.Header.Get("Git-Protocol"), ":") {
+		if param == "version=2" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) createRepo(_ string, w http.ResponseWriter, req *Request) error {
+	if req.RepoName == "" || !s.validRepoName(req.RepoName) {
+		body := &KitResponse{
+			Data: KitRepoResponse{
+				RepoPath: req.RepoName,
+			},
+		}
+		s.formatResponse(w, req.Request, body, http.StatusBadRequest)
+		return nil
+	}
+
+	// The body is optional, the default branch is taken from the config
+	// when it is missing
+	params := KitCreateRepoRequest{DefaultBranch: s.config.DefaultBranch}
+	if req.Body != nil {
+		err := json.NewDecoder(req.Body).Decode(&params)
+		if err != nil && err != io.EOF {
+			s.logError(req.Request, "create repo", err)
+			s.formatResponse(w, req.Request, &KitResponse{}, http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	if params.DefaultBranch != "" && !validBranchName(s.config.GitPath, params.DefaultBranch) {
+		s.logError(req.Request, "create repo", fmt.Errorf("invalid branch name %q", params.DefaultBranch))
+		s.formatResponse(w, req.Request, &KitResponse{}, http.StatusBadRequest)
+		return nil
+	}
+
+	for key := range params.Config {
+		if !s.config.repoConfigAllowed(key) {
+			s.logError(req.Request, "create repo", fmt.Errorf("git config key %q is not allowed", key))
+			s.formatResponse(w, req.Request, &KitResponse{}, http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	templatePath := ""
+	if params.Template != "" {
+		var ok bool
+		if templatePath, ok = s.templatePath(params.Template); !ok {
+			s.logError(req.Request, "create repo", fmt.Errorf("unknown template %q", params.Template))
+			s.formatResponse(w, req.Request, &KitResponse{}, http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	// ?dryRun=true validates the request and tells whether the repository
+	// would be created, without creating it
+	dryRun := req.URL.Query().Get("dryRun") == "true"
+
+	if !repoExists(req.RepoPath) {
+		if !dryRun {
+			if err := s.initRepoWith(req.RepoPath, req.RepoName, params, templatePath); err != nil {
+				s.fail500(w, req.Request, "repo-init", err)
+				return err
+			}
+		}
+
+		body := &KitResponse{
+			Data: KitRepoResponse{
+				RepoPath: req.RepoName,
+			},
+		}
+		s.formatResponse(w, req.Request, body, http.StatusCreated)
+		return nil
+	}
+	body := &KitResponse{
+		Data: KitRepoResponse{
+			RepoPath: req.RepoName,
+		},
+	}
+	s.formatResponse(w, req.Request, body, http.StatusConflict)
+	return nil
+}
+
+// CreateRepo creates a repository like POST /repo does without a body, with
+// HEAD pointing to Config.DefaultBranch and hooks installed if
+// Config.AutoHooks is set. It fails with ErrInvalidRepoName if the name does
+// not match Config.RepoNamePattern and ErrRepoExists if it is taken.
+func (s *Server) CreateRepo(name string) error {
+	s = s.snapshot()
+	repoName, repoPath, ok := s.resolveRepo(name)
+	if !ok || !s.validRepoName(repoName) {
+		return ErrInvalidRepoName
+	}
+
+	lock := s.repoLock(repoPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if repoExists(repoPath) {
+		return ErrRepoExists
+	}
+	return s.initRepoWith(repoPath, repoName, KitCreateRepoRequest{DefaultBranch: s.config.DefaultBranch}, "")
+}
+
+// initRepoWith creates a repository as requested, seeded from the template
+// at templatePath unless it is empty. Nothing is left behind on failure,
+// unless the directory existed before.
+func (s *Server) initRepoWith(repoPath string, repoName string, params KitCreateRepoRequest, templatePath string) error {
+	_, err := os.Lstat(repoPath)
+	created := os.IsNotExist(err)
+
+	err = initRepo(repoPath, repoName, params.DefaultBranch, &s.config)
+	if err == nil && len(params.Config) > 0 {
+		err = s.writeGitConfig(repoPath, params.Config)
+	}
+	if err == nil && templatePath != "" {
+		err = seedRepo(&s.config, repoPath, templatePath)
+	}
+	if err == nil && params.Description != "" {
+		err = ioutil.WriteFile(path.Join(repoPath, "description"), []byte(params.Description+"\n"), 0644)
+	}
+	if err == nil {
+		err = writeRepoMeta(repoPath, RepoMeta{DefaultBranch: params.DefaultBranch, Description: params.Description})
+	}
+
+	if err != nil && created {
+		os.RemoveAll(repoPath)
+	}
+	return err
+}
+
+// writeGitConfig sets git config keys of a repository, in order so that
+// failures are the same every time
+func (s *Server) writeGitConfig(repoPath string, config map[string]string) error {
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if _, err := s.gitOutput(context.Background(), "--git-dir", repoPath, "config", "--", key, config[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getDescription returns the contents of the description file read by
+// gitweb and similar tools
+func (s *Server) getDescription(_ string, w http.ResponseWriter, r *Request) error {
+	data, err := ioutil.ReadFile(path.Join(r.RepoPath, "description"))
+	if err != nil && !os.IsNotExist(err) {
+		s.fail500(w, r.Request, "repo description", err)
+		return err
+	}
+
+	body := &KitResponse{
+		Data: KitDescriptionResponse{
+			RepoPath:    r.RepoName,
+			Description: strings.TrimSpace(string(data)),
+		},
+	}
+	s.formatResponse(w, r.Request, body, http.StatusOK)
+	return nil
+}
+
+// repoSize reports the disk usage of a repository as counted by git, which
+// is faster than walking the repository for large ones
+func (s *Server) repoSize(_ string, w http.ResponseWriter, r *Request) error {
+	out, err := s.gitOutput(r.Context(), "--git-dir", r.RepoPath, "count-objects", "-v")
+	if err != nil {
+		// Files removed by a concurrent gc make git fail, it is done by the
+		// time git runs again
+		out, err = s.gitOutput(r.Context(), "--git-dir", r.RepoPath, "count-objects", "-v")
+	}
+	if err != nil {
+		s.fail500(w, r.Request, "repo size", err)
+		return err
+	}
+
+	// Sizes are reported in KiB
+	counts := map[string]int64{}
+	for _, line := range strings.Split(out, "\n") {
+		chunks := strings.SplitN(line, ": ", 2)
+		if len(chunks) != 2 {
+			continue
+		}
+		if n, err := strconv.ParseInt(chunks[1], 10, 64); err == nil {
+			counts[chunks[0]] = n
+		}
+	}
+
+	body := &KitResponse{
+		Data: KitRepoSizeResponse{
+			RepoPath: r.RepoName,
+			Size:     (counts["size"] + counts["size-pack"]) * 1024,
+			Garbage:  counts["size-garbage"] * 1024,
+		},
+	}
+	s.formatResponse(w, r.Request, body, http.StatusOK)
+	return nil
+}
+
+// gcRepo runs git gc on a repository. Only one gc runs per repository at a
+// time, concurrent requests get 409.
+func (s *Server) gcRepo(_ string, w http.ResponseWriter, r *Request) error {
+	body := &KitResponse{
+		Data: KitRepoResponse{
+			RepoPath: r.RepoName,
+		},
+	}
+
+	if _, running := s.gcs.LoadOrStore(r.RepoPath, true); running {
+		s.formatResponse(w, r.Request, body, http.StatusConflict)
+		return nil
+	}
+	defer s.gcs.Delete(r.RepoPath)
+
+	lock := s.repoLock(r.RepoPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := s.gitOutput(r.Context(), "--git-dir", r.RepoPath, "gc", "--quiet"); err != nil {
+		s.fail500(w, r.Request, "repo gc", err)
+		return err
+	}
+
+	s.formatResponse(w, r.Request, body, http.StatusOK)
+	return nil
+}
+
+// installHooks replaces the hooks of a repository with the current ones of
+// the configuration, removing them if it has none for the repository
+func (s *Server) installHooks(_ string, w http.ResponseWriter, r *Request) error {
+	hooks := s.config.hooksFor(r.RepoName)
+	if hooks == nil {
+		hooks = &HookScripts{}
+	}
+
+	if err := hooks.setupInDir(r.RepoPath); err != nil {
+		s.fail500(w, r.Request, "repo hooks", err)
+		return err
+	}
+
+	body := &KitResponse{
+		Data: KitRepoResponse{
+			RepoPath: r.RepoName,
+		},
+	}
+	s.formatResponse(w, r.Request, body, http.StatusOK)
+	return nil
+}
+
+// ReinstallHooks replaces the hooks of every repository in Dir with the ones
+// of the configuration, e.g. after a policy change. Repositories the
+// configuration has no hooks for are left alone.
+func (s *Server) ReinstallHooks() error {
+	s = s.snapshot()
+	_, failed, err := s.reinstallHooks()
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("reinstalling hooks failed for %d repositories, first %s: %s", len(failed), failed[0].RepoPath, failed[0].Error)
+	}
+	return nil
+}
+
+// reinstallHooks returns how many repositories got their hooks reinstalled
+// and the ones that failed
+func (s *Server) reinstallHooks() (int, []KitHooksFailure, error) {
+	repos, err := s.listRepos()
+	if err != nil {
+		return 0, nil, err
+	}
+	sort.Strings(repos)
+
+	updated := 0
+	failed := []KitHooksFailure{}
+	for _, repo := range repos {
+		hooks := s.config.hooksFor(repo)
+		if hooks == nil {
+			continue
+		}
+
+		repoPath := s.repoPath(getNamespaceAndRepo(repo))
+		lock := s.repoLock(repoPath)
+		lock.Lock()
+		err := hooks.setupInDir(repoPath)
+		lock.Unlock()
+
+		if err != nil {
+			failed = append(failed, KitHooksFailure{RepoPath: repo, Error: err.Error()})
+			continue
+		}
+		updated++
+	}
+	return updated, failed, nil
+}
+
+func (s *Server) reinstallAllHooks(_ string, w http.ResponseWriter, r *Request) error {
+	updated, failed, err := s.reinstallHooks()
+	if err != nil {
+		s.fail500(w, r.Request, "reinstall hooks", err)
+		return err
+	}
+
+	for _, f := range failed {
+		s.logError(r.Request, "reinstall hooks", fmt.Errorf("%s: %s", f.RepoPath, f.Error))
+	}
+
+	body := &KitResponse{
+		Data: KitReinstallHooksResponse{
+			Updated: updated,
+			Failed:  failed,
+		},
+	}
+	s.formatResponse(w, r.Request, body, http.StatusOK)
+	return nil
+}
+
+func (s *Server) listRepo(_ string, w http.ResponseWriter, r *Request) error {
+	repos, err := s.listRepos()
+	if err != nil {
+		s.fail500(w, r.Request, "list repo", err)
+		return err
+	}
+
+	query := r.URL.Query()
+	limit, err := queryInt(query, "limit")
+	if err != nil {
+		s.logError(r.Request, "list repo", err)
+		s.formatResponse(w, r.Request, &KitResponse{}, http.StatusBadRequest)
+		return nil
+	}
+	offset, err := queryInt(query, "offset")
+	if err != nil {
+		s.logError(r.Request, "list repo", err)
+		s.formatResponse(w, r.Request, &KitResponse{}, http.StatusBadRequest)
+		return nil
+	}
+
+	if prefix := query.Get("prefix"); prefix != "" {
+		matched := make([]string, 0, len(repos))
+		for _, repo := range repos {
+			if strings.HasPrefix(repo, prefix) {
+				matched = append(matched, repo)
+			}
+		}
+		repos = matched
+	}
+
+	if s.FilterRepoFunc != nil {
+		repos = s.FilterRepoFunc(repos, r)
+	}
+	sort.Strings(repos)
+	total := len(repos)
+
+	if offset > total {
+		offset = total
+	}
+	repos = repos[offset:]
+	if limit > 0 && limit < len(repos) {
+		repos = repos[:limit]
+	}
+
+	list := KitListRepoResponse{
+		RepoPath: repos,
+		Total:    total,
+	}
+
+	// Looking at the refs of every repository is costly, it is only done
+	// for the listed ones and on request
+	if query.Get("detail") == "true" {
+		list.Repos = make([]KitRepoDetail, 0, len(repos))
+		for _, repo := range repos {
+			detail := KitRepoDetail{Path: repo}
+			if _, repoPath, ok := s.resolveRepo(repo); ok {
+				detail.LastModified = refsModTime(repoPath)
+			}
+			list.Repos = append(list.Repos, detail)
+		}
+	}
+
+	body := &KitResponse{
+		Data: list,
+	}
+	s.formatResponse(w, r.Request, body, http.StatusOK)
+	return nil
+}
+
+func (s *Server) deleteRepo(_ string, w http.ResponseWriter, r *Request) error {
+	_, repoPath, ok := s.resolveRepo(r.RepoName)
+	if !ok {
+		body := &KitResponse{
+			Data: KitRepoResponse{
+				r.RepoName,
+			},
+		}
+		s.formatResponse(w, r.Request, body, http.StatusBadRequest)
+		return nil
+	}
+
+	err := s.removeRepo(r.Context(), repoPath, r.URL.Query().Get("force") == "true")
+	switch err {
+	case nil:
+	case ErrRepoNotFound:
+		body := &KitResponse{
+			Data: KitRepoResponse{
+				r.RepoName,
+			},
+		}
+		s.formatResponse(w, r.Request, body, http.StatusNotFound)
+		return nil
+	case ErrRepoNotEmpty:
+		body := &KitResponse{
+			Data: KitErrorResponse{
+				Message: "repository is not empty, add force=true to delete it anyway",
+			},
+		}
+		s.formatResponse(w, r.Request, body, http.StatusConflict)
+		return nil
+	default:
+		s.fail500(w, r.Request, "delete repo", err)
+		return err
+	}
+
+	body := &KitResponse{
+		Data: KitRepoResponse{
+			r.RepoName,
+		},
+	}
+	s.formatResponse(w, r.Request, body, http.StatusAccepted)
+	return nil
+}
+
+// DeleteRepo deletes a repository, even if it has refs unlike DELETE /repo
+// without force=true. It fails with ErrRepoNotFound if there is no such
+// repository and ErrInvalidRepoName if the name points outside of Dir.
+func (s *Server) DeleteRepo(name string) error {
+	s = s.snapshot()
+	_, repoPath, ok := s.resolveRepo(name)
+	if !ok {
+		return ErrInvalidRepoName
+	}
+
+	lock := s.repoLock(repoPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return s.removeRepo(context.Background(), repoPath, true)
+}
+
+// removeRepo deletes the repository at repoPath. Unless force is set,
+// repositories with refs are kept and ErrRepoNotEmpty returned.
+func (s *Server) removeRepo(ctx context.Context, repoPath string, force bool) error {
+	if _, err := os.Lstat(repoPath); err != nil {
+		if os.IsNotExist(err) {
+			return ErrRepoNotFound
+		}
+		return err
+	}
+
+	// Repositories with refs are only deleted on purpose
+	if !force {
+		refs, err := s.forEachRef(ctx, repoPath, "refs", "%(refname)")
+		if err != nil {
+			return err
+		}
+		if len(refs) > 0 {
+			return ErrRepoNotEmpty
+		}
+	}
+
+	s.advertiseCache.invalidate(repoPath)
+	return os.RemoveAll(repoPath)
+}
+
+// RepoExists reports whether a repository with the given name, e.g.
+// "team/project.git", exists in the configured directory.
+func (s *Server) RepoExists(name string) bool {
+	s = s.snapshot()
+	_, repoPath, ok := s.resolveRepo(name)
+	return ok && repoExists(repoPath)
+}
+
+// resolveRepo returns the normalized repository name and its location on disk.
+// ok is false when the name is empty or points outside of the repos directory.
+func (s *Server) resolveRepo(name string) (string, string, bool) {
+	namespace, repo := getNamespaceAndRepo(name)
+	if repo == "" {
+		return "", "", false
+	}
+
+	if root := s.config.roots()[0]; !isSubPath(root, path.Join(root, namespace, repo)) {
+		return "", "", false
+	}
+	return path.Join(namespace, repo), s.repoPath(namespace, repo), true
+}
+
+// repoPath returns where a repository is stored, see Config.RepoPathFunc and
+// Config.Dirs
+func (s *Server) repoPath(namespace string, name string) string {
+	if name == "" {
+		return path.Join(s.config.roots()[0], namespace)
+	}
+	if s.config.RepoPathFunc == nil {
+		name = s.repoDirName(namespace, name)
+		return path.Join(s.findRoot(namespace, name), namespace, name)
+	}
+	return s.config.RepoPathFunc(namespace, name)
+}
+
+// validRepoName reports whether a repository may be created with the name
+func (s *Server) validRepoName(name string) bool {
+	return s.repoNameRegex.MatchString(name)
+}
+
+func (s *Server) renameRepo(_ string, w http.ResponseWriter, r *Request) error {
+	params := KitRenameRepoRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		s.logError(r.Request, "rename repo", err)
+		s.formatResponse(w, r.Request, &KitResponse{}, http.StatusBadRequest)
+		return nil
+	}
+
+	fromName, fromPath, fromOk := s.resolveRepo(params.From)
+	toName, toPath, toOk := s.resolveRepo(params.To)
+	if !fromOk || !toOk || !s.validRepoName(toName) {
+		s.logError(r.Request, "rename repo", fmt.Errorf("invalid repo names %q -> %q", params.From, params.To))
+		s.formatResponse(w, r.Request, &KitResponse{}, http.StatusBadRequest)
+		return nil
+	}
+
+	// Repositories keep their root, renames cannot move them across mounts
+	if root := s.rootOf(fromPath); root != "" {
+		if _, err := os.Lstat(toPath); err != nil {
+			toPath = path.Join(root, toName)
+		}
+	}
+
+	// Lock both repositories in the same order for every rename
+	paths := []string{fromPath, toPath}
+	sort.Strings(paths)
+	for i, p := range paths {
+		if i > 0 && p == paths[i-1] {
+			continue
+		}
+		lock := s.repoLock(p)
+		lock.Lock()
+		defer lock.Unlock()
+	}
+
+	if !repoExists(fromPath) {
+		body := &KitResponse{
+			Data: KitRepoResponse{
+				RepoPath: fromName,
+			},
+		}
+		s.formatResponse(w, r.Request, body, http.StatusNotFound)
+		return nil
+	}
+
+	if _, err := os.Lstat(toPath); err == nil {
+		body := &KitResponse{
+			Data: KitRepoResponse{
+				RepoPath: toName,
+			},
+		}
+		s.formatResponse(w, r.Request, body, http.StatusConflict)
+		return nil
+	}
+
+	if err := os.MkdirAll(path.Dir(toPath), 0755); err != nil {
+		s.fail500(w, r.Request, "rename repo", err)
+		return err
+	}
+
+	if err := os.Rename(fromPath, toPath); err != nil {
+		s.fail500(w, r.Request, "rename repo", err)
+		return err
+	}
+	s.advertiseCache.invalidate(fromPath)
+
+	body := &KitResponse{
+		Data: KitRepoResponse{
+			RepoPath: toName,
+		},
+	}
+	s.formatResponse(w, r.Request, body, http.StatusOK)
+	return nil
+}
+
+// forkRepo copies a repository to a new one with git clone, e.g. into the
+// namespace of a user. The fork gets hooks like new repositories do.
+func (s *Server) forkRepo(_ string, w http.ResponseWriter, r *Request) error {
+	context := "fork repo"
+	params := KitForkRepoRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		s.logError(r.Request, context, err)
+		s.formatResponse(w, r.Request, &KitResponse{}, http.StatusBadRequest)
+		return nil
+	}
+
+	sourceName, sourcePath, sourceOk := s.resolveRepo(params.Source)
+	destName, destPath, destOk := s.resolveRepo(params.Dest)
+	if !sourceOk || !destOk || !s.validRepoName(destName) {
+		s.logError(r.Request, context, fmt.Errorf("invalid repo names %q -> %q", params.Source, params.Dest))
+		s.formatResponse(w, r.Request, &KitResponse{}, http.StatusBadRequest)
+		return nil
+	}
+
+	// AuthFunc only saw OperationFork so far, the caller must also be able
+	// to fetch the source and push to the destination
+	if s.config.Auth {
+		if code := s.authorizeRepo(r, sourceName, sourcePath, OperationDownload); code != http.StatusOK {
+			s.httpError(w, r.Request, code, http.StatusText(code))
+			return nil
+		}
+		if code := s.authorizeRepo(r, destName, destPath, OperationUpload); code != http.StatusOK {
+			s.httpError(w, r.Request, code, http.StatusText(code))
+			return nil
+		}
+	}
+
+	// Lock both repositories in the same order for every fork, the source
+	// only for reading
+	paths := []string{sourcePath, destPath}
+	sort.Strings(paths)
+	for i, p := range paths {
+		if i > 0 && p == paths[i-1] {
+			continue
+		}
+		lock := s.repoLock(p)
+		if p != destPath {
+			lock.RLock()
+			defer lock.RUnlock()
+			continue
+		}
+		lock.Lock()
+		defer lock.Unlock()
+	}
+
+	if !repoExists(sourcePath) {
+		body := &KitResponse{
+			Data: KitRepoResponse{
+				RepoPath: sourceName,
+			},
+		}
+		s.formatResponse(w, r.Request, body, http.StatusNotFound)
+		return nil
+	}
+
+	if _, err := os.Lstat(destPath); err == nil {
+		body := &KitResponse{
+			Data: KitRepoResponse{
+				RepoPath: destName,
+			},
+		}
+		s.formatResponse(w, r.Request, body, http.StatusConflict)
+		return nil
+	}
+
+	if err := s.cloneRepo(r.Context(), sourcePath, destPath, destName); err != nil {
+		// Do not leave a partial fork behind
+		os.RemoveAll(destPath)
+		s.fail500(w, r.Request, context, err)
+		return err
+	}
+
+	body := &KitResponse{
+		Data: KitRepoResponse{
+			RepoPath: destName,
+		},
+	}
+	s.formatResponse(w, r.Request, body, http.StatusCreated)
+	return nil
+}
+
+// authorizeRepo asks AuthFunc whether the client of r may run operation on
+// a repository named in the request body. It returns http.StatusOK if it
+// may, the status to respond with otherwise.
+func (s *Server) authorizeRepo(r *Request, name string, repoPath string, operation string) int {
+	namespace, _ := getNamespaceAndRepo(name)
+	req := &Request{
+		Request:    r.Request,
+		RepoName:   name,
+		Namespace:  namespace,
+		RepoPath:   repoPath,
+		Operation:  operation,
+		ID:         r.ID,
+		credential: r.credential,
+	}
+
+	allow, err := s.authorize(r.credential, req)
+	switch {
+	case err == errAuthTimeout:
+		s.logError(r.Request, "auth", err)
+		return http.StatusServiceUnavailable
+	case err != nil && err != ErrForbidden:
+		s.logError(r.Request, "auth", err)
+		return http.StatusForbidden
+	case !allow || err != nil:
+		s.logError(r.Request, "auth", fmt.Errorf("rejected %s of %s", operation, name))
+		return http.StatusForbidden
+	}
+	return http.StatusOK
+}
+
+// cloneRepo creates a bare copy of the repository at sourcePath. Objects are
+// hard linked when both are on the same file system.
+func (s *Server) cloneRepo(ctx context.Context, sourcePath string, destPath string, destName string) error {
+	if err := os.MkdirAll(path.Dir(destPath), 0755); err != nil {
+		return err
+	}
+	if _, err := s.gitOutput(ctx, "clone", "--quiet", "--bare", "--", sourcePath, destPath); err != nil {
+		return err
+	}
+
+	// The path of the source on the server is of no use to clients
+	if _, err := s.gitOutput(ctx, "--git-dir", destPath, "remote", "remove", "origin"); err != nil {
+		return err
+	}
+
+	if hooks := s.config.hooksFor(destName); s.config.AutoHooks && hooks != nil {
+		return hooks.setupInDir(destPath)
+	}
+	return nil
+}
+
+// Setup makes sure that the git binary can be run and prepares the
+// repositories directory
+func (s *Server) Setup() error {
+	s = s.snapshot()
+	if _, err := exec.LookPath(s.config.GitPath); err != nil {
+		return fmt.Errorf("git binary %q is not usable: %v", s.config.GitPath, err)
+	}
+	return s.config.Setup()
+}
+
+// initRepo creates a bare repository. HEAD points to branch unless it is
+// empty, in which case the default of git is kept.
+func initRepo(fullPath string, name string, branch string, config *Config) error {
+	args := []string{"init", "--bare"}
+	if config.SharedRepo != "" {
+		args = append(args, "--shared="+config.SharedRepo)
+	}
+	cmd := exec.Command(config.GitPath, append(args, fullPath)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: config.credential()}
+	if err := cmd.Run(); err != nil {
+		return gitStartError(config.GitPath, err)
+	}
+
+	if branch != "" {
+		cmd := exec.Command(config.GitPath, "--git-dir", fullPath, "symbolic-ref", "HEAD", "refs/heads/"+branch)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: config.credential()}
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	if hooks := config.hooksFor(name); config.AutoHooks && hooks != nil {
+		return hooks.setupInDir(fullPath)
+	}
+
+	return nil
+}
+
+// validBranchName reports whether git accepts name for a branch
+func validBranchName(gitPath string, name string) bool {
+	return exec.Command(gitPath, "check-ref-format", "refs/heads/"+name).Run() == nil
+}
+
+// findRepos walks the directory tree below root and returns the names of all
+// repositories found whose names end with suffix, relative to root.
+// Repositories are not descended into.
+func findRepos(root string, dir string, suffix string, depth int) ([]string, error) {
+	entries, err := os.ReadDir(path.Join(root, dir))
+	if err != nil {
+		return nil, err
+	}
+
+	repos := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		name := path.Join(dir, entry.Name())
+		if strings.HasSuffix(name, suffix) && repoExists(path.Join(root, name)) {
+			repos = append(repos, name)
+			continue
+		}
+
+		if depth > 1 {
+			found, err := findRepos(root, name, suffix, depth-1)
+			if err != nil {
+				return nil, err
+			}
+			repos = append(repos, found...)
+		}
+	}
+	return repos, nil
+}
+
+// repoExists reports whether p looks like a bare repository to git, which
+// needs the objects and refs directories and a HEAD file. Only stat calls are
+// made, it is checked for every request.
+func repoExists(p string) bool {
+	for _, dir := range []string{"objects", "refs"} {
+		info, err := os.Stat(path.Join(p, dir))
+		if err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	info, err := os.Stat(path.Join(p, "HEAD"))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// gitOutput runs git and returns its output. Git runs like it does for the rpc
+// handlers, bound to ctx and tracked for Shutdown.
+func (s *Server) gitOutput(ctx context.Context, args ...string) (string, error) {
+	return s.gitOutputEnv(ctx, nil, args...)
+}
+
+// gitOutputEnv is gitOutput with KEY=VALUE pairs added to the environment
+func (s *Server) gitOutputEnv(ctx context.Context, env []string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, s.config.GitPath, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: s.config.credential()}
+	cmd.Env = s.gitEnviron(env...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := s.startCommand(cmd); err != nil {
+		return "", err
+	}
+	defer s.releaseCommand(cmd)
+	defer watchProcessGroup(ctx, cmd)()
+
+	if err := cmd.Wait(); err != nil {
+		return "", commandError(err, &stderr)
+	}
+	return stdout.String(), nil
+}
+
+// gitEnviron returns the environment of git processes, the one of the server
+// with Config.TempDir and then the KEY=VALUE pairs of extra added
+func (s *Server) gitEnviron(extra ...string) []string {
+	env := os.Environ()
+	if s.config.TempDir != "" {
+		env = append(env, "TMPDIR="+s.config.TempDir)
+	}
+	return append(env, extra...)
+}
+
+// gitCommand prepares a git process serving the request. The process is killed
+// once the request context is done, e.g. when the HTTP client goes away
+// mid-transfer. Only stdout is streamed, stderr is collected in the buffer so
+// that it cannot corrupt the protocol.
+func (s *Server) gitCommand(r *Request, args ...string) (*exec.Cmd, io.ReadCloser, *bytes.Buffer) {
+	cmd := exec.CommandContext(r.Context(), s.config.GitPath, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: s.config.credential()}
+	cmd.Env = s.gitEnviron()
+	if s.GitEnvFunc != nil {
+		cmd.Env = append(cmd.Env, s.GitEnvFunc(r)...)
+	}
 
-	r, _ := cmd.StdoutPipe()
-	cmd.Stderr = cmd.Stdout
+	stdout, _ := cmd.StdoutPipe()
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
 
-	return cmd, r
+	return cmd, stdout, stderr
 }
@@ -0,0 +1,3136 @@
+package gitkit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeGitStub creates an executable script that stands in for the git binary.
+func writeGitStub(t *testing.T, dir string, script string) string {
+	path := filepath.Join(dir, "git-stub")
+	err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755)
+	assert.NoError(t, err)
+	return path
+}
+
+// makeRepo creates the skeleton of a bare repository, enough for repoExists
+// but not for git to serve it
+func makeRepo(t *testing.T, dir string, name string) {
+	for _, sub := range []string{"objects", "refs"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, name, sub), 0755))
+	}
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name, "HEAD"), []byte("ref: refs/heads/master\n"), 0644))
+}
+
+// runGit runs the real git binary in dir and returns its combined output.
+func runGit(dir string, args ...string) (string, error) {
+	args = append([]string{"-c", "user.name=gitkit", "-c", "user.email=gitkit@localhost"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// pushSampleCommit creates a local repository with a single commit and
+// pushes it to the given remote url.
+func pushSampleCommit(t *testing.T, dir string, url string) {
+	work := filepath.Join(dir, "work")
+	assert.NoError(t, os.MkdirAll(work, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(work, "README"), []byte("hello"), 0644))
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "README"},
+		{"commit", "-q", "-m", "initial commit"},
+		{"push", "-q", url, "HEAD:refs/heads/master"},
+	} {
+		out, err := runGit(work, args...)
+		assert.NoError(t, err, out)
+	}
+}
+
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestClientDisconnectKillsGitProcess(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	pidFile := filepath.Join(dir, "pid")
+	makeRepo(t, repos, "test.git")
+
+	gitPath := writeGitStub(t, dir, fmt.Sprintf("echo $$ > %s\nexec sleep 30\n", pidFile))
+	server := httptest.NewServer(New(Config{Dir: repos, GitPath: gitPath}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/test.git/info/refs?service=git-upload-pack", nil)
+	go func() {
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	var pid int
+	started := waitFor(5*time.Second, func() bool {
+		data, err := ioutil.ReadFile(pidFile)
+		if err != nil {
+			return false
+		}
+		pid, err = strconv.Atoi(strings.TrimSpace(string(data)))
+		return err == nil
+	})
+	assert.True(t, started, "git process did not start")
+
+	cancel()
+
+	exited := waitFor(5*time.Second, func() bool {
+		return syscall.Kill(pid, 0) != nil
+	})
+	assert.True(t, exited, "git process is still running after client disconnect")
+}
+
+func TestProtocolV2Advertisement(t *testing.T) {
+	dir := t.TempDir()
+	cases := map[bool]string{
+		true:  "000eversion 2\n",
+		false: "001e# service=git-upload-pack\n0000",
+	}
+
+	out, err := runGit(dir, "init", "-q", "--bare", "test.git")
+	assert.NoError(t, err, out)
+
+	for enabled, prefix := range cases {
+		server := httptest.NewServer(New(Config{Dir: dir, ProtocolV2: enabled}))
+
+		req, _ := http.NewRequest("GET", server.URL+"/test.git/info/refs?service=git-upload-pack", nil)
+		req.Header.Set("Git-Protocol", "version=2")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		server.Close()
+
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.True(t, strings.HasPrefix(string(body), prefix), string(body))
+	}
+}
+
+func TestProtocolV2Clone(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewServer(New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true, ProtocolV2: true}))
+	defer server.Close()
+
+	pushSampleCommit(t, dir, server.URL+"/test.git")
+
+	out, err := runGit(dir, "-c", "protocol.version=2", "clone", "-q", "-b", "master", server.URL+"/test.git", "clone")
+	assert.NoError(t, err, out)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "clone", "README"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true, ProtocolV2: true})
+
+	var lock sync.Mutex
+	protos := map[string]bool{}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		protos[r.Proto] = true
+		lock.Unlock()
+		server.ServeHTTP(w, r)
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	// The test server has a self-signed certificate
+	t.Setenv("GIT_SSL_NO_VERIFY", "1")
+
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+	for _, version := range []string{"0", "2"} {
+		clone := filepath.Join(dir, "clone-v"+version)
+		out, err := runGit(dir, "-c", "http.version=HTTP/2", "-c", "protocol.version="+version, "clone", "-q", ts.URL+"/test.git", clone)
+		assert.NoError(t, err, out)
+
+		data, err := ioutil.ReadFile(filepath.Join(clone, "README"))
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, map[string]bool{"HTTP/2.0": true}, protos)
+}
+
+// Clones check out the branch HEAD of the repository points to, which git
+// tells them with the symref capability of the advertisement
+func TestCloneDefaultBranch(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: filepath.Join(dir, "repos"), ProtocolV2: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/test.git/repo", strings.NewReader(`{"defaultBranch":"trunk"}`)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// master is pushed too and sorts first, clones must not pick it
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+	out, err := runGit(filepath.Join(dir, "work"), "push", "-q", ts.URL+"/test.git", "HEAD:refs/heads/trunk")
+	assert.NoError(t, err, out)
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/test.git/info/refs?service=git-upload-pack", nil))
+	assert.Contains(t, w.Body.String(), "symref=HEAD:refs/heads/trunk")
+
+	for _, version := range []string{"0", "2"} {
+		clone := filepath.Join(dir, "clone-v"+version)
+		out, err := runGit(dir, "-c", "protocol.version="+version, "clone", "-q", ts.URL+"/test.git", clone)
+		assert.NoError(t, err, out)
+
+		out, err = runGit(clone, "symbolic-ref", "HEAD")
+		assert.NoError(t, err, out)
+		assert.Equal(t, "refs/heads/trunk\n", out, version)
+	}
+}
+
+// Progress of upload-pack reaches the client through the stateless rpc
+// responses, and so do keepalives, which git sends in the same band
+func TestCloneProgress(t *testing.T) {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	gitPath := writeGitStub(t, dir, fmt.Sprintf(`echo "$@" >> %s
+exec git "$@"
+`, calls))
+	server := httptest.NewServer(New(Config{Dir: filepath.Join(dir, "repos"), GitPath: gitPath, AutoCreate: true, KeepAlive: 3 * time.Second}))
+	defer server.Close()
+
+	pushSampleCommit(t, dir, server.URL+"/test.git")
+
+	out, err := runGit(dir, "clone", "--progress", server.URL+"/test.git", "clone")
+	assert.NoError(t, err, out)
+	assert.Contains(t, out, "remote: Enumerating objects")
+
+	data, err := ioutil.ReadFile(calls)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "-c uploadpack.keepAlive=3 upload-pack --stateless-rpc")
+	assert.Contains(t, string(data), "-c receive.keepAlive=3 receive-pack --stateless-rpc")
+}
+
+func TestPreReceiveRejectionMessage(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewServer(New(Config{
+		Dir:        filepath.Join(dir, "repos"),
+		AutoCreate: true,
+		AutoHooks:  true,
+		Hooks: &HookScripts{
+			PreReceive: "#!/bin/sh\necho rejected by policy >&2\nexit 1\n",
+		},
+	}))
+	defer server.Close()
+
+	work := filepath.Join(dir, "work")
+	assert.NoError(t, os.MkdirAll(work, 0755))
+	runGit(work, "init", "-q")
+	runGit(work, "commit", "-q", "--allow-empty", "-m", "initial commit")
+
+	out, err := runGit(work, "push", server.URL+"/test.git", "HEAD:refs/heads/master")
+	assert.Error(t, err)
+	assert.Contains(t, out, "remote: rejected by policy")
+}
+
+func TestFsckOnReceive(t *testing.T) {
+	dir := t.TempDir()
+	work := filepath.Join(dir, "work")
+	assert.NoError(t, os.MkdirAll(work, 0755))
+	runGit(work, "init", "-q")
+
+	// A commit without a valid author, which git fsck reports
+	tree, err := runGit(work, "mktree")
+	assert.NoError(t, err, tree)
+	commit := filepath.Join(dir, "commit")
+	data := "tree " + strings.TrimSpace(tree) + "\nauthor broken\ncommitter broken\n\nbroken commit\n"
+	assert.NoError(t, ioutil.WriteFile(commit, []byte(data), 0644))
+	sha, err := runGit(work, "hash-object", "-t", "commit", "-w", "--literally", commit)
+	assert.NoError(t, err, sha)
+	out, err := runGit(work, "update-ref", "refs/heads/master", strings.TrimSpace(sha))
+	assert.NoError(t, err, out)
+
+	for _, fsck := range []bool{false, true} {
+		server := httptest.NewServer(New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true, FsckOnReceive: fsck}))
+		out, err := runGit(work, "push", server.URL+fmt.Sprintf("/fsck-%t.git", fsck), "HEAD:refs/heads/master")
+		server.Close()
+
+		if fsck {
+			assert.Error(t, err)
+			assert.Contains(t, out, "fsck error")
+		} else {
+			assert.NoError(t, err, out)
+		}
+	}
+}
+
+func TestReceivePackStderrRelayedOverSideband(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	makeRepo(t, repos, "test.git")
+
+	gitPath := writeGitStub(t, dir, "cat > /dev/null\necho hook says no >&2\nprintf 0000\nexit 1\n")
+	server := httptest.NewServer(New(Config{Dir: repos, GitPath: gitPath}))
+	defer server.Close()
+
+	cases := map[string]string{
+		"report-status side-band-64k": "0012\x02hook says no\n0000",
+		"report-status":               "0000",
+	}
+
+	for caps, expected := range cases {
+		body := &strings.Builder{}
+		packLine(body, ZeroSHA+" "+ZeroSHA+" refs/heads/master\x00"+caps+"\n")
+		packFlush(body)
+
+		resp, err := http.Post(server.URL+"/test.git/git-receive-pack", "application/x-git-receive-pack-request", strings.NewReader(body.String()))
+		assert.NoError(t, err)
+
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, expected, string(data))
+	}
+}
+
+func TestEmptyPushBody(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	calls := filepath.Join(dir, "calls")
+	makeRepo(t, repos, "test.git")
+
+	gitPath := writeGitStub(t, dir, fmt.Sprintf("echo >> %s\ncat > /dev/null\nprintf 0000\n", calls))
+	server := New(Config{Dir: repos, GitPath: gitPath})
+
+	push := func(body string, gzipped bool) int {
+		r := httptest.NewRequest("POST", "/test.git/git-receive-pack", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-git-receive-pack-request")
+		if gzipped {
+			r.Header.Set("Content-Encoding", "gzip")
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusBadRequest, push("", false))
+	assert.Equal(t, http.StatusBadRequest, push("", true))
+	_, err := os.Stat(calls)
+	assert.True(t, os.IsNotExist(err), "git must not be started")
+
+	// A flush is up to git
+	assert.Equal(t, http.StatusOK, push("0000", false))
+	assert.FileExists(t, calls)
+}
+
+func TestRepoExists(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	makeRepo(t, repos, "team/project.git")
+	makeRepo(t, dir, "outside.git")
+
+	server := New(Config{Dir: repos})
+
+	assert.True(t, server.RepoExists("team/project.git"))
+	assert.True(t, server.RepoExists("/team/project.git"))
+	assert.False(t, server.RepoExists("team/missing.git"))
+	assert.False(t, server.RepoExists("team"))
+	assert.False(t, server.RepoExists(""))
+	assert.False(t, server.RepoExists("../outside.git"))
+}
+
+func Test_repoExists(t *testing.T) {
+	dir := t.TempDir()
+
+	bare := filepath.Join(dir, "bare.git")
+	out, err := runGit(dir, "init", "-q", "--bare", bare)
+	assert.NoError(t, err, out)
+	assert.True(t, repoExists(bare))
+
+	empty := filepath.Join(dir, "empty.git")
+	assert.NoError(t, os.Mkdir(empty, 0755))
+	assert.False(t, repoExists(empty))
+
+	objectsOnly := filepath.Join(dir, "objects-only.git")
+	assert.NoError(t, os.MkdirAll(filepath.Join(objectsOnly, "objects"), 0755))
+	assert.False(t, repoExists(objectsOnly))
+
+	// HEAD has to be a file, refs a directory
+	broken := filepath.Join(dir, "broken.git")
+	for _, sub := range []string{"objects", "refs", "HEAD"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(broken, sub), 0755))
+	}
+	assert.False(t, repoExists(broken))
+
+	assert.False(t, repoExists(filepath.Join(dir, "missing.git")))
+}
+
+func TestRenameRepo(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	makeRepo(t, repos, "alice/repo.git")
+	makeRepo(t, repos, "bob/taken.git")
+
+	server := New(Config{Dir: repos})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	cases := []struct {
+		body string
+		code int
+	}{
+		{`{"from": "alice/missing.git", "to": "alice/other.git"}`, 404},
+		{`{"from": "alice/repo.git", "to": "bob/taken.git"}`, 409},
+		{`{"from": "alice/repo.git", "to": "../escaped.git"}`, 400},
+		{`{"from": "alice/repo.git"}`, 400},
+		{`not json`, 400},
+		{`{"from": "alice/repo.git", "to": "carol/repo.git"}`, 200},
+	}
+
+	for _, c := range cases {
+		resp, err := http.Post(ts.URL+"/repo/rename", "application/json", strings.NewReader(c.body))
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, c.code, resp.StatusCode, c.body)
+	}
+
+	assert.False(t, server.RepoExists("alice/repo.git"))
+	assert.True(t, server.RepoExists("carol/repo.git"))
+}
+
+func TestForkRepo(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	makeRepo(t, repos, "bob/taken.git")
+	makeRepo(t, dir, "outside.git")
+
+	server := New(Config{
+		Dir:        repos,
+		AutoCreate: true,
+		AutoHooks:  true,
+		Hooks:      &HookScripts{PreReceive: "#!/bin/sh\nexit 0\n"},
+	})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/alice/repo.git")
+
+	cases := []struct {
+		body string
+		code int
+	}{
+		{`{"source": "alice/missing.git", "dest": "bob/repo.git"}`, 404},
+		{`{"source": "alice/repo.git", "dest": "bob/taken.git"}`, 409},
+		{`{"source": "alice/repo.git", "dest": "alice/repo.git"}`, 409},
+		{`{"source": "alice/repo.git", "dest": "../escaped.git"}`, 400},
+		{`{"source": "../outside.git", "dest": "bob/repo.git"}`, 400},
+		{`{"source": "alice/repo.git"}`, 400},
+		{`not json`, 400},
+		{`{"source": "alice/repo.git", "dest": "bob/repo.git"}`, 201},
+	}
+
+	for _, c := range cases {
+		resp, err := http.Post(ts.URL+"/repo/fork", "application/json", strings.NewReader(c.body))
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, c.code, resp.StatusCode, c.body)
+	}
+
+	assert.True(t, server.RepoExists("alice/repo.git"))
+	assert.True(t, server.RepoExists("bob/repo.git"))
+	assert.NoFileExists(t, filepath.Join(dir, "escaped.git"))
+	assert.FileExists(t, filepath.Join(repos, "bob", "repo.git", "hooks", "pre-receive"))
+
+	out, err := runGit(dir, "clone", "-q", ts.URL+"/bob/repo.git", "clone")
+	assert.NoError(t, err, out)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "clone", "README"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// The fork does not point back to the server path of its source
+	out, _ = runGit(dir, "--git-dir", filepath.Join(repos, "bob", "repo.git"), "remote")
+	assert.Empty(t, strings.TrimSpace(out))
+}
+
+func TestForkRepoAuth(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "alice/private.git")
+	makeRepo(t, dir, "alice/public.git")
+
+	server := New(Config{Dir: dir, Auth: true})
+	server.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		switch req.Operation {
+		case OperationFork:
+			return true, nil
+		case OperationDownload:
+			return req.RepoName == "alice/public.git", nil
+		case OperationUpload:
+			return req.Namespace == "bob", nil
+		}
+		return false, nil
+	}
+
+	fork := func(body string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/repo/fork", strings.NewReader(body))
+		r.SetBasicAuth("bob", "secret")
+		server.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Forks need read access to the source and write access to the
+	// destination
+	assert.Equal(t, http.StatusForbidden, fork(`{"source": "alice/private.git", "dest": "bob/private.git"}`))
+	assert.Equal(t, http.StatusForbidden, fork(`{"source": "alice/public.git", "dest": "alice/copy.git"}`))
+	assert.Equal(t, http.StatusCreated, fork(`{"source": "alice/public.git", "dest": "bob/public.git"}`))
+
+	assert.False(t, server.RepoExists("bob/private.git"))
+	assert.False(t, server.RepoExists("alice/copy.git"))
+	assert.True(t, server.RepoExists("bob/public.git"))
+}
+
+func TestListRepo(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	makeRepo(t, repos, "alice/repo.git")
+	makeRepo(t, repos, "bob/other.git")
+	makeRepo(t, repos, "top.git")
+	makeRepo(t, repos, "org/team/project.git")
+	makeRepo(t, repos, "org/team/deep/hidden.git")
+	assert.NoError(t, os.MkdirAll(filepath.Join(repos, "org/empty.git"), 0755))
+
+	// No FilterRepoFunc is set, all repositories are listed
+	ts := httptest.NewServer(New(Config{Dir: repos}))
+	defer ts.Close()
+
+	// Listing must not depend on the working directory of the process
+	code, list := getRepoList(t, ts.URL+"/repos")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, 4, list.Total)
+	assert.ElementsMatch(t, []string{"alice/repo.git", "bob/other.git", "top.git", "org/team/project.git"}, list.RepoPath)
+}
+
+// getRepoList fetches the repos listing at url and returns the response code
+func getRepoList(t *testing.T, url string) (int, KitListRepoResponse) {
+	resp, err := http.Get(url)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	body := struct {
+		Code int                 `json:"code"`
+		Data KitListRepoResponse `json:"data"`
+	}{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, resp.StatusCode, body.Code)
+	return body.Code, body.Data
+}
+
+func TestListRepoDirs(t *testing.T) {
+	dir := t.TempDir()
+
+	// Missing and empty directories have no repositories yet
+	missing := httptest.NewServer(New(Config{Dir: filepath.Join(dir, "missing")}))
+	defer missing.Close()
+	code, list := getRepoList(t, missing.URL+"/repos")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, list.RepoPath)
+	assert.Equal(t, 0, list.Total)
+
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "empty"), 0755))
+	empty := httptest.NewServer(New(Config{Dir: filepath.Join(dir, "empty")}))
+	defer empty.Close()
+	code, list = getRepoList(t, empty.URL+"/repos")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotNil(t, list.RepoPath)
+	assert.Empty(t, list.RepoPath)
+
+	makeRepo(t, filepath.Join(dir, "populated"), "test.git")
+	populated := httptest.NewServer(New(Config{Dir: filepath.Join(dir, "populated")}))
+	defer populated.Close()
+	code, list = getRepoList(t, populated.URL+"/repos")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"test.git"}, list.RepoPath)
+}
+
+func TestListRepoBareSuffix(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true, AnyRepoName: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	// Plain directory names are served and listed, other directories skipped
+	pushSampleCommit(t, dir, ts.URL+"/team/project")
+	makeRepo(t, filepath.Join(dir, "repos"), "other.git")
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "repos", "team", "notes"), 0755))
+	code, list := getRepoList(t, ts.URL+"/repos")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"other.git", "team/project"}, list.RepoPath)
+
+	other := httptest.NewServer(New(Config{Dir: filepath.Join(dir, "repos"), BareSuffix: ".git"}))
+	defer other.Close()
+	code, list = getRepoList(t, other.URL+"/repos")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"other.git"}, list.RepoPath)
+
+	// Names without the suffix resolve to the repository with it
+	out, err := runGit(dir, "ls-remote", other.URL+"/other")
+	assert.NoError(t, err, out)
+	out, err = runGit(dir, "ls-remote", ts.URL+"/other")
+	assert.Error(t, err, out)
+}
+
+func TestSetupCreateDir(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "nested", "repos")
+
+	err := New(Config{Dir: repos}).Setup()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "set Config.CreateDir")
+	}
+	assert.NoFileExists(t, repos)
+
+	assert.NoError(t, New(Config{Dir: repos, CreateDir: true}).Setup())
+	assert.DirExists(t, repos)
+
+	// Existing directories are fine either way
+	assert.NoError(t, New(Config{Dir: repos}).Setup())
+}
+
+func TestTempDir(t *testing.T) {
+	dir := t.TempDir()
+	tmp := filepath.Join(dir, "tmp")
+	assert.NoError(t, os.Mkdir(tmp, 0755))
+	env := filepath.Join(dir, "env")
+	gitPath := writeGitStub(t, dir, fmt.Sprintf(`echo "$TMPDIR $@" >> %s
+exec git "$@"
+`, env))
+
+	server := New(Config{Dir: filepath.Join(dir, "repos"), GitPath: gitPath, CreateDir: true, AutoCreate: true, TempDir: tmp})
+	assert.NoError(t, server.Setup())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/test.git/repo/size", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	data, err := ioutil.ReadFile(env)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), tmp+" receive-pack --stateless-rpc")
+	assert.Contains(t, string(data), tmp+" --git-dir "+filepath.Join(dir, "repos", "test.git")+" count-objects")
+
+	// The directory has to exist
+	err = New(Config{Dir: dir, TempDir: filepath.Join(dir, "missing")}).Setup()
+	assert.Error(t, err)
+	err = New(Config{Dir: dir, TempDir: env}).Setup()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is not a directory")
+	}
+}
+
+func TestListRepoPagination(t *testing.T) {
+	repos := t.TempDir()
+	for _, name := range []string{"a/1.git", "a/2.git", "a/3.git", "a/secret.git", "b/1.git"} {
+		makeRepo(t, repos, name)
+	}
+
+	server := New(Config{Dir: repos})
+	server.FilterRepoFunc = func(repos []string, _ *Request) []string {
+		allowed := []string{}
+		for _, repo := range repos {
+			if repo != "a/secret.git" {
+				allowed = append(allowed, repo)
+			}
+		}
+		return allowed
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	cases := map[string]KitListRepoResponse{
+		"":                            {RepoPath: []string{"a/1.git", "a/2.git", "a/3.git", "b/1.git"}, Total: 4},
+		"?limit=2":                    {RepoPath: []string{"a/1.git", "a/2.git"}, Total: 4},
+		"?limit=2&offset=3":           {RepoPath: []string{"b/1.git"}, Total: 4},
+		"?offset=10":                  {RepoPath: []string{}, Total: 4},
+		"?prefix=a/":                  {RepoPath: []string{"a/1.git", "a/2.git", "a/3.git"}, Total: 3},
+		"?prefix=a/&limit=1&offset=1": {RepoPath: []string{"a/2.git"}, Total: 3},
+	}
+
+	for query, expected := range cases {
+		code, list := getRepoList(t, ts.URL+"/repos"+query)
+		assert.Equal(t, 200, code, query)
+		assert.Equal(t, expected, list, query)
+	}
+
+	for _, query := range []string{"?limit=abc", "?offset=-1"} {
+		code, _ := getRepoList(t, ts.URL+"/repos"+query)
+		assert.Equal(t, 400, code, query)
+	}
+}
+
+func TestListRepoDetail(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+	assert.NoError(t, server.CreateRepo("empty.git"))
+
+	// Details are left out unless asked for
+	_, list := getRepoList(t, ts.URL+"/repos")
+	assert.Nil(t, list.Repos)
+
+	lastModified := func() map[string]time.Time {
+		_, list := getRepoList(t, ts.URL+"/repos?detail=true&limit=10")
+		times := map[string]time.Time{}
+		for _, repo := range list.Repos {
+			times[repo.Path] = repo.LastModified
+		}
+		return times
+	}
+
+	before := lastModified()
+	assert.Len(t, before, 2)
+	assert.False(t, before["test.git"].IsZero())
+
+	time.Sleep(20 * time.Millisecond)
+	out, err := runGit(filepath.Join(dir, "work"), "commit", "-q", "--allow-empty", "-m", "second commit")
+	assert.NoError(t, err, out)
+	out, err = runGit(filepath.Join(dir, "work"), "push", "-q", ts.URL+"/test.git", "HEAD:refs/heads/master")
+	assert.NoError(t, err, out)
+
+	after := lastModified()
+	assert.True(t, after["test.git"].After(before["test.git"]), after["test.git"].String())
+	assert.Equal(t, before["empty.git"], after["empty.git"])
+}
+
+func Test_findRepos(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "a/b/c/d.git")
+	makeRepo(t, dir, "a/b.git")
+	makeRepo(t, dir, "a/b.git/nested.git")
+
+	for depth, expected := range map[int][]string{
+		1: {},
+		2: {"a/b.git"},
+		4: {"a/b.git", "a/b/c/d.git"},
+	} {
+		repos, err := findRepos(dir, "", ".git", depth)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, expected, repos)
+	}
+
+	// Without a suffix every repository counts
+	makeRepo(t, dir, "a/e")
+	repos, err := findRepos(dir, "", "", 4)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a/b.git", "a/b/c/d.git", "a/e"}, repos)
+}
+
+func TestPostReceiveFunc(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true})
+
+	received := make(chan string, 1)
+	server.PostReceiveFunc = func(r *Request) error {
+		received <- r.RepoName
+		return fmt.Errorf("callback errors must not fail the push")
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/team/test.git")
+
+	select {
+	case name := <-received:
+		assert.Equal(t, "team/test.git", name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("post-receive callback was not called")
+	}
+}
+
+func TestRefUpdateFunc(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{
+		Dir:        filepath.Join(dir, "repos"),
+		AutoCreate: true,
+		AutoHooks:  true,
+		Hooks: &HookScripts{
+			Update: "#!/bin/sh\ntest \"$1\" != refs/heads/blocked\n",
+		},
+	})
+
+	received := make(chan []RefUpdate, 1)
+	server.RefUpdateFunc = func(r *Request, updates []RefUpdate) error {
+		received <- updates
+		return nil
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	url := ts.URL + "/test.git"
+	pushSampleCommit(t, dir, url)
+	<-received
+
+	work := filepath.Join(dir, "work")
+	head, _ := runGit(work, "rev-parse", "HEAD")
+	head = strings.TrimSpace(head)
+
+	cases := []struct {
+		args     []string
+		expected []RefUpdate
+	}{
+		{
+			[]string{"push", url, "HEAD:refs/heads/feature", "HEAD:refs/heads/blocked", "HEAD:refs/tags/v1"},
+			[]RefUpdate{
+				{OldSHA: ZeroSHA, NewSHA: head, Ref: "refs/heads/feature"},
+				{OldSHA: ZeroSHA, NewSHA: head, Ref: "refs/tags/v1"},
+			},
+		},
+		{
+			[]string{"push", "--atomic", url, "HEAD:refs/heads/other", "HEAD:refs/heads/blocked"},
+			nil,
+		},
+		{
+			[]string{"push", url, ":refs/heads/feature"},
+			[]RefUpdate{
+				{OldSHA: head, NewSHA: ZeroSHA, Ref: "refs/heads/feature"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		runGit(work, c.args...)
+
+		var updates []RefUpdate
+		select {
+		case updates = <-received:
+		case <-time.After(time.Second):
+		}
+		assert.Equal(t, c.expected, updates, c.args)
+	}
+}
+
+func TestDisabledServices(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+
+	writable := httptest.NewServer(New(Config{Dir: repos, AutoCreate: true}))
+	defer writable.Close()
+	pushSampleCommit(t, dir, writable.URL+"/test.git")
+
+	mirror := httptest.NewServer(New(Config{
+		Dir:              repos,
+		DisabledServices: []string{"git-receive-pack", "POST /repo", "DELETE /repo"},
+	}))
+	defer mirror.Close()
+
+	out, err := runGit(dir, "clone", "-q", mirror.URL+"/test.git", "clone")
+	assert.NoError(t, err, out)
+
+	out, err = runGit(filepath.Join(dir, "work"), "push", mirror.URL+"/test.git", "HEAD:refs/heads/other")
+	assert.Error(t, err)
+	assert.Contains(t, out, "403")
+
+	for _, req := range []struct{ method, path string }{
+		{"POST", "/test.git/git-receive-pack"},
+		{"POST", "/new.git/repo"},
+		{"DELETE", "/test.git/repo"},
+	} {
+		r, _ := http.NewRequest(req.method, mirror.URL+req.path, nil)
+		resp, err := http.DefaultClient.Do(r)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, req.path)
+	}
+
+	// Renames are still allowed as they were not disabled
+	resp, err := http.Post(mirror.URL+"/repo/rename", "application/json", strings.NewReader(`{"from": "test.git", "to": "renamed.git"}`))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+
+	writable := httptest.NewServer(New(Config{Dir: repos, AutoCreate: true}))
+	defer writable.Close()
+	pushSampleCommit(t, dir, writable.URL+"/test.git")
+
+	mirror := httptest.NewServer(New(Config{Dir: repos, AutoCreate: true, ReadOnly: true}))
+	defer mirror.Close()
+
+	out, err := runGit(dir, "clone", "-q", mirror.URL+"/test.git", "clone")
+	assert.NoError(t, err, out)
+
+	out, err = runGit(filepath.Join(dir, "work"), "push", mirror.URL+"/test.git", "HEAD:refs/heads/other")
+	assert.Error(t, err)
+	assert.Contains(t, out, "403")
+
+	for _, req := range []struct{ method, path string }{
+		{"GET", "/test.git/info/refs?service=git-receive-pack"},
+		{"POST", "/test.git/git-receive-pack"},
+		{"POST", "/new.git/repo"},
+		{"DELETE", "/test.git/repo"},
+		{"POST", "/repo/rename"},
+	} {
+		r, _ := http.NewRequest(req.method, mirror.URL+req.path, nil)
+		resp, err := http.DefaultClient.Do(r)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, req.path)
+	}
+
+	// Missing repositories are not created in read-only mode
+	resp, err := http.Get(mirror.URL + "/other.git/info/refs?service=git-upload-pack")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.True(t, New(Config{Dir: repos}).RepoExists("test.git"))
+	assert.False(t, New(Config{Dir: repos}).RepoExists("other.git"))
+}
+
+func TestDeleteRepo(t *testing.T) {
+	repos := t.TempDir()
+	out, err := runGit(repos, "init", "-q", "--bare", "team/test.git")
+	assert.NoError(t, err, out)
+	server := New(Config{Dir: repos})
+
+	cases := map[string]int{
+		"team/missing.git": http.StatusNotFound,
+		"team/test.git":    http.StatusAccepted,
+	}
+
+	for name, code := range cases {
+		w := httptest.NewRecorder()
+		server.deleteRepo("", w, &Request{Request: httptest.NewRequest("DELETE", "/"+name+"/repo", nil), RepoName: name})
+		assert.Equal(t, code, w.Code, name)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	}
+	assert.False(t, server.RepoExists("team/test.git"))
+
+	// Missing repositories never reach the handler through ServeHTTP
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	req, _ := http.NewRequest("DELETE", ts.URL+"/team/missing.git/repo", nil)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestCreateAndDeleteRepoAPI(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	server := New(Config{
+		Dir:           repos,
+		DefaultBranch: "main",
+		AutoHooks:     true,
+		Hooks:         &HookScripts{PreReceive: "#!/bin/sh\nexit 0\n"},
+	})
+
+	assert.NoError(t, server.CreateRepo("team/project.git"))
+	assert.True(t, server.RepoExists("team/project.git"))
+	assert.FileExists(t, filepath.Join(repos, "team", "project.git", "hooks", "pre-receive"))
+	head, err := ioutil.ReadFile(filepath.Join(repos, "team", "project.git", "HEAD"))
+	assert.NoError(t, err)
+	assert.Equal(t, "ref: refs/heads/main\n", string(head))
+
+	assert.Equal(t, ErrRepoExists, server.CreateRepo("team/project.git"))
+	assert.Equal(t, ErrInvalidRepoName, server.CreateRepo("team/bad name.git"))
+	assert.Equal(t, ErrInvalidRepoName, server.CreateRepo("../outside.git"))
+	assert.Equal(t, ErrInvalidRepoName, server.CreateRepo(""))
+	assert.NoFileExists(t, filepath.Join(dir, "outside.git"))
+
+	// Repositories with refs are deleted too
+	pushSampleCommit(t, dir, filepath.Join(repos, "team", "project.git"))
+	assert.NoError(t, server.DeleteRepo("team/project.git"))
+	assert.False(t, server.RepoExists("team/project.git"))
+
+	assert.Equal(t, ErrRepoNotFound, server.DeleteRepo("team/project.git"))
+	assert.Equal(t, ErrInvalidRepoName, server.DeleteRepo("../repos"))
+	assert.DirExists(t, repos)
+}
+
+func TestDeleteNonEmptyRepo(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	server := New(Config{Dir: repos, AutoCreate: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+
+	del := func(target string) (int, string) {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("DELETE", target, nil))
+
+		body := struct {
+			Data KitErrorResponse `json:"data"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body.Data.Message
+	}
+
+	code, message := del("/test.git/repo")
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Contains(t, message, "force=true")
+	assert.True(t, server.RepoExists("test.git"))
+
+	code, _ = del("/test.git/repo?force=true")
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.False(t, server.RepoExists("test.git"))
+}
+
+func TestDeleteRepoPermissionDenied(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+
+	repos := t.TempDir()
+	makeRepo(t, repos, "team/test.git")
+	assert.NoError(t, os.Chmod(filepath.Join(repos, "team"), 0500))
+	defer os.Chmod(filepath.Join(repos, "team"), 0755)
+
+	w := httptest.NewRecorder()
+	New(Config{Dir: repos}).deleteRepo("", w, &Request{Request: httptest.NewRequest("DELETE", "/team/test.git/repo?force=true", nil), RepoName: "team/test.git"})
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestPathTraversal(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	makeRepo(t, repos, "test.git")
+	makeRepo(t, dir, "outside.git")
+
+	server := New(Config{Dir: repos, AutoCreate: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	cases := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{"GET", "/../outside.git/info/refs?service=git-upload-pack", 400},
+		{"GET", "/team/../../outside.git/info/refs?service=git-upload-pack", 400},
+		{"GET", "/%2e%2e/outside.git/info/refs?service=git-upload-pack", 400},
+		{"GET", "/%2E%2E/%2e%2e/etc/info/refs?service=git-upload-pack", 400},
+		{"GET", "/test.git/..//info/refs?service=git-upload-pack", 400},
+		{"POST", "/../created.git/repo", 400},
+		{"DELETE", "/../outside.git/repo", 400},
+		{"DELETE", "/%2e%2e/outside.git/repo", 400},
+		// Absolute paths are resolved inside the repos directory
+		{"GET", "/" + filepath.Join(dir, "absolute.git") + "/info/refs?service=git-receive-pack", 200},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, ts.URL+c.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, c.code, resp.StatusCode, c.path)
+	}
+
+	_, err := os.Stat(filepath.Join(dir, "outside.git"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "created.git"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "absolute.git"))
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, server.RepoExists(filepath.Join(dir, "absolute.git")))
+
+	for _, name := range []string{"../outside.git", "", "team/.."} {
+		w := httptest.NewRecorder()
+		server.deleteRepo("", w, &Request{RepoName: name})
+		assert.Equal(t, http.StatusBadRequest, w.Code, name)
+
+		w = httptest.NewRecorder()
+		server.createRepo("", w, &Request{RepoName: name, RepoPath: path.Join(repos, name)})
+		assert.Equal(t, http.StatusBadRequest, w.Code, name)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	pidFile := filepath.Join(dir, "pid")
+	makeRepo(t, repos, "test.git")
+
+	gitPath := writeGitStub(t, dir, fmt.Sprintf("echo $$ > %s\nexec sleep 30\n", pidFile))
+	server := httptest.NewServer(New(Config{Dir: repos, GitPath: gitPath, RequestTimeout: 200 * time.Millisecond}))
+	defer server.Close()
+
+	requests := map[string]string{
+		"GET":  "/test.git/info/refs?service=git-upload-pack",
+		"POST": "/test.git/git-upload-pack",
+	}
+
+	for method, path := range requests {
+		os.Remove(pidFile)
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader("0000"))
+
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			// Responses flushed before the timeout are cut short
+			_, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		assert.Error(t, err, path)
+		assert.True(t, time.Since(start) < 5*time.Second, path)
+
+		data, _ := ioutil.ReadFile(pidFile)
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+		assert.NotEqual(t, 0, pid)
+
+		exited := waitFor(5*time.Second, func() bool {
+			return syscall.Kill(pid, 0) != nil
+		})
+		assert.True(t, exited, "git process is still running after timeout")
+	}
+}
+
+func TestMaxConcurrentProcs(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	started, release := filepath.Join(dir, "started"), filepath.Join(dir, "release")
+	makeRepo(t, repos, "test.git")
+
+	gitPath := writeGitStub(t, dir, fmt.Sprintf(`echo >> %s
+while [ ! -f %s ]; do sleep 0.01; done
+printf 0000
+`, started, release))
+	server := New(Config{Dir: repos, GitPath: gitPath, MaxConcurrentProcs: 2, MaxConcurrentPushes: 1})
+
+	request := func(service string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/test.git/info/refs?service="+service, nil))
+		return w
+	}
+	running := func(n int) bool {
+		return waitFor(5*time.Second, func() bool {
+			data, _ := ioutil.ReadFile(started)
+			return strings.Count(string(data), "\n") == n
+		})
+	}
+
+	done := make(chan int, 3)
+	for _, service := range []string{"git-upload-pack", "git-upload-pack", "git-receive-pack"} {
+		go func(service string) {
+			done <- request(service).Code
+		}(service)
+	}
+	assert.True(t, running(3))
+
+	// Both limits are reached, neither waits
+	for _, service := range []string{"git-upload-pack", "git-receive-pack"} {
+		w := request(service)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code, service)
+		assert.Equal(t, "1", w.Header().Get("Retry-After"), service)
+	}
+
+	assert.NoError(t, ioutil.WriteFile(release, nil, 0644))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, <-done)
+	}
+
+	// Slots are given back
+	assert.Equal(t, http.StatusOK, request("git-upload-pack").Code)
+	assert.Equal(t, http.StatusOK, request("git-receive-pack").Code)
+}
+
+func TestDumbHTTP(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+
+	makeRepo(t, dir, "outside.git")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "outside.git", "HEAD"), []byte("ref: refs/heads/master\n"), 0644))
+
+	server := httptest.NewServer(New(Config{Dir: repos, AutoCreate: true, DumbHTTP: true}))
+	defer server.Close()
+	pushSampleCommit(t, dir, server.URL+"/team/test.git")
+
+	cmd := exec.Command("git", "clone", "-q", "-b", "master", server.URL+"/team/test.git", "clone")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_SMART_HTTP=0")
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err, string(out))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "clone", "README"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	cases := map[string]string{
+		"/team/test.git/info/refs":          "text/plain",
+		"/team/test.git/HEAD":               "text/plain",
+		"/team/test.git/objects/info/packs": "text/plain; charset=utf-8",
+	}
+	for url, contentType := range cases {
+		resp, err := http.Get(server.URL + url)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, 200, resp.StatusCode, url)
+		assert.Equal(t, contentType, resp.Header.Get("Content-Type"), url)
+	}
+
+	// Objects can be downloaded in parts
+	objects, _ := filepath.Glob(filepath.Join(repos, "team", "test.git", "objects", "??", "*"))
+	if assert.NotEmpty(t, objects) {
+		object, err := ioutil.ReadFile(objects[0])
+		assert.NoError(t, err)
+
+		rel, _ := filepath.Rel(filepath.Join(repos, "team", "test.git"), objects[0])
+		req, _ := http.NewRequest("GET", server.URL+"/team/test.git/"+filepath.ToSlash(rel), nil)
+		req.Header.Set("Range", "bytes=2-5")
+		resp, err := http.DefaultClient.Do(req)
+		if assert.NoError(t, err) {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+			assert.Equal(t, object[2:6], body)
+		}
+	}
+
+	for _, url := range []string{
+		"/team/test.git/config",
+		"/team/test.git/objects/../config",
+		"/../outside.git/HEAD",
+		"/team/test.git/objects/aa/" + strings.Repeat("0", 38),
+	} {
+		resp, err := http.Get(server.URL + url)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.NotEqual(t, 200, resp.StatusCode, url)
+	}
+
+	// Files are not served unless enabled
+	smartOnly := httptest.NewServer(New(Config{Dir: repos}))
+	defer smartOnly.Close()
+	for _, url := range []string{"/team/test.git/info/refs", "/team/test.git/HEAD"} {
+		resp, err := http.Get(smartOnly.URL + url)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.NotEqual(t, 200, resp.StatusCode, url)
+	}
+}
+
+func TestInfoRefsGzip(t *testing.T) {
+	dir := t.TempDir()
+	out, err := runGit(dir, "init", "-q", "--bare", "test.git")
+	assert.NoError(t, err, out)
+
+	server := httptest.NewServer(New(Config{Dir: dir}))
+	defer server.Close()
+
+	for _, encoding := range []string{"gzip", ""} {
+		req, _ := http.NewRequest("GET", server.URL+"/test.git/info/refs?service=git-upload-pack", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+
+		var body io.Reader = resp.Body
+		if encoding == "gzip" {
+			assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+			body, err = gzip.NewReader(resp.Body)
+			assert.NoError(t, err)
+		} else {
+			assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+		}
+
+		data, err := ioutil.ReadAll(body)
+		resp.Body.Close()
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(data), "001e# service=git-upload-pack\n0000"), string(data))
+		assert.True(t, strings.HasSuffix(string(data), "0000"), string(data))
+	}
+}
+
+func TestGzipLevel(t *testing.T) {
+	dir := t.TempDir()
+	out, err := runGit(dir, "init", "-q", "--bare", "test.git")
+	assert.NoError(t, err, out)
+
+	for _, config := range []Config{
+		{Dir: dir, GzipLevel: gzip.BestSpeed},
+		{Dir: dir, GzipLevel: gzip.HuffmanOnly},
+		{Dir: dir, DisableGzip: true},
+	} {
+		r := httptest.NewRequest("GET", "/test.git/info/refs?service=git-upload-pack", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		New(config).ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		if config.DisableGzip {
+			assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+			assert.True(t, strings.HasPrefix(w.Body.String(), "001e# service=git-upload-pack\n0000"))
+			continue
+		}
+
+		assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+		gz, err := gzip.NewReader(w.Body)
+		if assert.NoError(t, err) {
+			data, err := ioutil.ReadAll(gz)
+			assert.NoError(t, err)
+			assert.True(t, strings.HasPrefix(string(data), "001e# service=git-upload-pack\n0000"))
+		}
+	}
+
+	assert.Panics(t, func() { New(Config{Dir: dir, GzipLevel: 10}) })
+	assert.Panics(t, func() { New(Config{Dir: dir, GzipLevel: -3}) })
+}
+
+// BenchmarkInfoRefsGzip serves the advertisement of a repository with many
+// branches at each compression level
+func BenchmarkInfoRefsGzip(b *testing.B) {
+	dir := b.TempDir()
+	work := filepath.Join(dir, "work")
+	for _, args := range [][]string{
+		{"init", "-q", work},
+		{"-C", work, "commit", "-q", "--allow-empty", "-m", "initial commit"},
+		{"clone", "-q", "--bare", work, filepath.Join(dir, "test.git")},
+	} {
+		if out, err := runGit(dir, args...); err != nil {
+			b.Fatal(err, out)
+		}
+	}
+
+	sha, err := runGit(work, "rev-parse", "HEAD")
+	if err != nil {
+		b.Fatal(err, sha)
+	}
+	packed := &bytes.Buffer{}
+	packed.WriteString("# pack-refs with: peeled fully-peeled sorted \n")
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(packed, "%s refs/heads/branch-%05d\n", strings.TrimSpace(sha), i)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.git", "packed-refs"), packed.Bytes(), 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, level := range []int{gzip.HuffmanOnly, gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression} {
+		server := New(Config{Dir: dir, GzipLevel: level})
+		b.Run(fmt.Sprintf("level=%d", level), func(b *testing.B) {
+			size := 0
+			for i := 0; i < b.N; i++ {
+				r := httptest.NewRequest("GET", "/test.git/info/refs?service=git-upload-pack", nil)
+				r.Header.Set("Accept-Encoding", "gzip")
+				w := httptest.NewRecorder()
+				server.ServeHTTP(w, r)
+				if w.Code != http.StatusOK {
+					b.Fatalf("unexpected status %d", w.Code)
+				}
+				size = w.Body.Len()
+			}
+			b.ReportMetric(float64(size), "compressed-bytes")
+		})
+	}
+}
+
+func TestInfoRefsFlush(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	makeRepo(t, repos, "test.git")
+	release := filepath.Join(dir, "release")
+
+	// Refs only come once the client got the service announcement
+	gitPath := writeGitStub(t, dir, fmt.Sprintf("while [ ! -f %s ]; do sleep 0.05; done\nprintf 0000\n", release))
+	server := httptest.NewServer(New(Config{Dir: repos, GitPath: gitPath}))
+	defer server.Close()
+	defer ioutil.WriteFile(release, nil, 0644)
+
+	for _, encoding := range []string{"", "gzip"} {
+		os.Remove(release)
+
+		header := make(chan string, 1)
+		go func() {
+			req, _ := http.NewRequest("GET", server.URL+"/test.git/info/refs?service=git-upload-pack", nil)
+			req.Header.Set("Accept-Encoding", encoding)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				header <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+
+			var body io.Reader = resp.Body
+			if encoding == "gzip" {
+				if body, err = gzip.NewReader(resp.Body); err != nil {
+					header <- err.Error()
+					return
+				}
+			}
+
+			data := make([]byte, 34)
+			_, err = io.ReadFull(body, data)
+			header <- string(data)
+
+			ioutil.ReadAll(body)
+		}()
+
+		select {
+		case data := <-header:
+			assert.Equal(t, "001e# service=git-upload-pack\n0000", data, encoding)
+		case <-time.After(5 * time.Second):
+			t.Errorf("no service announcement before the refs with encoding %q", encoding)
+		}
+		assert.NoError(t, ioutil.WriteFile(release, nil, 0644))
+	}
+}
+
+type testLogger struct {
+	sync.Mutex
+	infos  []string
+	errors []string
+}
+
+func (l *testLogger) Infof(format string, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.infos = append(l.infos, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Errorf(format string, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+}
+
+func TestLogger(t *testing.T) {
+	logger := &testLogger{}
+	server := New(Config{Dir: t.TempDir()})
+	server.Logger = logger
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/missing.git/info/refs?service=git-upload-pack")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 404, resp.StatusCode)
+
+	logger.Lock()
+	defer logger.Unlock()
+	assert.Equal(t, 1, len(logger.infos))
+	assert.True(t, strings.HasPrefix(logger.infos[0], "request: GET "), logger.infos[0])
+	assert.Equal(t, 1, len(logger.errors))
+	assert.True(t, strings.HasPrefix(logger.errors[0], "repo-init: "), logger.errors[0])
+}
+
+type metric struct {
+	op   string
+	repo string
+	err  error
+}
+
+func TestMetricsFunc(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true})
+
+	var lock sync.Mutex
+	metrics := []metric{}
+	server.MetricsFunc = func(op string, repo string, duration time.Duration, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		metrics = append(metrics, metric{op, repo, err})
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+	out, err := runGit(dir, "clone", "-q", ts.URL+"/test.git", "clone")
+	assert.NoError(t, err, out)
+
+	for _, req := range []struct{ method, path, body string }{
+		{"GET", "/repos", ""},
+		{"POST", "/new.git/repo", ""},
+		{"POST", "/repo/rename", `{"from": "new.git", "to": "renamed.git"}`},
+		{"DELETE", "/renamed.git/repo", ""},
+	} {
+		r, _ := http.NewRequest(req.method, ts.URL+req.path, strings.NewReader(req.body))
+		resp, err := http.DefaultClient.Do(r)
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	lock.Lock()
+	ops := map[string]bool{}
+	for _, m := range metrics {
+		ops[m.op] = true
+		assert.NoError(t, m.err, m.op)
+		if m.op == "info-refs" || m.op == "upload-pack" || m.op == "receive-pack" {
+			assert.Equal(t, "test.git", m.repo)
+		}
+	}
+	lock.Unlock()
+	assert.Equal(t, map[string]bool{
+		"info-refs":    true,
+		"upload-pack":  true,
+		"receive-pack": true,
+		"list":         true,
+		"create":       true,
+		"rename":       true,
+		"delete":       true,
+	}, ops)
+
+	// Git exiting with a non-zero status is reported
+	failing := New(Config{Dir: filepath.Join(dir, "repos"), GitPath: writeGitStub(t, dir, "exit 1\n")})
+	failing.MetricsFunc = server.MetricsFunc
+	metrics = metrics[:0]
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/test.git/info/refs?service=git-upload-pack", nil)
+	failing.ServeHTTP(w, r)
+
+	assert.Equal(t, 1, len(metrics))
+	assert.Equal(t, "info-refs", metrics[0].op)
+	assert.Error(t, metrics[0].err)
+}
+
+func TestShutdown(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	pidFile := filepath.Join(dir, "pid")
+	makeRepo(t, repos, "test.git")
+
+	startRequest := func(ts *httptest.Server) <-chan int {
+		status := make(chan int, 1)
+		go func() {
+			resp, err := http.Get(ts.URL + "/test.git/info/refs?service=git-upload-pack")
+			if err != nil {
+				status <- 0
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			status <- resp.StatusCode
+		}()
+		assert.True(t, waitFor(5*time.Second, func() bool {
+			_, err := os.Stat(pidFile)
+			return err == nil
+		}), "git process has not been started")
+		return status
+	}
+
+	// Requests in flight are waited for
+	doneFile := filepath.Join(dir, "done")
+	gitPath := writeGitStub(t, dir, fmt.Sprintf("echo $$ > %s\nsleep 0.5\ntouch %s\n", pidFile, doneFile))
+	server := New(Config{Dir: repos, GitPath: gitPath})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	status := startRequest(ts)
+	assert.NoError(t, server.Shutdown(context.Background()))
+	_, err := os.Stat(doneFile)
+	assert.NoError(t, err, "Shutdown returned before git was done")
+	assert.Equal(t, http.StatusOK, <-status)
+
+	resp, err := http.Get(ts.URL + "/test.git/info/refs?service=git-upload-pack")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	// Git processes still running once the context expires are killed
+	os.Remove(pidFile)
+	gitPath = writeGitStub(t, dir, fmt.Sprintf("echo $$ > %s\nexec sleep 30\n", pidFile))
+	server = New(Config{Dir: repos, GitPath: gitPath})
+	ts2 := httptest.NewServer(server)
+	defer ts2.Close()
+
+	startRequest(ts2)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, server.Shutdown(ctx))
+
+	data, _ := ioutil.ReadFile(pidFile)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	assert.NotEqual(t, 0, pid)
+	assert.True(t, waitFor(5*time.Second, func() bool {
+		return syscall.Kill(pid, 0) != nil
+	}), "git process is still running after shutdown")
+
+	// No git process is started after that, it would outlive the shutdown
+	os.Remove(pidFile)
+	_, err = server.gitOutput(context.Background(), "version")
+	assert.Equal(t, errShuttingDown, err)
+	assert.NoFileExists(t, pidFile)
+}
+
+func TestRequestOperation(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	makeRepo(t, repos, "test.git")
+
+	server := New(Config{Dir: repos, Auth: true, GitPath: writeGitStub(t, dir, "exit 0\n")})
+
+	var operation string
+	server.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		operation = req.Operation
+		return false, nil
+	}
+
+	tests := []struct {
+		method    string
+		path      string
+		operation string
+	}{
+		{"GET", "/test.git/info/refs?service=git-upload-pack", OperationDownload},
+		{"GET", "/test.git/info/refs?service=git-receive-pack", OperationUpload},
+		{"POST", "/test.git/git-upload-pack", OperationDownload},
+		{"POST", "/test.git/git-receive-pack", OperationUpload},
+		{"GET", "/repos", OperationList},
+		{"POST", "/test.git/repo", OperationCreate},
+		{"POST", "/repo/rename", OperationRename},
+		{"POST", "/repo/fork", OperationFork},
+		{"DELETE", "/test.git/repo", OperationDelete},
+		{"POST", "/test.git/repo/gc", OperationGC},
+		{"POST", "/test.git/repo/sync", OperationSync},
+		{"POST", "/test.git/repo/hooks", OperationHooks},
+		{"POST", "/test.git/repo/head", OperationSetHead},
+		{"PUT", "/test.git/repo/config", OperationSetConfig},
+	}
+
+	for _, test := range tests {
+		operation = ""
+		r := httptest.NewRequest(test.method, test.path, nil)
+		r.SetBasicAuth("user", "secret")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code, test.path)
+		assert.Equal(t, test.operation, operation, test.method+" "+test.path)
+	}
+}
+
+func TestAuthForbidden(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "test.git")
+	makeRepo(t, dir, "private.git")
+
+	server := New(Config{Dir: dir, Auth: true})
+	server.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		if cred.Password != "secret" {
+			return false, nil
+		}
+		if req.RepoName == "private.git" {
+			return false, ErrForbidden
+		}
+		return true, nil
+	}
+
+	tests := []struct {
+		repo     string
+		password string
+		code     int
+	}{
+		{"test.git", "secret", http.StatusOK},
+		{"test.git", "wrong", http.StatusUnauthorized},
+		{"private.git", "wrong", http.StatusUnauthorized},
+		{"private.git", "secret", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/"+test.repo+"/repo/description", nil)
+		r.SetBasicAuth("alice", test.password)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		assert.Equal(t, test.code, w.Code, test.repo+" "+test.password)
+	}
+
+	// Without credentials git is still asked for some
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/private.git/repo/description", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.NotEmpty(t, w.Header()["WWW-Authenticate"])
+}
+
+func TestAuthFuncs(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "test.git")
+	makeRepo(t, dir, "private.git")
+
+	var asked []string
+	server := New(Config{Dir: dir, Auth: true})
+	server.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		t.Error("AuthFunc must not be asked when AuthFuncs are set")
+		return true, nil
+	}
+	server.AuthFuncs = []func(Credential, *Request) (bool, error){
+		// Static tokens
+		func(cred Credential, req *Request) (bool, error) {
+			asked = append(asked, "tokens")
+			return cred.Password == "token", nil
+		},
+		// Directory users, who cannot see private.git
+		func(cred Credential, req *Request) (bool, error) {
+			asked = append(asked, "directory")
+			switch {
+			case cred.Password == "down":
+				return false, fmt.Errorf("directory unavailable")
+			case cred.Password != "secret":
+				return false, nil
+			case req.RepoName == "private.git":
+				return false, ErrForbidden
+			}
+			return true, nil
+		},
+	}
+
+	tests := []struct {
+		repo     string
+		password string
+		code     int
+		asked    []string
+	}{
+		{"test.git", "token", http.StatusOK, []string{"tokens"}},
+		{"test.git", "secret", http.StatusOK, []string{"tokens", "directory"}},
+		{"test.git", "wrong", http.StatusUnauthorized, []string{"tokens", "directory"}},
+		{"test.git", "down", http.StatusUnauthorized, []string{"tokens", "directory"}},
+		{"private.git", "secret", http.StatusForbidden, []string{"tokens", "directory"}},
+		{"private.git", "token", http.StatusOK, []string{"tokens"}},
+	}
+
+	for _, test := range tests {
+		asked = nil
+		r := httptest.NewRequest("GET", "/"+test.repo+"/repo/description", nil)
+		r.SetBasicAuth("alice", test.password)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		assert.Equal(t, test.code, w.Code, test.repo+" "+test.password)
+		assert.Equal(t, test.asked, asked, test.repo+" "+test.password)
+	}
+
+	errs := authErrors{fmt.Errorf("ldap down"), fmt.Errorf("db down")}
+	assert.Equal(t, "ldap down; db down", errs.Error())
+}
+
+func TestAuthTimeout(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "test.git")
+
+	release := make(chan struct{})
+	defer close(release)
+	server := New(Config{Dir: dir, Auth: true, AuthTimeout: 50 * time.Millisecond})
+	server.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		if cred.Username == "slow" {
+			<-release
+		}
+		return true, nil
+	}
+
+	request := func(user string) int {
+		r := httptest.NewRequest("GET", "/test.git/repo/description", nil)
+		r.SetBasicAuth(user, "secret")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	start := time.Now()
+	assert.Equal(t, http.StatusServiceUnavailable, request("slow"))
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, http.StatusOK, request("alice"))
+}
+
+func TestExtraHeaders(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "test.git")
+
+	server := New(Config{Dir: dir, ExtraHeaders: map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "DENY",
+	}})
+
+	tests := []struct {
+		method string
+		url    string
+		code   int
+	}{
+		{"GET", "/test.git/info/refs?service=git-upload-pack", http.StatusOK},
+		{"POST", "/test.git/git-upload-pack", http.StatusOK},
+		{"GET", "/repos", http.StatusOK},
+		{"GET", "/test.git/repo/description", http.StatusOK},
+		{"GET", "/missing.git/repo/description", http.StatusNotFound},
+		{"GET", "/healthz", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(test.method, test.url, strings.NewReader("0000")))
+
+		assert.Equal(t, test.code, w.Code, test.url)
+		assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"), test.url)
+		assert.Equal(t, "DENY", w.Header().Get("X-Frame-Options"), test.url)
+	}
+}
+
+func TestUnknownRoute(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "test.git")
+	server := New(Config{Dir: dir, Auth: true, DisabledServices: []string{"DELETE /repo"}})
+	server.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		return false, nil
+	}
+
+	tests := []struct {
+		method string
+		url    string
+		code   int
+	}{
+		// No such endpoint
+		{"GET", "/some/random/path", http.StatusNotFound},
+		{"GET", "/test.git/repo/unknown", http.StatusNotFound},
+		// Malformed git requests and disabled services
+		{"GET", "/test.git/git-upload-pack", http.StatusForbidden},
+		{"POST", "/test.git/info/refs", http.StatusForbidden},
+		{"DELETE", "/test.git/repo", http.StatusForbidden},
+		// Known endpoints still ask for credentials
+		{"GET", "/test.git/repo/branches", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(test.method, test.url, nil))
+		assert.Equal(t, test.code, w.Code, test.method+" "+test.url)
+	}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/some/random/path", nil))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var body struct {
+		Code int
+		Data KitErrorResponse
+	}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	assert.Equal(t, http.StatusNotFound, body.Code)
+	assert.Equal(t, "Not Found", body.Data.Message)
+}
+
+func TestAuthRealm(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "test.git")
+
+	tests := []struct {
+		realm  string
+		header string
+	}{
+		{"", `Basic realm="Git"`},
+		{"example.com", `Basic realm="example.com"`},
+		{`say "hi"`, `Basic realm="say \"hi\""`},
+	}
+
+	for _, test := range tests {
+		server := New(Config{Dir: dir, Auth: true, AuthRealm: test.realm})
+		server.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+			return true, nil
+		}
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/test.git/info/refs?service=git-upload-pack", nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, []string{test.header}, w.Header()["WWW-Authenticate"])
+	}
+}
+
+func TestAuthRequestFields(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "team/project.git")
+
+	var seen Request
+	server := New(Config{Dir: dir, Auth: true})
+	server.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		seen = *req
+		return false, nil
+	}
+
+	tests := []struct {
+		method    string
+		url       string
+		repoName  string
+		namespace string
+		operation string
+	}{
+		{"GET", "/team/project.git/info/refs?service=git-upload-pack", "team/project.git", "team", OperationDownload},
+		{"POST", "/team/project.git/git-receive-pack", "team/project.git", "team", OperationUpload},
+		// Auth runs before the repository is checked to exist
+		{"GET", "/team/missing.git/info/refs?service=git-receive-pack", "team/missing.git", "team", OperationUpload},
+		{"GET", "/top.git/info/refs?service=git-upload-pack", "top.git", "", OperationDownload},
+		{"GET", "/repos", "", "", OperationList},
+	}
+
+	for _, test := range tests {
+		seen = Request{}
+		r := httptest.NewRequest(test.method, test.url, nil)
+		r.SetBasicAuth("alice", "secret")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code, test.url)
+		assert.Equal(t, test.repoName, seen.RepoName, test.url)
+		assert.Equal(t, test.namespace, seen.Namespace, test.url)
+		assert.Equal(t, test.operation, seen.Operation, test.url)
+	}
+}
+
+func TestRepoNamePattern(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: dir})
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/test.git/repo", http.StatusCreated},
+		{"/team/my_repo-2.git/repo", http.StatusCreated},
+		{"/no-suffix/repo", http.StatusCreated},
+		{"/my%20repo.git/repo", http.StatusBadRequest},
+		{"/test;rm.git/repo", http.StatusBadRequest},
+		{"/$(id).git/repo", http.StatusBadRequest},
+		{"/test%0A.git/repo", http.StatusBadRequest},
+		{"/.hidden.git/repo", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("POST", test.path, nil))
+		assert.Equal(t, test.code, w.Code, test.path)
+	}
+
+	// Custom patterns replace the default one
+	server = New(Config{Dir: dir, RepoNamePattern: `^[a-z]+\.git$`})
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/lower.git/repo", nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/team/lower.git/repo", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	assert.Panics(t, func() { New(Config{Dir: dir, RepoNamePattern: "("}) })
+}
+
+func TestRepoPathFunc(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+
+	shard := func(namespace, name string) string {
+		sum := fmt.Sprintf("%x", sha1.Sum([]byte(path.Join(namespace, name))))
+		return filepath.Join(repos, sum[:2], sum[2:4], sum+".git")
+	}
+	server := New(Config{Dir: repos, AutoCreate: true, RepoPathFunc: shard})
+
+	received := make(chan *Request, 1)
+	server.PostReceiveFunc = func(req *Request) error {
+		received <- req
+		return nil
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/team/test.git")
+	req := <-received
+	assert.Equal(t, "team/test.git", req.RepoName)
+	assert.Equal(t, shard("team", "test.git"), req.RepoPath)
+	assert.True(t, repoExists(shard("team", "test.git")))
+	assert.False(t, repoExists(filepath.Join(repos, "team", "test.git")))
+
+	out, err := runGit(dir, "clone", "-q", ts.URL+"/team/test.git", "clone")
+	assert.NoError(t, err, out)
+	assert.True(t, server.RepoExists("team/test.git"))
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/other.git/repo", nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.True(t, repoExists(shard("", "other.git")))
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("DELETE", "/other.git/repo", nil))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.False(t, repoExists(shard("", "other.git")))
+
+	// Listings leave out the directories requests do not map to
+	makeRepo(t, repos, "plain.git")
+	code, list := getRepoList(t, ts.URL+"/repos")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, list.RepoPath)
+
+	mirror := func(namespace, name string) string {
+		return filepath.Join(repos, namespace, name)
+	}
+	other := httptest.NewServer(New(Config{Dir: repos, RepoPathFunc: mirror}))
+	defer other.Close()
+	code, list = getRepoList(t, other.URL+"/repos")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, list.RepoPath, "plain.git")
+}
+
+func TestPostRPCLargeBody(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	makeRepo(t, repos, "test.git")
+
+	// Git echoing its input fills the stdout pipe long before all of the
+	// request body is written to it
+	gitPath := writeGitStub(t, dir, "exec cat\n")
+	server := httptest.NewServer(New(Config{Dir: repos, GitPath: gitPath, RequestTimeout: time.Minute}))
+	defer server.Close()
+
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	// Concatenated gzip members decompress to the concatenation of their
+	// contents, so the block only needs compressing once
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(data)
+	gz.Close()
+
+	// Hundreds of MiB are streamed rather than held in memory
+	const blocks = 256
+	want := sha1.New()
+	io.Copy(want, &repeatReader{data: data, n: blocks})
+
+	for encoding, block := range map[string][]byte{"": data, "gzip": compressed.Bytes()} {
+		body := &repeatReader{data: block, n: blocks}
+		req, _ := http.NewRequest("POST", server.URL+"/test.git/git-upload-pack", body)
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, encoding) {
+			continue
+		}
+		received := sha1.New()
+		n, err := io.Copy(received, resp.Body)
+		resp.Body.Close()
+		assert.NoError(t, err, encoding)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, encoding)
+		assert.Equal(t, int64(blocks*len(data)), n, encoding)
+		assert.Equal(t, want.Sum(nil), received.Sum(nil), encoding)
+	}
+}
+
+// repeatReader reads data n times
+type repeatReader struct {
+	data []byte
+	n    int
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[r.off:])
+	r.off += n
+	if r.off == len(r.data) {
+		r.off = 0
+		r.n--
+	}
+	return n, nil
+}
+
+func TestAuthMethodMTLS(t *testing.T) {
+	repos := t.TempDir()
+	makeRepo(t, repos, "test.git")
+
+	server := New(Config{Dir: repos, Auth: true, AuthMethod: AuthMethodMTLS})
+	server.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		return cred.ClientCN == "ci-runner", nil
+	}
+
+	tests := []struct {
+		cn   string
+		code int
+	}{
+		{"", http.StatusUnauthorized},
+		{"someone", http.StatusUnauthorized},
+		{"ci-runner", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/repos", nil)
+		r.SetBasicAuth("ci-runner", "secret")
+		if test.cn != "" {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+				{Subject: pkix.Name{CommonName: test.cn}},
+			}}
+		}
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		assert.Equal(t, test.code, w.Code, test.cn)
+	}
+}
+
+func TestCreateRepoDefaultBranch(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: dir, AutoCreate: true, DefaultBranch: "trunk"})
+
+	head := func(name string) string {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, name, "HEAD"))
+		return strings.TrimSpace(string(data))
+	}
+
+	tests := []struct {
+		name string
+		body string
+		code int
+		head string
+	}{
+		{"requested.git", `{"defaultBranch": "main"}`, http.StatusCreated, "ref: refs/heads/main"},
+		{"nested.git", `{"defaultBranch": "release/v1"}`, http.StatusCreated, "ref: refs/heads/release/v1"},
+		{"fallback.git", "", http.StatusCreated, "ref: refs/heads/trunk"},
+		{"empty.git", `{}`, http.StatusCreated, "ref: refs/heads/trunk"},
+		{"invalid.git", `{"defaultBranch": "bad..name"}`, http.StatusBadRequest, ""},
+		{"malformed.git", `{"defaultBranch": `, http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("POST", "/"+test.name+"/repo", strings.NewReader(test.body)))
+		assert.Equal(t, test.code, w.Code, test.name)
+		assert.Equal(t, test.head, head(test.name), test.name)
+	}
+
+	// Repositories created on the fly use the configured branch
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/auto.git/info/refs?service=git-receive-pack", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ref: refs/heads/trunk", head("auto.git"))
+}
+
+func TestCreateRepoDryRun(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "taken.git")
+	server := New(Config{Dir: dir})
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"new.git", "", http.StatusCreated},
+		{"taken.git", "", http.StatusConflict},
+		{"bad.name.git", "", http.StatusBadRequest},
+		{"branch.git", `{"defaultBranch": "bad..name"}`, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("POST", "/"+test.name+"/repo?dryRun=true", strings.NewReader(test.body)))
+		assert.Equal(t, test.code, w.Code, test.name)
+
+		if test.code != http.StatusBadRequest {
+			var res struct{ Data KitRepoResponse }
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+			assert.Equal(t, KitRepoResponse{RepoPath: test.name}, res.Data, test.name)
+		}
+	}
+	for _, name := range []string{"new.git", "bad.name.git", "branch.git"} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+
+	// Without it the repository is created
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/new.git/repo", nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.True(t, repoExists(filepath.Join(dir, "new.git")))
+}
+
+func TestCreateRepoConfig(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: dir, AllowedRepoConfigKeys: []string{"core.compression", "core.bigFileThreshold"}})
+
+	tests := []struct {
+		name   string
+		config string
+		code   int
+	}{
+		{"allowed.git", `{"core.compression": "-1", "core.bigfilethreshold": "10m"}`, http.StatusCreated},
+		{"fsmonitor.git", `{"core.fsmonitor": "touch /tmp/owned"}`, http.StatusBadRequest},
+		{"hooks.git", `{"core.compression": "9", "core.hooksPath": "/tmp"}`, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("POST", "/"+test.name+"/repo", strings.NewReader(`{"config": `+test.config+`}`)))
+		assert.Equal(t, test.code, w.Code, test.name)
+	}
+
+	for key, value := range map[string]string{"core.compression": "-1", "core.bigFileThreshold": "10m"} {
+		out, err := runGit(dir, "--git-dir", filepath.Join(dir, "allowed.git"), "config", key)
+		assert.NoError(t, err, out)
+		assert.Equal(t, value+"\n", out, key)
+	}
+	for _, name := range []string{"fsmonitor.git", "hooks.git"} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+
+	// Nothing is allowed by default
+	w := httptest.NewRecorder()
+	New(Config{Dir: dir}).ServeHTTP(w, httptest.NewRequest("POST", "/default.git/repo", strings.NewReader(`{"config": {"core.compression": "1"}}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestSharedRepo(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		shared string
+		config string
+		mode   os.FileMode
+	}{
+		{"group", "1", os.ModeSetgid | 0070},
+		{"0660", "0660", os.ModeSetgid | 0060},
+		{"all", "2", os.ModeSetgid | 0075},
+	}
+
+	for _, test := range tests {
+		server := New(Config{Dir: filepath.Join(dir, test.shared), SharedRepo: test.shared})
+		assert.NoError(t, server.CreateRepo("test.git"))
+
+		repoPath := filepath.Join(dir, test.shared, "test.git")
+		out, err := runGit(dir, "--git-dir", repoPath, "config", "core.sharedRepository")
+		assert.NoError(t, err, out)
+		assert.Equal(t, test.config, strings.TrimSpace(out), test.shared)
+
+		info, err := os.Stat(filepath.Join(repoPath, "refs"))
+		if assert.NoError(t, err) {
+			assert.Equal(t, test.mode, info.Mode()&test.mode, test.shared)
+		}
+	}
+
+	assert.Panics(t, func() { New(Config{Dir: dir, SharedRepo: "friends"}) })
+	assert.Panics(t, func() { New(Config{Dir: dir, SharedRepo: "0999"}) })
+}
+
+func TestRepoDescription(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "bare.git")
+	server := New(Config{Dir: dir})
+
+	description := func(name string) (int, string) {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/"+name+"/repo/description", nil))
+
+		body := struct {
+			Data KitDescriptionResponse `json:"data"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body.Data.Description
+	}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/described.git/repo", strings.NewReader(`{"description": "Release tooling"}`)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	code, text := description("described.git")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "Release tooling", text)
+
+	// Repositories without a description file have an empty one
+	code, text = description("bare.git")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "", text)
+
+	code, _ = description("missing.git")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestGitPathNotFound(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	makeRepo(t, repos, "test.git")
+
+	for _, gitPath := range []string{filepath.Join(dir, "missing-git"), "missing-git-binary"} {
+		server := New(Config{Dir: repos, GitPath: gitPath})
+		err := server.Setup()
+		if assert.Error(t, err, gitPath) {
+			assert.Contains(t, err.Error(), gitPath)
+		}
+
+		logger := &testLogger{}
+		server.Logger = logger
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/test.git/info/refs?service=git-upload-pack", nil))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+		assert.Equal(t, 1, len(logger.errors))
+		assert.Contains(t, logger.errors[0], "not found, check Config.GitPath", gitPath)
+	}
+
+	// Files that cannot be executed are rejected up front as well
+	notExecutable := filepath.Join(dir, "git")
+	assert.NoError(t, ioutil.WriteFile(notExecutable, []byte("#!/bin/sh\n"), 0644))
+	assert.Error(t, New(Config{Dir: repos, GitPath: notExecutable}).Setup())
+
+	assert.NoError(t, New(Config{Dir: repos}).Setup())
+}
+
+func TestRunAsUID(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("switching users needs root")
+	}
+
+	// The unprivileged user has to reach the stub and the repositories
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	assert.NoError(t, os.Chmod(filepath.Dir(dir), 0755))
+	assert.NoError(t, os.Chmod(dir, 0755))
+	assert.NoError(t, os.Mkdir(repos, 0755))
+	assert.NoError(t, os.Chmod(repos, 0777))
+
+	stub := writeGitStub(t, dir, `if [ "$1" = ids ]; then id -u; id -g; exit 0; fi
+if [ "$1" = groups ]; then grep '^Groups:' /proc/self/status; exit 0; fi
+exec git "$@"
+`)
+	server := New(Config{Dir: repos, GitPath: stub, RunAsUID: 65534, RunAsGID: 65534})
+
+	out, err := server.gitOutput(context.Background(), "ids")
+	assert.NoError(t, err)
+	assert.Equal(t, "65534\n65534\n", out)
+
+	// The supplementary groups of the server are dropped too
+	groups, err := syscall.Getgroups()
+	assert.NoError(t, err)
+	assert.NoError(t, syscall.Setgroups([]int{1}))
+	defer syscall.Setgroups(groups)
+	out, err = server.gitOutput(context.Background(), "groups")
+	assert.NoError(t, err)
+	assert.Equal(t, "Groups:", strings.TrimSpace(out))
+
+	assert.NoError(t, server.CreateRepo("test.git"))
+	info, err := os.Stat(filepath.Join(repos, "test.git", "HEAD"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint32(65534), info.Sys().(*syscall.Stat_t).Uid)
+	}
+
+	// Without ids git runs as the server
+	out, err = New(Config{Dir: repos, GitPath: stub}).gitOutput(context.Background(), "ids")
+	assert.NoError(t, err)
+	assert.Equal(t, "0\n0\n", out)
+}
+
+func TestGitEnvFunc(t *testing.T) {
+	dir := t.TempDir()
+	pusherFile := filepath.Join(dir, "pusher")
+
+	server := New(Config{
+		Dir:        filepath.Join(dir, "repos"),
+		AutoCreate: true,
+		AutoHooks:  true,
+		Auth:       true,
+		Hooks: &HookScripts{
+			PreReceive: fmt.Sprintf("#!/bin/sh\necho $PUSHER > %s\n", pusherFile),
+		},
+	})
+	server.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		return true, nil
+	}
+	server.GitEnvFunc = func(req *Request) []string {
+		user, _, _ := req.BasicAuth()
+		return []string{"PUSHER=" + user}
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	url := strings.Replace(ts.URL, "http://", "http://alice:secret@", 1)
+	pushSampleCommit(t, dir, url+"/test.git")
+
+	data, err := ioutil.ReadFile(pusherFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice\n", string(data))
+}
+
+func TestRepoSize(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/empty.git/repo", nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	size := func(name string) (int, KitRepoSizeResponse) {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/"+name+"/repo/size", nil))
+
+		body := struct {
+			Data KitRepoSizeResponse `json:"data"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body.Data
+	}
+
+	code, data := size("test.git")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "test.git", data.RepoPath)
+	assert.True(t, data.Size > 0)
+	assert.Equal(t, int64(0), data.Garbage)
+
+	code, data = size("empty.git")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, int64(0), data.Size)
+
+	code, _ = size("missing.git")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestGCRepo(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	server := New(Config{Dir: repos, AutoCreate: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/test.git/repo/gc", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	packs, _ := filepath.Glob(filepath.Join(repos, "test.git", "objects", "pack", "*.pack"))
+	assert.Equal(t, 1, len(packs))
+
+	w = httptest.NewRecorder()
+	New(Config{Dir: repos, ReadOnly: true}).ServeHTTP(w, httptest.NewRequest("POST", "/test.git/repo/gc", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Only one gc runs for a repository at a time
+	pidFile := filepath.Join(dir, "pid")
+	gitPath := writeGitStub(t, dir, fmt.Sprintf("echo $$ > %s\nsleep 0.5\n", pidFile))
+	server = New(Config{Dir: repos, GitPath: gitPath})
+
+	done := make(chan int, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("POST", "/test.git/repo/gc", nil))
+		done <- w.Code
+	}()
+	assert.True(t, waitFor(5*time.Second, func() bool {
+		_, err := os.Stat(pidFile)
+		return err == nil
+	}))
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/test.git/repo/gc", nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, http.StatusOK, <-done)
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/test.git/repo/gc", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRepoLocking(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	state := filepath.Join(dir, "state")
+	assert.NoError(t, os.MkdirAll(state, 0755))
+	makeRepo(t, repos, "a.git")
+	makeRepo(t, repos, "b.git")
+
+	post := func(server *Server, name string) {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("POST", "/"+name+"/git-receive-pack", strings.NewReader("0000")))
+	}
+	pushAll := func(server *Server, names ...string) {
+		var wg sync.WaitGroup
+		for _, name := range names {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				post(server, name)
+			}(name)
+		}
+		wg.Wait()
+	}
+
+	// Pushes to the same repository never overlap
+	gitPath := writeGitStub(t, dir, fmt.Sprintf(`cat > /dev/null
+running=%s/running-$(basename $3)
+mkdir $running || echo overlap >> %s/errors
+sleep 0.1
+rmdir $running
+printf 0000
+`, state, state))
+	pushAll(New(Config{Dir: repos, GitPath: gitPath}), "a.git", "a.git", "a.git", "a.git")
+	_, err := os.Stat(filepath.Join(state, "errors"))
+	assert.True(t, os.IsNotExist(err), "pushes to the same repository overlapped")
+
+	// Pushes to different repositories run concurrently
+	gitPath = writeGitStub(t, dir, fmt.Sprintf(`cat > /dev/null
+touch %s/started-$(basename $3)
+i=0
+while [ $(ls %s | grep -c started-) -lt 2 ] && [ $i -lt 100 ]; do sleep 0.05; i=$((i+1)); done
+[ $(ls %s | grep -c started-) -ge 2 ] || echo serialized >> %s/errors
+printf 0000
+`, state, state, state, state))
+	server := New(Config{Dir: repos, GitPath: gitPath})
+	pushAll(server, "a.git", "b.git")
+	_, err = os.Stat(filepath.Join(state, "errors"))
+	assert.True(t, os.IsNotExist(err), "pushes to different repositories were serialized")
+
+	// Locks are dropped once released, missing repositories included
+	_, err = server.RepoConfig("missing.git")
+	assert.Equal(t, ErrRepoNotFound, err)
+	server.repoLocksLock.Lock()
+	assert.Empty(t, server.repoLocks)
+	server.repoLocksLock.Unlock()
+}
+
+func TestConcurrentPushesAndGC(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	server := New(Config{Dir: repos, AutoCreate: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+	work := filepath.Join(dir, "work")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			out, err := runGit(work, "push", "-q", ts.URL+"/test.git", fmt.Sprintf("HEAD:refs/heads/branch-%d", i))
+			assert.NoError(t, err, out)
+		}(i)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", ts.URL+"/test.git/repo/gc", nil)
+			resp, err := http.DefaultClient.Do(req)
+			if assert.NoError(t, err) {
+				resp.Body.Close()
+				assert.Contains(t, []int{http.StatusOK, http.StatusConflict}, resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	out, err := runGit(dir, "--git-dir", filepath.Join(repos, "test.git"), "fsck", "--strict")
+	assert.NoError(t, err, out)
+	out, err = runGit(dir, "--git-dir", filepath.Join(repos, "test.git"), "for-each-ref", "--format=%(refname)", "refs/heads/branch-*")
+	assert.NoError(t, err, out)
+	assert.Equal(t, 8, len(strings.Fields(out)))
+}
+
+func TestAutoCreateOnPushOnly(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	server := httptest.NewServer(New(Config{Dir: repos, AutoCreate: true}))
+	defer server.Close()
+
+	// Clones of missing repositories fail instead of creating empty ones
+	out, err := runGit(dir, "clone", server.URL+"/missing.git", "clone")
+	assert.Error(t, err)
+	assert.Contains(t, out, "not found")
+	assert.False(t, repoExists(filepath.Join(repos, "missing.git")))
+
+	for _, path := range []string{
+		"/missing.git/git-upload-pack",
+		"/missing.git/repo/branches",
+	} {
+		method := "POST"
+		if strings.HasSuffix(path, "branches") {
+			method = "GET"
+		}
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+	}
+	assert.False(t, repoExists(filepath.Join(repos, "missing.git")))
+
+	// Pushes create them
+	pushSampleCommit(t, dir, server.URL+"/pushed.git")
+	assert.True(t, repoExists(filepath.Join(repos, "pushed.git")))
+}
+
+func TestCreateRepoFailureKeepsDir(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	gitPath := writeGitStub(t, dir, `if [ "$1" = init ]; then git "$@"; exit 1; fi
+exec git "$@"
+`)
+	server := New(Config{Dir: repos, GitPath: gitPath, AutoCreate: true})
+
+	// Directories that are no repository are left alone when git fails
+	for _, name := range []string{"data.git", "pushed.git"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(repos, name), 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(repos, name, "important"), []byte("keep"), 0644))
+	}
+
+	assert.Error(t, server.CreateRepo("data.git"))
+	assert.FileExists(t, filepath.Join(repos, "data.git", "important"))
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/pushed.git/info/refs?service=git-receive-pack", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.FileExists(t, filepath.Join(repos, "pushed.git", "important"))
+
+	// The ones created for the repository are removed
+	assert.Error(t, server.CreateRepo("new.git"))
+	_, err := os.Stat(filepath.Join(repos, "new.git"))
+	assert.True(t, os.IsNotExist(err), err)
+}
+
+func TestConcurrentAutoCreate(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	inits := filepath.Join(dir, "inits")
+
+	// Record the inits and leave room for other requests to interleave
+	gitPath := writeGitStub(t, dir, fmt.Sprintf(`if [ "$1" = init ]; then echo init >> %s; sleep 0.2; fi
+exec git "$@"
+`, inits))
+	server := httptest.NewServer(New(Config{Dir: repos, GitPath: gitPath, AutoCreate: true}))
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 8)
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(server.URL + "/raced.git/info/refs?service=git-receive-pack")
+			if !assert.NoError(t, err) {
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			codes <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		assert.Equal(t, http.StatusOK, code)
+	}
+	data, err := ioutil.ReadFile(inits)
+	assert.NoError(t, err)
+	assert.Equal(t, "init\n", string(data))
+	assert.True(t, repoExists(filepath.Join(repos, "raced.git")))
+}
+
+func TestMaxPushSize(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	server := httptest.NewServer(New(Config{Dir: repos, AutoCreate: true, MaxPushSize: 256 << 10}))
+	defer server.Close()
+
+	pushSampleCommit(t, dir, server.URL+"/test.git")
+
+	// Random data does not compress, the pack is as large as the file
+	work := filepath.Join(dir, "work")
+	data := make([]byte, 2<<20)
+	rand.Read(data)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(work, "large"), data, 0644))
+	for _, args := range [][]string{
+		{"add", "large"},
+		{"commit", "-q", "-m", "large file"},
+	} {
+		out, err := runGit(work, args...)
+		assert.NoError(t, err, out)
+	}
+
+	out, err := runGit(work, "push", server.URL+"/test.git", "HEAD:refs/heads/large")
+	assert.Error(t, err)
+	assert.Contains(t, out, "413")
+
+	out, err = runGit(dir, "--git-dir", filepath.Join(repos, "test.git"), "for-each-ref", "refs/heads/large")
+	assert.NoError(t, err, out)
+	assert.Equal(t, "", out)
+
+	// The decompressed size counts for gzip bodies
+	head, err := runGit(work, "rev-parse", "HEAD")
+	assert.NoError(t, err, head)
+	cmd := exec.Command("git", "pack-objects", "--stdout", "--revs")
+	cmd.Dir = work
+	cmd.Stdin = strings.NewReader("HEAD\n")
+	pack, err := cmd.Output()
+	assert.NoError(t, err)
+
+	var push bytes.Buffer
+	packLine(&push, fmt.Sprintf("%s %s refs/heads/large\x00report-status\n", strings.Repeat("0", 40), strings.TrimSpace(head)))
+	packFlush(&push)
+	push.Write(pack)
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(push.Bytes())
+	gz.Close()
+
+	for encoding, body := range map[string][]byte{"": push.Bytes(), "gzip": compressed.Bytes()} {
+		req, _ := http.NewRequest("POST", server.URL+"/test.git/git-receive-pack", bytes.NewReader(body))
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		// The server drops connections with unread bodies, do not reuse them
+		req.Close = true
+		resp, err := http.DefaultClient.Do(req)
+		if assert.NoError(t, err, encoding) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, encoding)
+		}
+	}
+
+	out, err = runGit(dir, "--git-dir", filepath.Join(repos, "test.git"), "for-each-ref", "refs/heads/large")
+	assert.NoError(t, err, out)
+	assert.Equal(t, "", out)
+}
+
+func TestPathPrefix(t *testing.T) {
+	for _, prefix := range []string{"", "/", "/git", "git/", "/git/mount/"} {
+		dir := t.TempDir()
+		repos := filepath.Join(dir, "repos")
+		ts := httptest.NewServer(New(Config{Dir: repos, AutoCreate: true, PathPrefix: prefix}))
+
+		mount := strings.TrimRight(ts.URL+"/"+strings.Trim(prefix, "/"), "/")
+		pushSampleCommit(t, dir, mount+"/team/test.git")
+		assert.True(t, repoExists(filepath.Join(repos, "team", "test.git")), prefix)
+
+		out, err := runGit(dir, "clone", "-q", mount+"/team/test.git", "clone")
+		assert.NoError(t, err, out)
+
+		resp, err := http.Get(mount + "/repos")
+		if assert.NoError(t, err) {
+			body := struct {
+				Data KitListRepoResponse `json:"data"`
+			}{}
+			json.NewDecoder(resp.Body).Decode(&body)
+			resp.Body.Close()
+			assert.Equal(t, []string{"team/test.git"}, body.Data.RepoPath, prefix)
+		}
+
+		if strings.Trim(prefix, "/") != "" {
+			// Paths outside of the mount point, or only sharing its start
+			for _, p := range []string{"/team/test.git/info/refs?service=git-upload-pack", "/gitx/team/test.git/info/refs?service=git-upload-pack"} {
+				resp, err := http.Get(ts.URL + p)
+				if assert.NoError(t, err) {
+					resp.Body.Close()
+					assert.Equal(t, http.StatusNotFound, resp.StatusCode, p)
+				}
+			}
+		}
+		ts.Close()
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "test.git")
+	server := New(Config{Dir: dir, JSONErrors: true})
+
+	body := struct {
+		Code int              `json:"code"`
+		Data KitErrorResponse `json:"data"`
+	}{}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/missing.git/repo/branches", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, http.StatusNotFound, body.Code)
+	assert.Equal(t, "Not Found", body.Data.Message)
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/test.git/repo/raw?ref=-x&path=README", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, http.StatusBadRequest, body.Code)
+
+	// Git clients keep getting plain text
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/missing.git/info/refs?service=git-upload-pack", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+
+	// Archive RPCs are git requests too, whether enabled or not
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/test.git/git-upload-archive", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+	w = httptest.NewRecorder()
+	archives := New(Config{Dir: dir, JSONErrors: true, AllowUploadArchive: true})
+	archives.ServeHTTP(w, httptest.NewRequest("POST", "/missing.git/git-upload-archive", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+
+	// Plain text remains the default
+	w = httptest.NewRecorder()
+	New(Config{Dir: dir}).ServeHTTP(w, httptest.NewRequest("GET", "/missing.git/repo/branches", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+}
+
+func TestRequestID(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "test.git")
+
+	logger := &testLogger{}
+	server := New(Config{Dir: dir})
+	server.Logger = logger
+
+	var ids []string
+	server.AuthFunc = func(_ Credential, req *Request) (bool, error) {
+		ids = append(ids, req.ID)
+		return true, nil
+	}
+	server.config.Auth = true
+
+	request := func(id string) string {
+		r := httptest.NewRequest("GET", "/test.git/repo/description", nil)
+		r.SetBasicAuth("user", "pass")
+		if id != "" {
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		return w.Header().Get(RequestIDHeader)
+	}
+
+	// IDs of clients are passed through
+	assert.Equal(t, "trace-1234", request("trace-1234"))
+	assert.Equal(t, "trace-1234", ids[0])
+	assert.Contains(t, strings.Join(logger.infos, "\n"), "/test.git/repo/description from 192.0.2.1 [trace-1234]")
+
+	// Missing or unsafe ones are replaced with a new UUID
+	generated := request("")
+	assert.Len(t, generated, 36)
+	assert.Equal(t, generated, ids[1])
+	assert.NotEqual(t, generated, request(""))
+
+	replaced := request("bad id\n")
+	assert.Len(t, replaced, 36)
+}
+
+func TestHealthz(t *testing.T) {
+	dir := t.TempDir()
+
+	health := func(server *Server, target string) (int, KitHealthResponse) {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+
+		body := struct {
+			Data KitHealthResponse `json:"data"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body.Data
+	}
+
+	// No credentials needed
+	server := New(Config{Dir: dir, Auth: true})
+	code, body := health(server, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body.Status)
+	assert.NotEmpty(t, body.GitVersion)
+
+	code, _ = health(server, "/test.git/healthz")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, body = health(New(Config{Dir: dir, GitPath: filepath.Join(dir, "missing-git")}), "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", body.Status)
+	assert.Contains(t, body.Error, "missing-git")
+
+	code, body = health(New(Config{Dir: filepath.Join(dir, "missing")}), "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body.Error, "not writable")
+}
+
+func TestHooksFunc(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{
+		Dir:       dir,
+		AutoHooks: true,
+		Hooks:     &HookScripts{PreReceive: "#!/bin/sh\necho default\n"},
+		HooksFunc: func(repoName string) *HookScripts {
+			if strings.HasPrefix(repoName, "strict/") {
+				return &HookScripts{PreReceive: "#!/bin/sh\necho strict\n"}
+			}
+			return nil
+		},
+	})
+
+	request := func(method string, target string) int {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w.Code
+	}
+	preReceive := func(repo string) string {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, repo, "hooks", "pre-receive"))
+		return string(data)
+	}
+
+	assert.Equal(t, http.StatusCreated, request("POST", "/team/app.git/repo"))
+	assert.Equal(t, http.StatusCreated, request("POST", "/strict/app.git/repo"))
+	assert.Contains(t, preReceive("team/app.git"), "echo default")
+	assert.Contains(t, preReceive("strict/app.git"), "echo strict")
+
+	// Existing repositories pick up changed hooks on request
+	server.config.Hooks = &HookScripts{PreReceive: "#!/bin/sh\necho updated\n"}
+	assert.Equal(t, http.StatusOK, request("POST", "/team/app.git/repo/hooks"))
+	assert.Contains(t, preReceive("team/app.git"), "echo updated")
+	assert.Contains(t, preReceive("strict/app.git"), "echo strict")
+
+	assert.Equal(t, http.StatusNotFound, request("POST", "/missing.git/repo/hooks"))
+}
+
+func TestReinstallHooks(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: dir})
+	for _, name := range []string{"a.git", "team/b.git", "team/c.git"} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("POST", "/"+name+"/repo", nil))
+		assert.Equal(t, http.StatusCreated, w.Code)
+	}
+
+	// No hooks configured, nothing to do
+	assert.NoError(t, server.ReinstallHooks())
+	assert.NoFileExists(t, filepath.Join(dir, "a.git", "hooks", "pre-receive"))
+
+	server.config.Hooks = &HookScripts{PreReceive: "#!/bin/sh\necho policy\n"}
+	assert.NoError(t, server.ReinstallHooks())
+	for _, name := range []string{"a.git", "team/b.git", "team/c.git"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name, "hooks", "pre-receive"))
+		assert.NoError(t, err, name)
+		assert.Contains(t, string(data), "echo policy", name)
+	}
+
+	// Failures are reported per repository, and logged
+	assert.NoError(t, os.RemoveAll(filepath.Join(dir, "team", "c.git", "hooks")))
+	server.config.Hooks = &HookScripts{PreReceive: "#!/bin/sh\necho changed\n"}
+	logger := &testLogger{}
+	server.Logger = logger
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/admin/hooks/reinstall", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	body := struct {
+		Data KitReinstallHooksResponse `json:"data"`
+	}{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, 2, body.Data.Updated)
+	if assert.Len(t, body.Data.Failed, 1) {
+		assert.Equal(t, "team/c.git", body.Data.Failed[0].RepoPath)
+	}
+	logger.Lock()
+	if assert.Len(t, logger.errors, 1) {
+		assert.True(t, strings.HasPrefix(logger.errors[0], "reinstall hooks: team/c.git: "), logger.errors[0])
+	}
+	logger.Unlock()
+
+	assert.Error(t, server.ReinstallHooks())
+}
+
+func TestFormatResponseCode(t *testing.T) {
+	server := New(Config{Dir: t.TempDir()})
+
+	for _, test := range []struct {
+		body *KitResponse
+		code int
+		want int
+	}{
+		{&KitResponse{}, http.StatusAccepted, http.StatusAccepted},
+		{&KitResponse{Data: KitRepoResponse{"test.git"}}, http.StatusNotFound, http.StatusNotFound},
+		{&KitResponse{Code: 1001}, http.StatusOK, 1001},
+	} {
+		w := httptest.NewRecorder()
+		server.formatResponse(w, httptest.NewRequest("GET", "/repos", nil), test.body, test.code)
+		assert.Equal(t, test.code, w.Code)
+
+		body := KitResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, test.want, body.Code)
+	}
+}
+
+func TestMultipleDirs(t *testing.T) {
+	dir := t.TempDir()
+	active := filepath.Join(dir, "active")
+	archive := filepath.Join(dir, "archive")
+	out, err := runGit(dir, "init", "-q", "--bare", filepath.Join(archive, "team", "old.git"))
+	assert.NoError(t, err, out)
+	out, err = runGit(dir, "init", "-q", "--bare", filepath.Join(archive, "both.git"))
+	assert.NoError(t, err, out)
+	out, err = runGit(dir, "init", "-q", "--bare", filepath.Join(active, "both.git"))
+	assert.NoError(t, err, out)
+
+	server := New(Config{Dirs: []string{active, archive}})
+	request := func(method string, target string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	// Repositories are found in any root, the first one wins
+	assert.Equal(t, http.StatusOK, request("GET", "/team/old.git/repo/description", "").Code)
+	assert.Equal(t, filepath.Join(active, "both.git"), server.repoPath("", "both.git"))
+
+	// New repositories go to the first root
+	assert.Equal(t, http.StatusCreated, request("POST", "/new.git/repo", "").Code)
+	assert.True(t, repoExists(filepath.Join(active, "new.git")))
+
+	w := request("GET", "/repos", "")
+	body := struct {
+		Data KitListRepoResponse `json:"data"`
+	}{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, []string{"both.git", "new.git", "team/old.git"}, body.Data.RepoPath)
+
+	// Renames stay in the root of the repository
+	w = request("POST", "/repo/rename", `{"from": "team/old.git", "to": "team/older.git"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, repoExists(filepath.Join(archive, "team", "older.git")))
+}
+
+func TestRejectGzipRequests(t *testing.T) {
+	dir := t.TempDir()
+	out, err := runGit(dir, "init", "-q", "--bare", "test.git")
+	assert.NoError(t, err, out)
+	server := New(Config{Dir: dir, RejectGzipRequests: true})
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("0000"))
+	gz.Close()
+
+	post := func(target string) int {
+		r := httptest.NewRequest("POST", target, bytes.NewReader(compressed.Bytes()))
+		r.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, post("/test.git/git-receive-pack"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, post("/test.git/git-upload-pack"))
+
+	// Accepted by default
+	server = New(Config{Dir: dir})
+	assert.Equal(t, http.StatusOK, post("/test.git/git-upload-pack"))
+}
+
+func TestGzipRequestSize(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	makeRepo(t, repos, "test.git")
+	gitPath := writeGitStub(t, dir, "cat > /dev/null\nprintf 0000\n")
+	server := New(Config{Dir: repos, GitPath: gitPath, MaxGzipRequestSize: 1 << 20})
+
+	post := func(size int) int {
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		gz.Write(make([]byte, size))
+		gz.Close()
+
+		r := httptest.NewRequest("POST", "/test.git/git-upload-pack", &compressed)
+		r.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// A few kilobytes that decompress past the limit are cut off
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(1<<20+1))
+	assert.Equal(t, http.StatusOK, post(1<<20))
+
+	// There is no limit by default
+	server = New(Config{Dir: repos, GitPath: gitPath})
+	assert.Equal(t, http.StatusOK, post(4<<20))
+}
+
+func TestGitStderr(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	makeRepo(t, repos, "test.git")
+
+	gitPath := writeGitStub(t, dir, "cat > /dev/null\necho warning: noise >&2\nprintf 0000\necho fatal: broken >&2\nexit 1\n")
+	logger := &testLogger{}
+	server := New(Config{Dir: repos, GitPath: gitPath})
+	server.Logger = logger
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/test.git/info/refs?service=git-upload-pack", nil),
+		httptest.NewRequest("POST", "/test.git/git-upload-pack", strings.NewReader("0000")),
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+
+		// Only stdout reaches the client, stderr ends up in the logs
+		assert.NotContains(t, w.Body.String(), "noise", req.URL.Path)
+		assert.True(t, strings.HasSuffix(w.Body.String(), "0000"), req.URL.Path)
+	}
+
+	logger.Lock()
+	defer logger.Unlock()
+	if assert.Len(t, logger.errors, 2) {
+		for _, message := range logger.errors {
+			assert.Contains(t, message, "fatal: broken")
+		}
+	}
+}
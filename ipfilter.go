@@ -0,0 +1,61 @@
+package gitkit
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseCIDRs parses networks in CIDR notation, e.g. "10.0.0.0/8". Plain
+// addresses stand for themselves.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", cidr)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// allowedIP reports whether a client may connect from the address, see
+// Config.AllowedCIDRs and Config.DeniedCIDRs
+func (s *Server) allowedIP(addr string) bool {
+	if len(s.allowedNets) == 0 && len(s.deniedNets) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range s.deniedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(s.allowedNets) == 0 {
+		return true
+	}
+	for _, n := range s.allowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package gitkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowedCIDRs(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "test.git")
+
+	server := New(Config{
+		Dir:          dir,
+		AllowedCIDRs: []string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.7"},
+		DeniedCIDRs:  []string{"10.1.0.0/16", "2001:db8:bad::/48"},
+	})
+
+	tests := []struct {
+		remoteAddr string
+		code       int
+	}{
+		{"10.2.3.4:1234", http.StatusOK},
+		{"10.1.2.3:1234", http.StatusForbidden},
+		{"192.0.2.7:1234", http.StatusOK},
+		{"192.0.2.8:1234", http.StatusForbidden},
+		{"[2001:db8::1]:1234", http.StatusOK},
+		{"[2001:db8:bad::1]:1234", http.StatusForbidden},
+		{"[2001:db9::1]:1234", http.StatusForbidden},
+		{"[::ffff:10.2.3.4]:1234", http.StatusOK},
+		{"garbage", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/test.git/repo/description", nil)
+		r.RemoteAddr = test.remoteAddr
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		assert.Equal(t, test.code, w.Code, test.remoteAddr)
+	}
+}
+
+func TestDeniedCIDRsOnly(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "test.git")
+
+	server := New(Config{Dir: dir, TrustProxy: true, DeniedCIDRs: []string{"203.0.113.0/24", "2001:db8::/32"}})
+
+	tests := []struct {
+		forwardedFor string
+		code         int
+	}{
+		{"198.51.100.1", http.StatusOK},
+		{"203.0.113.9", http.StatusForbidden},
+		{"198.51.100.1, 203.0.113.9", http.StatusForbidden},
+		{"2001:db8::5", http.StatusForbidden},
+		{"2001:db9::5", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/test.git/repo/description", nil)
+		r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		assert.Equal(t, test.code, w.Code, test.forwardedFor)
+	}
+}
+
+func TestInvalidCIDRs(t *testing.T) {
+	assert.Panics(t, func() { New(Config{AllowedCIDRs: []string{"10.0.0.0/33"}}) })
+	assert.Panics(t, func() { New(Config{DeniedCIDRs: []string{"not-a-network"}}) })
+}
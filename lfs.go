@@ -0,0 +1,286 @@
+package gitkit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// Media type of Git LFS API requests and responses
+const lfsMediaType = "application/vnd.git-lfs+json"
+
+// Maximum size of a batch request body
+const lfsMaxBatchSize = 10 << 20
+
+// Objects transferred by LFS clients. The first group is the repository
+// path, the second one is the SHA-256 of the object.
+var lfsObjectRegex = regexp.MustCompile(`^(.*)/info/lfs/objects/([0-9a-f]{64})$`)
+
+var lfsOIDRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type lfsBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers,omitempty"`
+	Objects   []lfsObject `json:"objects"`
+}
+
+type lfsObject struct {
+	OID  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+type lfsBatchResponse struct {
+	Transfer string              `json:"transfer"`
+	Objects  []lfsObjectResponse `json:"objects"`
+}
+
+type lfsObjectResponse struct {
+	OID           string               `json:"oid"`
+	Size          int64                `json:"size"`
+	Authenticated bool                 `json:"authenticated,omitempty"`
+	Actions       map[string]lfsAction `json:"actions,omitempty"`
+	Error         *lfsObjectError      `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type lfsObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// findLFSService matches transfers of LFS objects stored by the server
+func (s *Server) findLFSService(req *http.Request) (*service, string) {
+	if !s.config.LFS {
+		return nil, ""
+	}
+
+	matches := lfsObjectRegex.FindStringSubmatch(req.URL.Path)
+	if matches == nil {
+		return nil, ""
+	}
+
+	suffix := "/info/lfs/objects/" + matches[2]
+	switch req.Method {
+	case http.MethodGet:
+		return &service{http.MethodGet, suffix, (*Server).lfsDownload, "", "lfs-download"}, matches[1]
+	case http.MethodPut:
+		return &service{http.MethodPut, suffix, (*Server).lfsUpload, "", "lfs-upload"}, matches[1]
+	}
+	return nil, ""
+}
+
+// lfsBatchOperation returns the operation of a batch request, uploads unless
+// it asks for downloads
+func lfsBatchOperation(req *Request) string {
+	if batch, err := req.readLFSBatch(); err == nil && batch.Operation == "download" {
+		return OperationDownload
+	}
+	return OperationUpload
+}
+
+// readLFSBatch parses the body of a batch request. The body is read once,
+// later calls return the same result.
+func (r *Request) readLFSBatch() (*lfsBatchRequest, error) {
+	if r.lfsBatch == nil && r.lfsBatchErr == nil {
+		batch := &lfsBatchRequest{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, lfsMaxBatchSize)).Decode(batch); err != nil {
+			r.lfsBatchErr = err
+		} else {
+			r.lfsBatch = batch
+		}
+	}
+	return r.lfsBatch, r.lfsBatchErr
+}
+
+// lfsBatch tells LFS clients where to transfer objects, see
+// https://github.com/git-lfs/git-lfs/blob/main/docs/api/batch.md
+// Objects are stored in the lfs directory of the repository and served by
+// the lfsDownload and lfsUpload handlers.
+func (s *Server) lfsBatch(_ string, w http.ResponseWriter, r *Request) error {
+	batch, err := r.readLFSBatch()
+	if err != nil {
+		s.lfsError(w, http.StatusBadRequest, "invalid batch request")
+		return nil
+	}
+
+	if batch.Operation != "download" && batch.Operation != "upload" {
+		s.lfsError(w, http.StatusUnprocessableEntity, "unsupported operation")
+		return nil
+	}
+	if !lfsBasicTransfer(batch.Transfers) {
+		s.lfsError(w, http.StatusUnprocessableEntity, "only the basic transfer adapter is supported")
+		return nil
+	}
+
+	// Let transfers authenticate like the batch request did
+	var header map[string]string
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		header = map[string]string{"Authorization": auth}
+	}
+
+	objects := make([]lfsObjectResponse, 0, len(batch.Objects))
+	for _, obj := range batch.Objects {
+		res := lfsObjectResponse{OID: obj.OID, Size: obj.Size}
+		if !lfsOIDRegex.MatchString(obj.OID) || obj.Size < 0 {
+			res.Error = &lfsObjectError{http.StatusUnprocessableEntity, "invalid object"}
+			objects = append(objects, res)
+			continue
+		}
+
+		info, err := os.Stat(lfsObjectPath(r.RepoPath, obj.OID))
+		stored := err == nil && info.Size() == obj.Size
+		action := lfsAction{Href: s.lfsHref(r, obj.OID), Header: header}
+
+		switch {
+		case batch.Operation == "download" && stored:
+			res.Authenticated = true
+			res.Actions = map[string]lfsAction{"download": action}
+		case batch.Operation == "download":
+			res.Error = &lfsObjectError{http.StatusNotFound, "object not found"}
+		case !stored:
+			// Objects the server already has need no upload
+			res.Authenticated = true
+			res.Actions = map[string]lfsAction{"upload": action}
+		}
+		objects = append(objects, res)
+	}
+
+	s.lfsResponse(w, http.StatusOK, lfsBatchResponse{Transfer: "basic", Objects: objects})
+	return nil
+}
+
+func (s *Server) lfsDownload(_ string, w http.ResponseWriter, r *Request) error {
+	matches := lfsObjectRegex.FindStringSubmatch(r.URL.Path)
+	f, err := os.Open(lfsObjectPath(r.RepoPath, matches[2]))
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.lfsError(w, http.StatusNotFound, "object not found")
+			return nil
+		}
+		s.fail500(w, r.Request, "lfs download", err)
+		return err
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if info, err := f.Stat(); err == nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, f); err != nil {
+		s.logError(r.Request, "lfs download", err)
+		return err
+	}
+	return nil
+}
+
+// lfsUpload stores an object once its contents match its SHA-256
+func (s *Server) lfsUpload(_ string, w http.ResponseWriter, r *Request) error {
+	context := "lfs upload"
+	oid := lfsObjectRegex.FindStringSubmatch(r.URL.Path)[2]
+
+	tmpDir := filepath.Join(r.RepoPath, "lfs", "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		s.fail500(w, r.Request, context, err)
+		return err
+	}
+	tmp, err := ioutil.TempFile(tmpDir, oid)
+	if err != nil {
+		s.fail500(w, r.Request, context, err)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	var body io.Reader = r.Body
+	if s.config.MaxPushSize > 0 {
+		body = &maxSizeReader{r: body, n: s.config.MaxPushSize}
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), body)
+	tmp.Close()
+	if err == errBodyTooLarge {
+		s.logError(r.Request, context, err)
+		s.lfsError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return err
+	}
+	if err != nil {
+		s.logError(r.Request, context, err)
+		return err
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != oid {
+		s.lfsError(w, http.StatusUnprocessableEntity, "object does not match its oid")
+		return nil
+	}
+
+	objectPath := lfsObjectPath(r.RepoPath, oid)
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		s.fail500(w, r.Request, context, err)
+		return err
+	}
+	if err := os.Rename(tmp.Name(), objectPath); err != nil {
+		s.fail500(w, r.Request, context, err)
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// lfsObjectPath returns where an object is stored, the layout git-lfs uses
+// for its local copies
+func lfsObjectPath(repoPath string, oid string) string {
+	return filepath.Join(repoPath, "lfs", "objects", oid[0:2], oid[2:4], oid)
+}
+
+// lfsHref returns the URL of an object on this server, as the client sees it
+func (s *Server) lfsHref(r *Request, oid string) string {
+	scheme, host := s.clientURL(r.Request)
+	return scheme + "://" + host + s.config.PathPrefix + "/" + r.RepoName + "/info/lfs/objects/" + oid
+}
+
+// lfsBasicTransfer reports whether the client can use the basic transfer
+// adapter, clients listing no adapters at all support it
+func lfsBasicTransfer(transfers []string) bool {
+	if len(transfers) == 0 {
+		return true
+	}
+	for _, t := range transfers {
+		if t == "basic" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) lfsResponse(w http.ResponseWriter, code int, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		http.Error(w, "Internal server error", 500)
+		s.logError(nil, "marshal response", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", lfsMediaType)
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+func (s *Server) lfsError(w http.ResponseWriter, code int, message string) {
+	s.lfsResponse(w, code, struct {
+		Message string `json:"message"`
+	}{message})
+}
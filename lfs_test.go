@@ -0,0 +1,163 @@
+package gitkit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLFS(t *testing.T) {
+	dir := t.TempDir()
+	out, err := runGit(dir, "init", "-q", "--bare", "test.git")
+	assert.NoError(t, err, out)
+
+	server := httptest.NewServer(New(Config{Dir: dir, LFS: true}))
+	defer server.Close()
+
+	content := "large binary contents"
+	sum := sha256.Sum256([]byte(content))
+	oid := hex.EncodeToString(sum[:])
+
+	batch := func(operation string) lfsBatchResponse {
+		body := `{"operation": "` + operation + `", "transfers": ["basic"], "objects": [{"oid": "` + oid + `", "size": 21}]}`
+		req, _ := http.NewRequest("POST", server.URL+"/test.git/info/lfs/objects/batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", lfsMediaType)
+		req.SetBasicAuth("user", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, lfsMediaType, resp.Header.Get("Content-Type"))
+
+		var res lfsBatchResponse
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		assert.Equal(t, "basic", res.Transfer)
+		return res
+	}
+
+	// Missing objects are not found, but can be uploaded
+	res := batch("download")
+	if assert.Len(t, res.Objects, 1) && assert.NotNil(t, res.Objects[0].Error) {
+		assert.Equal(t, http.StatusNotFound, res.Objects[0].Error.Code)
+	}
+
+	res = batch("upload")
+	if !assert.Len(t, res.Objects, 1) {
+		return
+	}
+	upload, ok := res.Objects[0].Actions["upload"]
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, server.URL+"/test.git/info/lfs/objects/"+oid, upload.Href)
+	assert.Contains(t, upload.Header["Authorization"], "Basic ")
+
+	// Uploads have to match their oid
+	req, _ := http.NewRequest("PUT", upload.Href, strings.NewReader("tampered"))
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	req, _ = http.NewRequest("PUT", upload.Href, strings.NewReader(content))
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.FileExists(t, filepath.Join(dir, "test.git", "lfs", "objects", oid[0:2], oid[2:4], oid))
+
+	// Stored objects need no upload and can be downloaded
+	res = batch("upload")
+	if assert.Len(t, res.Objects, 1) {
+		assert.Empty(t, res.Objects[0].Actions)
+	}
+
+	res = batch("download")
+	if !assert.Len(t, res.Objects, 1) {
+		return
+	}
+	download, ok := res.Objects[0].Actions["download"]
+	if !assert.True(t, ok) {
+		return
+	}
+	resp, err = http.Get(download.Href)
+	assert.NoError(t, err)
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, content, string(data))
+}
+
+func TestLFSDisabled(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "test.git")
+	server := New(Config{Dir: dir})
+
+	oid := strings.Repeat("a", 64)
+	for _, req := range []*http.Request{
+		httptest.NewRequest("POST", "/test.git/info/lfs/objects/batch", strings.NewReader(`{"operation": "download"}`)),
+		httptest.NewRequest("GET", "/test.git/info/lfs/objects/"+oid, nil),
+		httptest.NewRequest("PUT", "/test.git/info/lfs/objects/"+oid, strings.NewReader("data")),
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code, req.Method+" "+req.URL.Path)
+	}
+}
+
+func TestLFSBatchOperation(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "test.git")
+
+	var operations []string
+	server := New(Config{Dir: dir, LFS: true, Auth: true})
+	server.AuthFunc = func(_ Credential, req *Request) (bool, error) {
+		operations = append(operations, req.Operation)
+		return req.Operation == OperationDownload, nil
+	}
+
+	for _, operation := range []string{"download", "upload"} {
+		req := httptest.NewRequest("POST", "/test.git/info/lfs/objects/batch", strings.NewReader(`{"operation": "`+operation+`", "objects": []}`))
+		req.SetBasicAuth("user", "secret")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+
+		if operation == "download" {
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Contains(t, w.Body.String(), `"transfer":"basic"`)
+		} else {
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		}
+	}
+	assert.Equal(t, []string{OperationDownload, OperationUpload}, operations)
+}
+
+func TestLFSHrefProxy(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "test.git")
+	server := New(Config{Dir: dir, LFS: true, TrustProxy: true})
+
+	// Behind a proxy terminating TLS objects are linked as the client sees
+	// the server
+	oid := strings.Repeat("a", 64)
+	req := httptest.NewRequest("POST", "/test.git/info/lfs/objects/batch", strings.NewReader(`{"operation": "upload", "objects": [{"oid": "`+oid+`", "size": 1}]}`))
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "git.example.com")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var res lfsBatchResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+	if assert.Len(t, res.Objects, 1) {
+		assert.Equal(t, "https://git.example.com/test.git/info/lfs/objects/"+oid, res.Objects[0].Actions["upload"].Href)
+	}
+}
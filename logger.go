@@ -0,0 +1,24 @@
+package gitkit
+
+import (
+	"log"
+)
+
+// Logger receives messages about requests and errors handled by the server
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// stdLogger writes messages using the standard library logger
+type stdLogger struct{}
+
+func (stdLogger) Infof(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+func (stdLogger) Errorf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+var defaultLogger Logger = stdLogger{}
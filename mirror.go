@@ -0,0 +1,165 @@
+package gitkit
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// MirrorConfig describes the upstream a repository mirrors, see
+// Config.MirrorFunc
+type MirrorConfig struct {
+	URL string
+
+	// Credentials sent to HTTP upstreams with basic authentication. They are
+	// passed to git through its environment and never stored in the
+	// repository.
+	Username string
+	Password string
+
+	// Extra KEY=VALUE pairs for the environment of git fetch, e.g.
+	// GIT_SSH_COMMAND for SSH upstreams
+	Env []string
+}
+
+// KitSyncResponse tells how the refs of a mirror changed when it was synced
+type KitSyncResponse struct {
+	RepoPath string      `json:"repoPath" protobuf:"1"`
+	Created  int         `json:"created" protobuf:"2"`
+	Updated  int         `json:"updated" protobuf:"3"`
+	Deleted  int         `json:"deleted" protobuf:"4"`
+	Updates  []RefUpdate `json:"updates" protobuf:"5"`
+}
+
+// ErrNotMirror is returned by SyncMirror for repositories Config.MirrorFunc
+// has no upstream for
+var ErrNotMirror = errors.New("repository is not a mirror")
+
+// Branches and tags are mirrored, deleted upstream ones are pruned
+var mirrorRefspecs = []string{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"}
+
+// SyncMirror fetches the branches and tags of a mirror from its upstream,
+// e.g. on a schedule. It fails with ErrNotMirror if the repository has no
+// upstream.
+func (s *Server) SyncMirror(ctx context.Context, name string) (*KitSyncResponse, error) {
+	s = s.snapshot()
+	repoName, repoPath, ok := s.resolveRepo(name)
+	if !ok || !repoExists(repoPath) {
+		return nil, fmt.Errorf("repository %q not found", name)
+	}
+	return s.syncMirror(ctx, repoName, repoPath)
+}
+
+// syncMirrorRepo serves POST /repo/sync
+func (s *Server) syncMirrorRepo(_ string, w http.ResponseWriter, r *Request) error {
+	res, err := s.syncMirror(r.Context(), r.RepoName, r.RepoPath)
+	if err == ErrNotMirror {
+		body := &KitResponse{
+			Data: KitErrorResponse{Message: err.Error()},
+		}
+		s.formatResponse(w, r.Request, body, http.StatusBadRequest)
+		return nil
+	}
+	if err != nil {
+		s.fail500(w, r.Request, "sync mirror", err)
+		return err
+	}
+
+	s.formatResponse(w, r.Request, &KitResponse{Data: res}, http.StatusOK)
+	return nil
+}
+
+// syncMirror runs git fetch for a mirror and compares its refs before and
+// after. Pushes and other syncs of the repository wait for it.
+func (s *Server) syncMirror(ctx context.Context, repoName string, repoPath string) (*KitSyncResponse, error) {
+	var mirror *MirrorConfig
+	if s.config.MirrorFunc != nil {
+		mirror = s.config.MirrorFunc(repoName)
+	}
+	if mirror == nil || mirror.URL == "" {
+		return nil, ErrNotMirror
+	}
+	if strings.HasPrefix(mirror.URL, "-") {
+		return nil, fmt.Errorf("invalid upstream url %q", mirror.URL)
+	}
+
+	lock := s.repoLock(repoPath)
+	lock.Lock()
+	defer lock.Unlock()
+	defer s.advertiseCache.invalidate(repoPath)
+
+	before, err := s.refValues(ctx, repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	args := append([]string{"--git-dir", repoPath, "fetch", "--quiet", "--prune", "--no-tags", mirror.URL}, mirrorRefspecs...)
+	if _, err := s.gitOutputEnv(ctx, mirror.env(), args...); err != nil {
+		return nil, err
+	}
+
+	after, err := s.refValues(ctx, repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &KitSyncResponse{RepoPath: repoName, Updates: []RefUpdate{}}
+	for ref, newSHA := range after {
+		oldSHA, ok := before[ref]
+		switch {
+		case !ok:
+			res.Created++
+			res.Updates = append(res.Updates, RefUpdate{OldSHA: ZeroSHA, NewSHA: newSHA, Ref: ref})
+		case oldSHA != newSHA:
+			res.Updated++
+			res.Updates = append(res.Updates, RefUpdate{OldSHA: oldSHA, NewSHA: newSHA, Ref: ref})
+		}
+	}
+	for ref, oldSHA := range before {
+		if _, ok := after[ref]; !ok {
+			res.Deleted++
+			res.Updates = append(res.Updates, RefUpdate{OldSHA: oldSHA, NewSHA: ZeroSHA, Ref: ref})
+		}
+	}
+	sort.Slice(res.Updates, func(i, j int) bool {
+		return res.Updates[i].Ref < res.Updates[j].Ref
+	})
+	return res, nil
+}
+
+// env returns the environment of git fetch. Credentials go in an extra
+// header set through GIT_CONFIG_COUNT, so that they appear neither in the
+// command line nor in the repository config.
+func (m *MirrorConfig) env() []string {
+	env := append([]string{"GIT_TERMINAL_PROMPT=0"}, m.Env...)
+	if m.Username != "" || m.Password != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(m.Username + ":" + m.Password))
+		env = append(env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+		)
+	}
+	return env
+}
+
+// refValues returns the object names of the refs of a repository
+func (s *Server) refValues(ctx context.Context, repoPath string) (map[string]string, error) {
+	lines, err := s.forEachRef(ctx, repoPath, "refs", "%(objectname) %(refname)")
+	if err != nil {
+		return nil, err
+	}
+
+	refs := map[string]string{}
+	for _, line := range lines {
+		chunks := strings.SplitN(line, " ", 2)
+		if len(chunks) == 2 {
+			refs[chunks[1]] = chunks[0]
+		}
+	}
+	return refs, nil
+}
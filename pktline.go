@@ -0,0 +1,140 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Maximum payload of a side-band packet, leaving room for the length header
+// and the band number. Fits both side-band and side-band-64k clients.
+const sidebandMaxData = 1000 - 5
+
+// pktLine is a single packet in git's pkt-line format
+type pktLine []byte
+
+func (p pktLine) isFlush() bool {
+	return string(p) == "0000"
+}
+
+// payload returns packet data without the length header
+func (p pktLine) payload() []byte {
+	if len(p) < 4 {
+		return nil
+	}
+	return p[4:]
+}
+
+// capabilities returns the capability list sent after the NUL byte on the
+// first line of a request.
+func (p pktLine) capabilities() []string {
+	data := p.payload()
+	i := bytes.IndexByte(data, 0)
+	if i == -1 {
+		return nil
+	}
+	return strings.Fields(string(data[i+1:]))
+}
+
+// readPktLine reads a single packet from r
+func readPktLine(r io.Reader) (pktLine, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	size, err := strconv.ParseUint(string(head), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pkt-line length %q", head)
+	}
+
+	// Flush, delimiter and response-end packets carry no data
+	if size < 4 {
+		return pktLine(head), nil
+	}
+
+	line := make([]byte, size)
+	copy(line, head)
+	if _, err := io.ReadFull(r, line[4:]); err != nil {
+		return nil, err
+	}
+	return pktLine(line), nil
+}
+
+// readPktSection reads packets from r up to and including the next flush-pkt
+func readPktSection(r io.Reader) ([]pktLine, error) {
+	lines := []pktLine{}
+	for {
+		line, err := readPktLine(r)
+		if err != nil {
+			return lines, err
+		}
+		lines = append(lines, line)
+		if line.isFlush() {
+			return lines, nil
+		}
+	}
+}
+
+// copyPktLines copies packets from src to dst until src is exhausted. A flush-pkt
+// ending the stream is not written, instead pending is set so that the caller
+// can append more packets before flushing. If set, observe is called with
+// every packet other than flush-pkts.
+func copyPktLines(dst io.Writer, src io.Reader, observe func(pktLine)) (pending bool, err error) {
+	for {
+		line, err := readPktLine(src)
+		if err == io.EOF {
+			return pending, nil
+		}
+		if err != nil {
+			return pending, err
+		}
+
+		if pending {
+			if err := packFlush(dst); err != nil {
+				return false, err
+			}
+			pending = false
+		}
+
+		if line.isFlush() {
+			pending = true
+			continue
+		}
+
+		if observe != nil {
+			observe(line)
+		}
+
+		if _, err := dst.Write(line); err != nil {
+			return false, err
+		}
+	}
+}
+
+// packSideband writes data to the given side-band channel, split into as many
+// packets as needed.
+func packSideband(w io.Writer, band byte, data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > sidebandMaxData {
+			n = sidebandMaxData
+		}
+		if err := packLine(w, string(band)+string(data[:n])); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func hasCapability(caps []string, name string) bool {
+	for _, c := range caps {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
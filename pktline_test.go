@@ -0,0 +1,54 @@
+package gitkit
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_readPktLine(t *testing.T) {
+	r := strings.NewReader("000ahello\n0000")
+
+	line, err := readPktLine(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", string(line.payload()))
+	assert.False(t, line.isFlush())
+
+	line, err = readPktLine(r)
+	assert.NoError(t, err)
+	assert.True(t, line.isFlush())
+
+	_, err = readPktLine(strings.NewReader("zzzz"))
+	assert.Error(t, err)
+}
+
+func Test_pktLineCapabilities(t *testing.T) {
+	line := pktLine("0000old new refs/heads/master\x00report-status side-band-64k\n")
+	assert.Equal(t, []string{"report-status", "side-band-64k"}, line.capabilities())
+	assert.Nil(t, pktLine("0000old new refs/heads/master\n").capabilities())
+}
+
+func Test_copyPktLines(t *testing.T) {
+	w := bytes.NewBuffer([]byte{})
+	observed := []string{}
+	pending, err := copyPktLines(w, strings.NewReader("0006a\n00000006b\n0000"), func(line pktLine) {
+		observed = append(observed, string(line.payload()))
+	})
+
+	assert.NoError(t, err)
+	assert.True(t, pending)
+	assert.Equal(t, "0006a\n00000006b\n", w.String())
+	assert.Equal(t, []string{"a\n", "b\n"}, observed)
+}
+
+func Test_packSideband(t *testing.T) {
+	w := bytes.NewBuffer([]byte{})
+	err := packSideband(w, 2, []byte(strings.Repeat("x", sidebandMaxData+1)))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1000+6, w.Len())
+	assert.True(t, strings.HasPrefix(w.String(), "03e8\x02"))
+	assert.True(t, strings.HasSuffix(w.String(), "0006\x02x"))
+}
@@ -0,0 +1,186 @@
+package gitkit
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Media type of API responses encoded with protocol buffers, see gitkit.proto
+const protobufContentType = "application/x-protobuf"
+
+// acceptsProtobuf reports whether the client prefers protocol buffers to
+// JSON. Clients that accept both equally get JSON.
+func acceptsProtobuf(r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+
+	protobufQ, jsonQ := 0.0, 0.0
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		switch mediaType {
+		case protobufContentType:
+			protobufQ = q
+		case "application/json":
+			jsonQ = q
+		}
+	}
+	return protobufQ > jsonQ
+}
+
+// marshalProtobuf encodes a response in the protocol buffers wire format.
+// Struct fields are numbered by their protobuf tag, e.g. `protobuf:"1"`,
+// which has to match gitkit.proto and never change once released. KitResponse
+// data is field 2 whatever its type, so that a message per endpoint
+// describes it.
+func marshalProtobuf(v interface{}) ([]byte, error) {
+	return appendMessage(nil, reflect.ValueOf(v))
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// appendMessage appends the fields of a struct
+func appendMessage(b []byte, v reflect.Value) ([]byte, error) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return b, nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("protobuf: %s is not a message", v.Type())
+	}
+
+	// Times are google.protobuf.Timestamp messages
+	if v.Type() == timeType {
+		t := v.Interface().(time.Time)
+		if t.IsZero() {
+			return b, nil
+		}
+		b = appendVarintField(b, 1, uint64(t.Unix()))
+		return appendVarintField(b, 2, uint64(t.Nanosecond())), nil
+	}
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		num, err := strconv.Atoi(field.Tag.Get("protobuf"))
+		if err != nil || num < 1 {
+			return nil, fmt.Errorf("protobuf: %s.%s has no field number", v.Type(), field.Name)
+		}
+		if b, err = appendField(b, num, v.Field(i)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// appendField appends a field unless it has its zero value, repeated fields
+// once per element
+func appendField(b []byte, num int, v reflect.Value) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return b, nil
+		}
+		return appendField(b, num, v.Elem())
+	case reflect.String:
+		if v.Len() > 0 {
+			b = appendBytesField(b, num, []byte(v.String()))
+		}
+	case reflect.Bool:
+		if v.Bool() {
+			b = appendVarintField(b, num, 1)
+		}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		if v.Int() != 0 {
+			b = appendVarintField(b, num, uint64(v.Int()))
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			elem := v.Index(i)
+			if elem.Kind() == reflect.String {
+				b = appendBytesField(b, num, []byte(elem.String()))
+				continue
+			}
+			var err error
+			if b, err = appendMessageField(b, num, elem); err != nil {
+				return nil, err
+			}
+		}
+	case reflect.Map:
+		// Maps are repeated entry messages with the key as field 1 and the
+		// value as field 2, sorted by key so that encodings are stable
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			if key.Kind() != reflect.String {
+				return nil, fmt.Errorf("protobuf: unsupported field type %s", v.Type())
+			}
+			entry, err := appendField(nil, 1, key)
+			if err != nil {
+				return nil, err
+			}
+			if entry, err = appendField(entry, 2, v.MapIndex(key)); err != nil {
+				return nil, err
+			}
+			b = appendBytesField(b, num, entry)
+		}
+	case reflect.Struct:
+		if v.Type() == timeType && v.Interface().(time.Time).IsZero() {
+			return b, nil
+		}
+		return appendMessageField(b, num, v)
+	default:
+		return nil, fmt.Errorf("protobuf: unsupported field type %s", v.Type())
+	}
+	return b, nil
+}
+
+func appendMessageField(b []byte, num int, v reflect.Value) ([]byte, error) {
+	msg, err := appendMessage(nil, v)
+	if err != nil {
+		return nil, err
+	}
+	return appendBytesField(b, num, msg), nil
+}
+
+// Wire types of fields
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func appendVarintField(b []byte, num int, x uint64) []byte {
+	b = appendVarint(b, uint64(num)<<3|wireVarint)
+	return appendVarint(b, x)
+}
+
+func appendBytesField(b []byte, num int, data []byte) []byte {
+	b = appendVarint(b, uint64(num)<<3|wireBytes)
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendVarint(b []byte, x uint64) []byte {
+	for x >= 0x80 {
+		b = append(b, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(b, byte(x))
+}
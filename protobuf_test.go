@@ -0,0 +1,174 @@
+package gitkit
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_marshalProtobuf(t *testing.T) {
+	tests := []struct {
+		body interface{}
+		want []byte
+	}{
+		{
+			&KitResponse{Code: 200, Data: KitListRepoResponse{RepoPath: []string{"a.git"}, Total: 1}},
+			[]byte{0x08, 0xc8, 0x01, 0x12, 0x09, 0x0a, 0x05, 'a', '.', 'g', 'i', 't', 0x10, 0x01},
+		},
+		{
+			// Repeated data, zero values left out
+			&KitResponse{Code: 200, Data: []KitTag{{Name: "v1", Annotated: true}, {}}},
+			[]byte{0x08, 0xc8, 0x01, 0x12, 0x06, 0x0a, 0x02, 'v', '1', 0x18, 0x01, 0x12, 0x00},
+		},
+		{
+			&KitResponse{Code: 404},
+			[]byte{0x08, 0x94, 0x03},
+		},
+		{
+			// Timestamps with seconds and nanos
+			KitCommit{Date: time.Unix(300, 5)},
+			[]byte{0x22, 0x05, 0x08, 0xac, 0x02, 0x10, 0x05},
+		},
+		{
+			// Map entries sorted by key
+			RepoMeta{Extra: map[string]string{"b": "2", "a": "1"}},
+			[]byte{0x22, 0x06, 0x0a, 0x01, 'a', 0x12, 0x01, '1', 0x22, 0x06, 0x0a, 0x01, 'b', 0x12, 0x01, '2'},
+		},
+	}
+
+	for _, test := range tests {
+		data, err := marshalProtobuf(test.body)
+		assert.NoError(t, err)
+		assert.Equal(t, test.want, data)
+	}
+
+	_, err := marshalProtobuf(&KitResponse{Data: 1.5})
+	assert.Error(t, err)
+}
+
+func Test_acceptsProtobuf(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", false},
+		{"application/x-protobuf", true},
+		{"application/x-protobuf, */*", true},
+		{"application/json, application/x-protobuf", false},
+		{"application/json;q=0.5, application/x-protobuf", true},
+		{"application/x-protobuf;q=0", false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/repos", nil)
+		r.Header.Set("Accept", test.accept)
+		assert.Equal(t, test.want, acceptsProtobuf(r), test.accept)
+	}
+}
+
+func TestProtobufResponse(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "test.git")
+	server := New(Config{Dir: dir})
+
+	r := httptest.NewRequest("GET", "/repos", nil)
+	r.Header.Set("Accept", "application/x-protobuf")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	want, _ := marshalProtobuf(&KitResponse{Code: 200, Data: KitListRepoResponse{RepoPath: []string{"test.git"}, Total: 1}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-protobuf", w.Header().Get("Content-Type"))
+	assert.Equal(t, want, w.Body.Bytes())
+
+	// JSON stays the default
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/repos", nil))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept", w.Header().Get("Vary"))
+}
+
+// Every message of gitkit.proto has to match the protobuf tags of its Go type,
+// *Reply messages the ones of KitResponse
+func TestProtoFile(t *testing.T) {
+	types := map[string]interface{}{
+		"KitRepoResponse":           KitRepoResponse{},
+		"KitListRepoResponse":       KitListRepoResponse{},
+		"KitRepoDetail":             KitRepoDetail{},
+		"KitRepoSizeResponse":       KitRepoSizeResponse{},
+		"KitDescriptionResponse":    KitDescriptionResponse{},
+		"KitErrorResponse":          KitErrorResponse{},
+		"KitReinstallHooksResponse": KitReinstallHooksResponse{},
+		"KitHooksFailure":           KitHooksFailure{},
+		"KitBranch":                 KitBranch{},
+		"KitTag":                    KitTag{},
+		"KitHeadResponse":           KitHeadResponse{},
+		"RefUpdate":                 RefUpdate{},
+		"KitSyncResponse":           KitSyncResponse{},
+		"KitHealthResponse":         KitHealthResponse{},
+		"KitCommit":                 KitCommit{},
+		"KitCompareResponse":        KitCompareResponse{},
+		"RepoMeta":                  RepoMeta{},
+	}
+
+	data, err := ioutil.ReadFile("gitkit.proto")
+	assert.NoError(t, err)
+	messages := regexp.MustCompile(`(?s)\nmessage (\w+) \{\n(.*?)\n\}`).FindAllStringSubmatch(string(data), -1)
+	fieldRegex := regexp.MustCompile(`^\s*(?:repeated )?\S+(?:, \S+)? (\w+) = (\d+);$`)
+
+	seen := map[string]bool{}
+	for _, message := range messages {
+		name := message[1]
+		var typ reflect.Type
+		if strings.HasSuffix(name, "Reply") {
+			typ = reflect.TypeOf(KitResponse{})
+		} else if v, ok := types[name]; ok {
+			typ = reflect.TypeOf(v)
+			seen[name] = true
+		} else {
+			t.Errorf("message %s has no Go type", name)
+			continue
+		}
+
+		fields := strings.Split(message[2], "\n")
+		assert.Equal(t, typ.NumField(), len(fields), name)
+		for _, line := range fields {
+			match := fieldRegex.FindStringSubmatch(line)
+			if !assert.NotNil(t, match, line) {
+				continue
+			}
+
+			// repo_path is RepoPath, old_sha OldSHA
+			field, ok := typ.FieldByNameFunc(func(goName string) bool {
+				return strings.ToLower(goName) == strings.Replace(match[1], "_", "", -1)
+			})
+			if assert.True(t, ok, "%s.%s has no Go field", name, match[1]) {
+				assert.Equal(t, match[2], field.Tag.Get("protobuf"), name+"."+match[1])
+			}
+		}
+	}
+
+	for name := range types {
+		assert.True(t, seen[name], "%s is missing from gitkit.proto", name)
+	}
+}
+
+func Test_marshalProtobufUntagged(t *testing.T) {
+	_, err := marshalProtobuf(struct{ Name string }{"untagged"})
+	assert.Error(t, err)
+
+	data, err := marshalProtobuf(struct {
+		Name string `protobuf:"3"`
+	}{"a"})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x1a, 0x01, 'a'}, data)
+}
@@ -0,0 +1,99 @@
+package gitkit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits how often clients make requests, see Server.RateLimiter
+type RateLimiter interface {
+	// Allow reports whether the client identified by key may make a request
+	// now. Otherwise it returns how long the client should wait.
+	Allow(key string) (bool, time.Duration)
+}
+
+// NewRateLimiter returns an in-memory token bucket limiter allowing bursts of
+// perMinute requests, refilled over a minute
+func NewRateLimiter(perMinute int) RateLimiter {
+	return &tokenBucketLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		now:     time.Now,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+type tokenBucketLimiter struct {
+	rate  float64 // Tokens added per second
+	burst float64 // Tokens of a full bucket
+	now   func() time.Time
+
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func (l *tokenBucketLimiter) Allow(key string) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep forgets the buckets that are full again, at most once a minute
+func (l *tokenBucketLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitKey identifies the client of a request for rate limiting, by user
+// when authenticated and by address otherwise
+func (s *Server) rateLimitKey(r *http.Request, cred Credential) string {
+	if cred.Scheme == CertificateScheme && cred.ClientCN != "" {
+		return "user:" + cred.ClientCN
+	}
+	if cred.Username != "" {
+		return "user:" + cred.Username
+	}
+	return "ip:" + s.clientIP(r)
+}
+
+// retryAfter formats a wait as the seconds of a Retry-After header
+func retryAfter(wait time.Duration) string {
+	seconds := int64(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
@@ -0,0 +1,69 @@
+package gitkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := NewRateLimiter(2).(*tokenBucketLimiter)
+	limiter.now = func() time.Time { return now }
+
+	allowed := func(key string) bool {
+		ok, _ := limiter.Allow(key)
+		return ok
+	}
+
+	assert.True(t, allowed("a"))
+	assert.True(t, allowed("a"))
+	ok, wait := limiter.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 30*time.Second, wait)
+
+	// Other clients have their own bucket
+	assert.True(t, allowed("b"))
+
+	// A token comes back every 30 seconds
+	now = now.Add(30 * time.Second)
+	assert.True(t, allowed("a"))
+	assert.False(t, allowed("a"))
+
+	// Full buckets are forgotten
+	now = now.Add(2 * time.Minute)
+	assert.True(t, allowed("a"))
+	assert.Len(t, limiter.buckets, 1)
+}
+
+func TestRateLimit(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "test.git")
+	server := New(Config{Dir: dir, RateLimit: 2, Auth: true})
+	server.AuthFunc = func(Credential, *Request) (bool, error) {
+		return true, nil
+	}
+
+	request := func(user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/test.git/repo/description", nil)
+		r.SetBasicAuth(user, "secret")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, request("alice").Code)
+	assert.Equal(t, http.StatusOK, request("alice").Code)
+
+	w := request("alice")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusOK, request("bob").Code)
+
+	// Anonymous clients are told apart by address
+	assert.Equal(t, "ip:192.0.2.1", server.rateLimitKey(httptest.NewRequest("GET", "/", nil), Credential{}))
+}
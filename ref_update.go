@@ -0,0 +1,72 @@
+package gitkit
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"strings"
+)
+
+// RefUpdate describes a single ref change requested by a push.
+// OldSHA is ZeroSHA for new refs and NewSHA is ZeroSHA for deleted ones.
+type RefUpdate struct {
+	OldSHA string `json:"oldSha" protobuf:"1"`
+	NewSHA string `json:"newSha" protobuf:"2"`
+	Ref    string `json:"ref" protobuf:"3"`
+}
+
+// parseRefUpdates extracts ref updates from receive-pack commands. Lines that
+// are not commands, such as shallow info or push certificate headers, are skipped.
+func parseRefUpdates(commands []pktLine) []RefUpdate {
+	updates := []RefUpdate{}
+	for _, line := range commands {
+		data := line.payload()
+		if i := bytes.IndexByte(data, 0); i != -1 {
+			data = data[:i]
+		}
+
+		chunks := strings.Fields(string(data))
+		if len(chunks) != 3 || !isSHA(chunks[0]) || !isSHA(chunks[1]) {
+			continue
+		}
+
+		updates = append(updates, RefUpdate{
+			OldSHA: chunks[0],
+			NewSHA: chunks[1],
+			Ref:    chunks[2],
+		})
+	}
+	return updates
+}
+
+// parseReportStatus returns the status of every ref listed in a
+// report-status response, true meaning that the ref was updated.
+func parseReportStatus(report io.Reader) map[string]bool {
+	status := map[string]bool{}
+	for {
+		line, err := readPktLine(report)
+		if err != nil || line.isFlush() {
+			return status
+		}
+
+		chunks := strings.Fields(string(line.payload()))
+		if len(chunks) < 2 {
+			continue
+		}
+
+		switch chunks[0] {
+		case "ok":
+			status[chunks[1]] = true
+		case "ng":
+			status[chunks[1]] = false
+		}
+	}
+}
+
+func isSHA(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
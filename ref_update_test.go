@@ -0,0 +1,44 @@
+package gitkit
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseRefUpdates(t *testing.T) {
+	oldSHA := "e285100b636ac67fa28d85685072158edaa01685"
+	newSHA := "a3d33576d686e7dc1d90ec4b1a6e94e760a893b2"
+
+	w := bytes.NewBuffer([]byte{})
+	packLine(w, "shallow "+oldSHA)
+	packLine(w, oldSHA+" "+newSHA+" refs/heads/master\x00report-status side-band-64k atomic\n")
+	packLine(w, ZeroSHA+" "+newSHA+" refs/heads/feature\n")
+	packLine(w, oldSHA+" "+ZeroSHA+" refs/tags/v1\n")
+	packFlush(w)
+
+	commands, err := readPktSection(w)
+	assert.NoError(t, err)
+	assert.Equal(t, []RefUpdate{
+		{OldSHA: oldSHA, NewSHA: newSHA, Ref: "refs/heads/master"},
+		{OldSHA: ZeroSHA, NewSHA: newSHA, Ref: "refs/heads/feature"},
+		{OldSHA: oldSHA, NewSHA: ZeroSHA, Ref: "refs/tags/v1"},
+	}, parseRefUpdates(commands))
+}
+
+func Test_parseReportStatus(t *testing.T) {
+	w := bytes.NewBuffer([]byte{})
+	packLine(w, "unpack ok\n")
+	packLine(w, "ok refs/heads/master\n")
+	packLine(w, "ng refs/heads/blocked hook declined\n")
+	packFlush(w)
+
+	assert.Equal(t, map[string]bool{
+		"refs/heads/master":  true,
+		"refs/heads/blocked": false,
+	}, parseReportStatus(w))
+
+	assert.Equal(t, map[string]bool{}, parseReportStatus(strings.NewReader("")))
+}
@@ -0,0 +1,139 @@
+package gitkit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type KitBranch struct {
+	Name string `json:"name" protobuf:"1"`
+	SHA  string `json:"sha" protobuf:"2"`
+}
+
+// KitTag describes a tag, SHA is the commit it points to for annotated tags
+type KitTag struct {
+	Name      string `json:"name" protobuf:"1"`
+	SHA       string `json:"sha" protobuf:"2"`
+	Annotated bool   `json:"annotated" protobuf:"3"`
+}
+
+type KitSetHeadRequest struct {
+	Ref string `json:"ref"` // e.g. "refs/heads/develop" or "develop"
+}
+
+type KitHeadResponse struct {
+	RepoPath string `json:"repoPath" protobuf:"1"`
+	Head     string `json:"head" protobuf:"2"`
+}
+
+func (s *Server) listBranches(_ string, w http.ResponseWriter, r *Request) error {
+	lines, err := s.forEachRef(r.Context(), r.RepoPath, "refs/heads", "%(refname:lstrip=2) %(objectname)")
+	if err != nil {
+		s.fail500(w, r.Request, "list branches", err)
+		return err
+	}
+
+	branches := []KitBranch{}
+	for _, line := range lines {
+		chunks := strings.Fields(line)
+		if len(chunks) != 2 {
+			continue
+		}
+		branches = append(branches, KitBranch{Name: chunks[0], SHA: chunks[1]})
+	}
+
+	body := &KitResponse{
+		Data: branches,
+	}
+	s.formatResponse(w, r.Request, body, http.StatusOK)
+	return nil
+}
+
+func (s *Server) listTags(_ string, w http.ResponseWriter, r *Request) error {
+	lines, err := s.forEachRef(r.Context(), r.RepoPath, "refs/tags", "%(refname:lstrip=2) %(objecttype) %(objectname) %(*objectname)")
+	if err != nil {
+		s.fail500(w, r.Request, "list tags", err)
+		return err
+	}
+
+	tags := []KitTag{}
+	for _, line := range lines {
+		chunks := strings.Fields(line)
+		if len(chunks) < 3 {
+			continue
+		}
+
+		tag := KitTag{Name: chunks[0], SHA: chunks[2]}
+		if chunks[1] == "tag" && len(chunks) == 4 {
+			tag.SHA = chunks[3]
+			tag.Annotated = true
+		}
+		tags = append(tags, tag)
+	}
+
+	body := &KitResponse{
+		Data: tags,
+	}
+	s.formatResponse(w, r.Request, body, http.StatusOK)
+	return nil
+}
+
+// setHead points HEAD, and so the default branch, to an existing branch
+func (s *Server) setHead(_ string, w http.ResponseWriter, r *Request) error {
+	params := KitSetHeadRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		s.logError(r.Request, "set head", err)
+		s.formatResponse(w, r.Request, &KitResponse{}, http.StatusBadRequest)
+		return nil
+	}
+
+	ref := params.Ref
+	if !strings.HasPrefix(ref, "refs/") {
+		ref = "refs/heads/" + ref
+	}
+	if !strings.HasPrefix(ref, "refs/heads/") || !validBranchName(s.config.GitPath, strings.TrimPrefix(ref, "refs/heads/")) {
+		s.logError(r.Request, "set head", fmt.Errorf("invalid branch %q", params.Ref))
+		s.formatResponse(w, r.Request, &KitResponse{}, http.StatusBadRequest)
+		return nil
+	}
+
+	body := &KitResponse{
+		Data: KitHeadResponse{
+			RepoPath: r.RepoName,
+			Head:     ref,
+		},
+	}
+
+	if _, err := s.gitOutput(r.Context(), "--git-dir", r.RepoPath, "show-ref", "--verify", "--quiet", ref); err != nil {
+		s.formatResponse(w, r.Request, body, http.StatusNotFound)
+		return nil
+	}
+
+	if _, err := s.gitOutput(r.Context(), "--git-dir", r.RepoPath, "symbolic-ref", "HEAD", ref); err != nil {
+		s.fail500(w, r.Request, "set head", err)
+		return err
+	}
+
+	s.formatResponse(w, r.Request, body, http.StatusOK)
+	return nil
+}
+
+// forEachRef lists the refs of a repository matching pattern, one line per
+// ref formatted as requested
+func (s *Server) forEachRef(ctx context.Context, repoPath string, pattern string, format string) ([]string, error) {
+	out, err := s.gitOutput(ctx, "--git-dir", repoPath, "for-each-ref", "--format="+format, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
@@ -0,0 +1,137 @@
+package gitkit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListBranches(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+	out, err := runGit(filepath.Join(dir, "work"), "push", "-q", ts.URL+"/test.git", "HEAD:refs/heads/feature/x")
+	assert.NoError(t, err, out)
+	head, err := runGit(filepath.Join(dir, "work"), "rev-parse", "HEAD")
+	assert.NoError(t, err, head)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/empty.git/repo", nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	branches := func(name string) (int, []KitBranch) {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/"+name+"/repo/branches", nil))
+
+		body := struct {
+			Data []KitBranch `json:"data"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body.Data
+	}
+
+	code, list := branches("test.git")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []KitBranch{
+		{Name: "feature/x", SHA: strings.TrimSpace(head)},
+		{Name: "master", SHA: strings.TrimSpace(head)},
+	}, list)
+
+	// Repositories without branches have an empty list
+	code, list = branches("empty.git")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []KitBranch{}, list)
+
+	code, _ = branches("missing.git")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestListTags(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+	work := filepath.Join(dir, "work")
+	for _, args := range [][]string{
+		{"tag", "v1.0"},
+		{"tag", "-a", "-m", "release", "v1.1"},
+		{"push", "-q", ts.URL + "/test.git", "--tags"},
+	} {
+		out, err := runGit(work, args...)
+		assert.NoError(t, err, out)
+	}
+	head, err := runGit(work, "rev-parse", "HEAD")
+	assert.NoError(t, err, head)
+	head = strings.TrimSpace(head)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/test.git/repo/tags", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	body := struct {
+		Data []KitTag `json:"data"`
+	}{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, []KitTag{
+		{Name: "v1.0", SHA: head},
+		{Name: "v1.1", SHA: head, Annotated: true},
+	}, body.Data)
+}
+
+func TestSetHead(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	server := New(Config{Dir: repos, AutoCreate: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+	out, err := runGit(filepath.Join(dir, "work"), "push", "-q", ts.URL+"/test.git", "HEAD:refs/heads/develop")
+	assert.NoError(t, err, out)
+
+	setHead := func(body string) (int, KitHeadResponse) {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("POST", "/test.git/repo/head", strings.NewReader(body)))
+
+		res := struct {
+			Data KitHeadResponse `json:"data"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res.Data
+	}
+	head := func() string {
+		out, err := runGit(dir, "--git-dir", filepath.Join(repos, "test.git"), "symbolic-ref", "HEAD")
+		assert.NoError(t, err, out)
+		return strings.TrimSpace(out)
+	}
+
+	code, res := setHead(`{"ref": "refs/heads/develop"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "refs/heads/develop", res.Head)
+	assert.Equal(t, "refs/heads/develop", head())
+
+	// Short branch names work too
+	code, res = setHead(`{"ref": "master"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "refs/heads/master", res.Head)
+	assert.Equal(t, "refs/heads/master", head())
+
+	code, _ = setHead(`{"ref": "refs/heads/missing"}`)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	for _, body := range []string{`{"ref": "refs/tags/v1"}`, `{"ref": ""}`, `{"ref": "bad..name"}`, `not json`} {
+		code, _ = setHead(body)
+		assert.Equal(t, http.StatusBadRequest, code, body)
+	}
+	assert.Equal(t, "refs/heads/master", head())
+}
@@ -0,0 +1,46 @@
+package gitkit
+
+// UpdateConfig replaces the configuration of the server while it runs, e.g.
+// to change authentication settings or repository directories. cfg is
+// validated like New does and set up with Setup first, the configuration is
+// left as it is if either fails.
+//
+// Requests that have started keep the configuration they started with, the
+// following ones get the new one. Every field can be changed this way except
+// RateLimit, the limiter is set up by New. KeyDir, GitUser and the other
+// fields only used by the SSH server have no effect here. Cached decisions
+// of AuthFunc and ref advertisements are dropped, as they may not hold under
+// the new settings.
+func (s *Server) UpdateConfig(cfg Config) error {
+	next := s.snapshot()
+	if err := next.configure(cfg); err != nil {
+		return err
+	}
+	if err := next.Setup(); err != nil {
+		return err
+	}
+
+	s.configLock.Lock()
+	s.config = next.config
+	s.services = next.services
+	s.disabledServices = next.disabledServices
+	s.repoNameRegex = next.repoNameRegex
+	s.allowedNets = next.allowedNets
+	s.deniedNets = next.deniedNets
+	s.configLock.Unlock()
+
+	s.authCache.clear()
+	s.advertiseCache.clear()
+	return nil
+}
+
+// snapshot returns a copy of the server to serve a request, or run an
+// operation, with the current configuration from start to end. The copy
+// shares locks, processes in flight and caches with s.
+func (s *Server) snapshot() *Server {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	c := *s
+	return &c
+}
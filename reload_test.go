@@ -0,0 +1,72 @@
+package gitkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateConfig(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: dir})
+
+	create := func(name string) int {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("POST", "/"+name+"/repo", nil))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusCreated, create("first.git"))
+
+	assert.NoError(t, server.UpdateConfig(Config{Dir: dir, ReadOnly: true}))
+	assert.Equal(t, http.StatusForbidden, create("second.git"))
+	assert.False(t, server.RepoExists("second.git"))
+
+	assert.NoError(t, server.UpdateConfig(Config{Dir: dir}))
+	assert.Equal(t, http.StatusCreated, create("second.git"))
+
+	// Invalid configurations are refused and the current one is kept
+	assert.Error(t, server.UpdateConfig(Config{Dir: dir, ReadOnly: true, GzipLevel: 42}))
+	assert.Error(t, server.UpdateConfig(Config{Dir: filepath.Join(dir, "missing"), ReadOnly: true}))
+	assert.Equal(t, http.StatusCreated, create("third.git"))
+}
+
+func TestUpdateConfigInFlight(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: dir, Auth: true})
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	server.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		if req.RepoName == "slow.git" {
+			close(entered)
+			<-release
+		}
+		return true, nil
+	}
+
+	create := func(name string) int {
+		r := httptest.NewRequest("POST", "/"+name+"/repo", nil)
+		r.SetBasicAuth("alice", "secret")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	done := make(chan int)
+	go func() {
+		done <- create("slow.git")
+	}()
+	<-entered
+
+	// Only names starting with "new-" are allowed from now on
+	assert.NoError(t, server.UpdateConfig(Config{Dir: dir, Auth: true, RepoNamePattern: `^new-.*\.git$`}))
+	assert.Equal(t, http.StatusBadRequest, create("other.git"))
+	assert.Equal(t, http.StatusCreated, create("new-repo.git"))
+
+	// The request that started before the update keeps its configuration
+	close(release)
+	assert.Equal(t, http.StatusCreated, <-done)
+}
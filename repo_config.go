@@ -0,0 +1,190 @@
+package gitkit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RepoMeta holds the settings of a repository, stored in gitkit.json inside
+// it. Gitkit keeps the visibility and extra settings for applications built
+// on it and does not act on them. The default branch is the one HEAD points
+// to and the description is the description file, so they stay in sync with
+// POST /repo/head and GET /repo/description.
+type RepoMeta struct {
+	Visibility    string `json:"visibility" protobuf:"1"` // e.g. "public" or "private"
+	DefaultBranch string `json:"defaultBranch" protobuf:"2"`
+	Description   string `json:"description" protobuf:"3"`
+
+	// Settings of the application, by name
+	Extra map[string]string `json:"extra,omitempty" protobuf:"4"`
+}
+
+// ErrInvalidBranchName is returned by SetRepoConfig for default branches git
+// does not accept
+var ErrInvalidBranchName = errors.New("invalid branch name")
+
+// Name of the settings file in repositories
+const repoMetaFile = "gitkit.json"
+
+// Start of the description git init writes, which is no description
+const defaultDescription = "Unnamed repository;"
+
+// RepoConfig returns the settings of a repository. Repositories without
+// settings, or with a file that cannot be read, get the defaults: no
+// visibility and the branch of HEAD, or Config.DefaultBranch if HEAD does
+// not point to a branch. It fails with ErrInvalidRepoName or
+// ErrRepoNotFound.
+func (s *Server) RepoConfig(name string) (RepoMeta, error) {
+	s = s.snapshot()
+	_, repoPath, ok := s.resolveRepo(name)
+	if !ok {
+		return RepoMeta{}, ErrInvalidRepoName
+	}
+
+	lock := s.repoLock(repoPath)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	if !repoExists(repoPath) {
+		return RepoMeta{}, ErrRepoNotFound
+	}
+	return s.readRepoMeta(repoPath), nil
+}
+
+// SetRepoConfig replaces the settings of a repository, HEAD points to the
+// default branch afterwards unless it is empty. It fails with
+// ErrInvalidRepoName, ErrRepoNotFound or ErrInvalidBranchName.
+func (s *Server) SetRepoConfig(name string, meta RepoMeta) error {
+	s = s.snapshot()
+	_, repoPath, ok := s.resolveRepo(name)
+	if !ok {
+		return ErrInvalidRepoName
+	}
+
+	lock := s.repoLock(repoPath)
+	lock.Lock()
+	defer lock.Unlock()
+	defer s.advertiseCache.invalidate(repoPath)
+
+	if !repoExists(repoPath) {
+		return ErrRepoNotFound
+	}
+	return s.writeRepoConfig(context.Background(), repoPath, meta)
+}
+
+// getRepoConfig serves GET /repo/config
+func (s *Server) getRepoConfig(_ string, w http.ResponseWriter, r *Request) error {
+	s.formatResponse(w, r.Request, &KitResponse{Data: s.readRepoMeta(r.RepoPath)}, http.StatusOK)
+	return nil
+}
+
+// setRepoConfig serves PUT /repo/config, the body replaces the settings
+func (s *Server) setRepoConfig(_ string, w http.ResponseWriter, r *Request) error {
+	meta := RepoMeta{}
+	if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+		s.logError(r.Request, "set repo config", err)
+		s.formatResponse(w, r.Request, &KitResponse{}, http.StatusBadRequest)
+		return nil
+	}
+
+	err := s.writeRepoConfig(r.Context(), r.RepoPath, meta)
+	if err == ErrInvalidBranchName {
+		s.logError(r.Request, "set repo config", fmt.Errorf("invalid branch %q", meta.DefaultBranch))
+		s.formatResponse(w, r.Request, &KitResponse{}, http.StatusBadRequest)
+		return nil
+	}
+	if err != nil {
+		s.fail500(w, r.Request, "set repo config", err)
+		return err
+	}
+
+	s.formatResponse(w, r.Request, &KitResponse{Data: s.readRepoMeta(r.RepoPath)}, http.StatusOK)
+	return nil
+}
+
+// readRepoMeta reads the settings of a repository, falling back to the
+// defaults if they are missing or corrupt
+func (s *Server) readRepoMeta(repoPath string) RepoMeta {
+	meta := RepoMeta{DefaultBranch: s.config.DefaultBranch}
+
+	data, err := ioutil.ReadFile(filepath.Join(repoPath, repoMetaFile))
+	if err == nil {
+		stored := RepoMeta{}
+		if err := json.Unmarshal(data, &stored); err != nil {
+			s.logError(nil, "repo config", err)
+		} else {
+			meta = stored
+		}
+	} else if !os.IsNotExist(err) {
+		s.logError(nil, "repo config", err)
+	}
+
+	// Git has the last word on what it keeps itself
+	if head, err := ioutil.ReadFile(filepath.Join(repoPath, "HEAD")); err == nil {
+		if branch := strings.TrimPrefix(strings.TrimSpace(string(head)), "ref: refs/heads/"); branch != strings.TrimSpace(string(head)) {
+			meta.DefaultBranch = branch
+		}
+	}
+	description, _ := ioutil.ReadFile(filepath.Join(repoPath, "description"))
+	meta.Description = strings.TrimSpace(string(description))
+	if strings.HasPrefix(meta.Description, defaultDescription) {
+		meta.Description = ""
+	}
+	return meta
+}
+
+// writeRepoConfig points HEAD to the default branch, unless it is empty,
+// writes the description file and stores the settings
+func (s *Server) writeRepoConfig(ctx context.Context, repoPath string, meta RepoMeta) error {
+	if meta.DefaultBranch != "" {
+		if !validBranchName(s.config.GitPath, meta.DefaultBranch) {
+			return ErrInvalidBranchName
+		}
+		if _, err := s.gitOutput(ctx, "--git-dir", repoPath, "symbolic-ref", "HEAD", "refs/heads/"+meta.DefaultBranch); err != nil {
+			return err
+		}
+	}
+
+	description := ""
+	if meta.Description != "" {
+		description = meta.Description + "\n"
+	}
+	if err := ioutil.WriteFile(filepath.Join(repoPath, "description"), []byte(description), 0644); err != nil {
+		return err
+	}
+	return writeRepoMeta(repoPath, meta)
+}
+
+// writeRepoMeta stores the settings of a repository. The file is replaced
+// at once, so that readers never see part of it.
+func writeRepoMeta(repoPath string, meta RepoMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(repoPath, repoMetaFile+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(repoPath, repoMetaFile))
+}
@@ -0,0 +1,117 @@
+package gitkit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepoConfig(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: dir, DefaultBranch: "main"})
+	assert.NoError(t, server.CreateRepo("test.git"))
+
+	// Missing settings get the defaults
+	meta, err := server.RepoConfig("test.git")
+	assert.NoError(t, err)
+	assert.Equal(t, RepoMeta{DefaultBranch: "main"}, meta)
+
+	want := RepoMeta{
+		Visibility:    "private",
+		DefaultBranch: "develop",
+		Description:   "Test repository",
+		Extra:         map[string]string{"owner": "alice"},
+	}
+	assert.NoError(t, server.SetRepoConfig("test.git", want))
+	meta, err = server.RepoConfig("test.git")
+	assert.NoError(t, err)
+	assert.Equal(t, want, meta)
+
+	// The branch and description are those of git
+	head, _ := ioutil.ReadFile(filepath.Join(dir, "test.git", "HEAD"))
+	assert.Equal(t, "ref: refs/heads/develop\n", string(head))
+	description, _ := ioutil.ReadFile(filepath.Join(dir, "test.git", "description"))
+	assert.Equal(t, "Test repository\n", string(description))
+
+	out, err := runGit(dir, "--git-dir", filepath.Join(dir, "test.git"), "symbolic-ref", "HEAD", "refs/heads/release")
+	assert.NoError(t, err, out)
+	meta, err = server.RepoConfig("test.git")
+	assert.NoError(t, err)
+	assert.Equal(t, "release", meta.DefaultBranch)
+
+	// Corrupt settings get the defaults
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "test.git", "gitkit.json"), []byte("{"), 0644))
+	meta, err = server.RepoConfig("test.git")
+	assert.NoError(t, err)
+	assert.Equal(t, RepoMeta{DefaultBranch: "release", Description: "Test repository"}, meta)
+
+	_, err = server.RepoConfig("missing.git")
+	assert.Equal(t, ErrRepoNotFound, err)
+	assert.Equal(t, ErrRepoNotFound, server.SetRepoConfig("missing.git", want))
+	assert.Equal(t, ErrInvalidRepoName, server.SetRepoConfig("../test.git", want))
+	assert.Equal(t, ErrInvalidBranchName, server.SetRepoConfig("test.git", RepoMeta{DefaultBranch: "bad..branch"}))
+}
+
+func TestRepoConfigHTTP(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: dir})
+
+	request := func(method string, body string) (int, RepoMeta) {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(method, "/test.git/repo/config", bytes.NewBufferString(body)))
+
+		var resp struct {
+			Data RepoMeta `json:"data"`
+		}
+		if w.Code == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		}
+		return w.Code, resp.Data
+	}
+
+	// Created repositories start with their branch and description
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/test.git/repo", bytes.NewBufferString(`{"defaultBranch":"trunk","description":"Test"}`)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	code, meta := request("GET", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, RepoMeta{DefaultBranch: "trunk", Description: "Test"}, meta)
+
+	code, meta = request("PUT", `{"visibility":"public","defaultBranch":"trunk","extra":{"topic":"go"}}`)
+	assert.Equal(t, http.StatusOK, code)
+	want := RepoMeta{Visibility: "public", DefaultBranch: "trunk", Extra: map[string]string{"topic": "go"}}
+	assert.Equal(t, want, meta)
+
+	code, meta = request("GET", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, want, meta)
+
+	code, _ = request("PUT", "{")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = request("PUT", `{"defaultBranch":"bad..branch"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// The description is the one of GET /repo/description
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("PUT", "/test.git/repo/config", bytes.NewBufferString(`{"defaultBranch":"trunk","description":"Updated"}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/test.git/repo/description", nil))
+	assert.Contains(t, w.Body.String(), `"description":"Updated"`)
+	want = RepoMeta{DefaultBranch: "trunk", Description: "Updated"}
+
+	// Settings cannot be changed on read-only servers
+	assert.NoError(t, server.UpdateConfig(Config{Dir: dir, ReadOnly: true}))
+	code, _ = request("PUT", `{"visibility":"private"}`)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, meta = request("GET", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, want, meta)
+}
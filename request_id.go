@@ -0,0 +1,48 @@
+package gitkit
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/gofrs/uuid"
+)
+
+// RequestIDHeader carries the ID of a request, it is taken from the client
+// when present and echoed in the response
+const RequestIDHeader = "X-Request-ID"
+
+// Request IDs accepted from clients, anything else is replaced so that IDs
+// are safe to log
+var requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// withRequestID tags the request with the ID sent by the client, or a new
+// one, and sets the response header
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(RequestIDHeader)
+	if !requestIDRegex.MatchString(id) {
+		id = newRequestID()
+	}
+
+	w.Header().Set(RequestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+func newRequestID() string {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return ""
+	}
+	return id.String()
+}
+
+// requestID returns the ID of the request, if any
+func requestID(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,124 @@
+package gitkit
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// roots returns the directories repositories are stored in, see Config.Dirs
+func (c *Config) roots() []string {
+	if len(c.Dirs) > 0 {
+		return c.Dirs
+	}
+	return []string{c.Dir}
+}
+
+// findRoot returns the root of the first repository found at namespace/name,
+// or the root new repositories are created in if there is none
+func (s *Server) findRoot(namespace string, name string) string {
+	roots := s.config.roots()
+	if len(roots) == 1 {
+		return roots[0]
+	}
+
+	for _, root := range roots {
+		if repoExists(path.Join(root, namespace, name)) {
+			return root
+		}
+	}
+	return s.createRoot()
+}
+
+// repoDirName returns the name of the directory of the repository
+// namespace/name. Like git daemon, names without Config.BareSuffix resolve to
+// the repository with it unless there is one of their own, e.g. "project" to
+// "project.git".
+func (s *Server) repoDirName(namespace string, name string) string {
+	suffix := s.config.bareSuffix()
+	if suffix == "" || strings.HasSuffix(name, suffix) {
+		return name
+	}
+
+	roots := s.config.roots()
+	for _, root := range roots {
+		if repoExists(path.Join(root, namespace, name)) {
+			return name
+		}
+	}
+	for _, root := range roots {
+		if repoExists(path.Join(root, namespace, name+suffix)) {
+			return name + suffix
+		}
+	}
+	return name
+}
+
+// createRoot returns the first writable root, or the first root if none is
+func (s *Server) createRoot() string {
+	roots := s.config.roots()
+	for _, root := range roots {
+		if checkWritable(root) == nil {
+			return root
+		}
+	}
+	return roots[0]
+}
+
+// rootOf returns the root containing repoPath, if any
+func (s *Server) rootOf(repoPath string) string {
+	for _, root := range s.config.roots() {
+		if isSubPath(root, repoPath) {
+			return root
+		}
+	}
+	return ""
+}
+
+// listRepos returns the names of the repositories of all roots. Repositories
+// of earlier roots hide the ones with the same name in later roots. With
+// Config.RepoPathFunc only the repositories stored where it puts them are
+// listed, as the names of the others are not served.
+func (s *Server) listRepos() ([]string, error) {
+	seen := map[string]bool{}
+	repos := []string{}
+	for _, root := range s.config.roots() {
+		found, err := findRepos(root, "", s.config.bareSuffix(), s.config.MaxListDepth)
+		if os.IsNotExist(err) {
+			// Nothing has been created yet
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, repo := range found {
+			if s.config.RepoPathFunc != nil && !s.servesRepo(root, repo) {
+				continue
+			}
+			if !seen[repo] {
+				seen[repo] = true
+				repos = append(repos, repo)
+			}
+		}
+	}
+	return repos, nil
+}
+
+// servesRepo reports whether requests for the repository found at root/repo
+// are served from there
+func (s *Server) servesRepo(root string, repo string) bool {
+	namespace, name := getNamespaceAndRepo(repo)
+	return path.Clean(s.repoPath(namespace, name)) == path.Join(root, repo)
+}
+
+// checkWritable fails unless files can be created in dir
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".gitkit-write-check")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
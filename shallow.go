@@ -0,0 +1,55 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Depth git clients send to fetch full history, e.g. with --unshallow
+const infiniteDepth = 0x7fffffff
+
+// checkDeepen returns an error if the upload-pack request asks for history
+// deeper than max commits. deepen-since and deepen-not requests are rejected
+// since their depth cannot be told up front, requests without deepen lines
+// or for full history are accepted. Both protocol versions send the
+// arguments before the first flush-pkt.
+func checkDeepen(lines []pktLine, max int) error {
+	for _, line := range lines {
+		data := line.payload()
+		if i := bytes.IndexByte(data, 0); i != -1 {
+			data = data[:i]
+		}
+		arg := strings.TrimSuffix(string(data), "\n")
+
+		switch {
+		case strings.HasPrefix(arg, "deepen "):
+			depth, err := strconv.Atoi(strings.TrimPrefix(arg, "deepen "))
+			if err != nil || depth >= infiniteDepth {
+				continue
+			}
+			if depth > max {
+				return fmt.Errorf("shallow fetches are limited to a depth of %d", max)
+			}
+		case strings.HasPrefix(arg, "deepen-since "), strings.HasPrefix(arg, "deepen-not "):
+			return fmt.Errorf("shallow fetches by date or ref are not allowed, use a depth of at most %d", max)
+		}
+	}
+	return nil
+}
+
+// checkFilter returns an error if the upload-pack request has a filter for a
+// partial clone, e.g. "filter blob:none", and those are not allowed. Clients
+// only send one when upload-pack has advertised the capability.
+func checkFilter(lines []pktLine, allowed bool) error {
+	if allowed {
+		return nil
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(string(line.payload()), "filter ") {
+			return fmt.Errorf("partial clones are not allowed, clone without --filter")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package gitkit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_checkDeepen(t *testing.T) {
+	want := "want 0123456789012345678901234567890123456789\x00multi_ack side-band-64k\n"
+
+	tests := []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{want}, true},
+		{[]string{want, "deepen 1\n"}, true},
+		{[]string{want, "deepen 3\n"}, true},
+		{[]string{want, "deepen 4\n"}, false},
+		{[]string{want, "deepen 2147483647\n"}, true},
+		{[]string{want, "deepen-since 1700000000\n"}, false},
+		{[]string{want, "deepen-not refs/heads/old\n"}, false},
+		{[]string{"command=fetch\n", "agent=git/2.40.0\n", "", "deepen 10\n"}, false},
+		{[]string{"command=fetch\n", "", "deepen 2\n", "deepen-relative\n"}, true},
+	}
+
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		for _, arg := range test.args {
+			if arg == "" {
+				buf.WriteString("0001")
+				continue
+			}
+			packLine(buf, arg)
+		}
+		packFlush(buf)
+
+		lines, err := readPktSection(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, test.ok, checkDeepen(lines, 3) == nil, test.args)
+	}
+}
+
+func TestMaxCloneDepth(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewServer(New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true, ProtocolV2: true, MaxCloneDepth: 1}))
+	defer server.Close()
+
+	pushSampleCommit(t, dir, server.URL+"/test.git")
+	url := server.URL + "/test.git"
+
+	out, err := runGit(dir, "clone", "-q", "--depth", "1", url, "shallow")
+	assert.NoError(t, err, out)
+
+	out, err = runGit(dir, "clone", "-q", url, "full")
+	assert.NoError(t, err, out)
+
+	for _, version := range []string{"0", "2"} {
+		out, err = runGit(dir, "-c", "protocol.version="+version, "clone", "-q", "--depth", "2", url, "deep-v"+version)
+		assert.Error(t, err)
+		assert.Contains(t, out, "shallow fetches are limited to a depth of 1", version)
+
+		out, err = runGit(dir, "-c", "protocol.version="+version, "clone", "-q", "--shallow-since", "2000-01-01", url, "since-v"+version)
+		assert.Error(t, err)
+		assert.Contains(t, out, "shallow fetches by date or ref are not allowed", version)
+	}
+}
+
+func TestPartialClone(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewServer(New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true, ProtocolV2: true}))
+	defer server.Close()
+
+	pushSampleCommit(t, dir, server.URL+"/test.git")
+
+	clone := filepath.Join(dir, "clone-v2")
+	out, err := runGit(dir, "-c", "protocol.version=2", "clone", "-q", "--filter=blob:none", server.URL+"/test.git", clone)
+	assert.NoError(t, err, out)
+	assert.NotContains(t, out, "filtering not recognized")
+
+	// Blobs are fetched on demand for the checkout
+	content, err := ioutil.ReadFile(filepath.Join(clone, "README"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(content))
+	out, _ = runGit(clone, "config", "remote.origin.partialclonefilter")
+	assert.Equal(t, "blob:none\n", out)
+
+	// Protocol v0 clients could not fetch the missing blobs by id, they get
+	// full clones
+	clone = filepath.Join(dir, "clone-v0")
+	out, err = runGit(dir, "-c", "protocol.version=0", "clone", "--filter=blob:none", server.URL+"/test.git", clone)
+	assert.NoError(t, err, out)
+	assert.Contains(t, out, "filtering not recognized by server")
+	content, err = ioutil.ReadFile(filepath.Join(clone, "README"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(content))
+}
+
+func TestDisablePartialClone(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewServer(New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true, ProtocolV2: true, DisablePartialClone: true}))
+	defer server.Close()
+
+	pushSampleCommit(t, dir, server.URL+"/test.git")
+
+	// Clients fall back to full clones
+	for _, version := range []string{"0", "2"} {
+		clone := filepath.Join(dir, "clone-v"+version)
+		out, err := runGit(dir, "-c", "protocol.version="+version, "clone", "--filter=blob:none", server.URL+"/test.git", clone)
+		assert.NoError(t, err, out)
+		assert.Contains(t, out, "filtering not recognized by server", version)
+	}
+
+	// Filters sent anyway are rejected
+	head, _ := runGit(filepath.Join(dir, "work"), "rev-parse", "HEAD")
+	body := &bytes.Buffer{}
+	packLine(body, "command=fetch\n")
+	body.WriteString("0001")
+	packLine(body, "want "+head[:40]+"\n")
+	packLine(body, "filter blob:none\n")
+	packLine(body, "done\n")
+	packFlush(body)
+
+	req, _ := http.NewRequest("POST", server.URL+"/test.git/git-upload-pack", body)
+	req.Header.Set("Git-Protocol", "version=2")
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Contains(t, string(data), "ERR partial clones are not allowed")
+	}
+}
@@ -0,0 +1,121 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+)
+
+// Shutdown gracefully shuts down the server. New requests are rejected with
+// 503 Service Unavailable while the git processes of the ones in flight,
+// pushes included, are allowed to run to completion. No new git process is
+// started, requests in flight that need one more fail. If ctx expires first,
+// the git processes that are still running are killed and the context's
+// error is returned.
+//
+// Killing receive-pack while it is still reading the pack leaves the refs of
+// the repository untouched. Refs that git has already updated at that point
+// are not rolled back, so a deadline generous enough for pushes to finish is
+// preferable.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	s.closing = true
+	s.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.lock.Lock()
+		for cmd := range s.commands {
+			killProcessGroup(cmd)
+		}
+		s.lock.Unlock()
+		return ctx.Err()
+	}
+}
+
+// beginRequest registers a request with the server, it returns false once
+// the server is shutting down. Every successful call must be matched with a
+// call to s.active.Done().
+func (s *Server) beginRequest() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closing {
+		return false
+	}
+	s.active.Add(1)
+	return true
+}
+
+// errShuttingDown is returned by startCommand once Shutdown has been called
+var errShuttingDown = errors.New("server is shutting down")
+
+// startCommand starts cmd and keeps track of it until releaseCommand is
+// called, so that Shutdown can kill it. No command is started once the
+// server is shutting down, Shutdown could not kill it anymore.
+func (s *Server) startCommand(cmd *exec.Cmd) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closing {
+		return errShuttingDown
+	}
+	if err := cmd.Start(); err != nil {
+		return gitStartError(s.config.GitPath, err)
+	}
+
+	if s.commands == nil {
+		s.commands = map[*exec.Cmd]struct{}{}
+	}
+	s.commands[cmd] = struct{}{}
+	return nil
+}
+
+func (s *Server) releaseCommand(cmd *exec.Cmd) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.commands, cmd)
+}
+
+// acquireProc takes a slot for a git transfer, one of Config.MaxConcurrentPushes
+// for pushes and of Config.MaxConcurrentProcs otherwise. It returns false if
+// none is free. Every successful call must be matched with a call to
+// releaseProc.
+func (s *Server) acquireProc(push bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if push {
+		if s.config.MaxConcurrentPushes > 0 && s.pushes >= s.config.MaxConcurrentPushes {
+			return false
+		}
+		s.pushes++
+		return true
+	}
+
+	if s.config.MaxConcurrentProcs > 0 && s.procs >= s.config.MaxConcurrentProcs {
+		return false
+	}
+	s.procs++
+	return true
+}
+
+func (s *Server) releaseProc(push bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if push {
+		s.pushes--
+		return
+	}
+	s.procs--
+}
@@ -10,7 +10,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"os/exec"
@@ -38,6 +37,7 @@ type SSH struct {
 	sshconfig           *ssh.ServerConfig
 	config              *Config
 	PublicKeyLookupFunc func(string) (*PublicKey, error)
+	Logger              Logger
 }
 
 func NewSSH(config Config) *SSH {
@@ -50,6 +50,13 @@ func NewSSH(config Config) *SSH {
 	return s
 }
 
+func (s *SSH) logger() Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return defaultLogger
+}
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil || os.IsExist(err)
@@ -89,7 +96,7 @@ func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel) {
 
 		ch, reqs, err := newChan.Accept()
 		if err != nil {
-			log.Printf("error accepting channel: %v", err)
+			s.logger().Errorf("ssh: error accepting channel: %v", err)
 			continue
 		}
 
@@ -101,30 +108,30 @@ func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel) {
 
 				switch req.Type {
 				case "env":
-					log.Printf("ssh: incoming env request: %s\n", payload)
+					s.logger().Infof("ssh: incoming env request: %s", payload)
 
 					args := strings.Split(strings.Replace(payload, "\x00", "", -1), "\v")
 					if len(args) != 2 {
-						log.Printf("env: invalid env arguments: '%#v'", args)
+						s.logger().Errorf("env: invalid env arguments: '%#v'", args)
 						continue
 					}
 
 					args[0] = strings.TrimLeft(args[0], "\x04")
 					if len(args[0]) == 0 {
-						log.Printf("env: invalid key from payload: %s", payload)
+						s.logger().Errorf("env: invalid key from payload: %s", payload)
 						continue
 					}
 
 					_, _, err := execCommandBytes("env", args[0]+"="+args[1])
 					if err != nil {
-						log.Printf("env: %v", err)
+						s.logger().Errorf("env: %v", err)
 						return
 					}
 				case "exec":
-					log.Printf("ssh: incoming exec request: %s\n", payload)
+					s.logger().Infof("ssh: incoming exec request: %s", payload)
 
 					cmdName := strings.TrimLeft(payload, "'()")
-					log.Printf("ssh: payload '%v'", cmdName)
+					s.logger().Infof("ssh: payload '%v'", cmdName)
 
 					if strings.HasPrefix(cmdName, "\x00") {
 						cmdName = strings.Replace(cmdName, "\x00", "", -1)[1:]
@@ -132,44 +139,54 @@ func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel) {
 
 					gitcmd, err := ParseGitCommand(cmdName)
 					if err != nil {
-						log.Println("ssh: error parsing command:", err)
+						s.logger().Errorf("ssh: error parsing command: %v", err)
+						ch.Write([]byte("Invalid command.\r\n"))
+						return
+					}
+
+					if strings.HasSuffix(gitcmd.Command, "upload-archive") && s.config.DisableSSHUploadArchive {
+						s.logger().Errorf("ssh: upload-archive is not allowed")
 						ch.Write([]byte("Invalid command.\r\n"))
 						return
 					}
 
 					if !repoExists(filepath.Join(s.config.Dir, gitcmd.Repo)) && s.config.AutoCreate == true {
-						err := initRepo(gitcmd.Repo, s.config)
+						err := initRepo(filepath.Join(s.config.Dir, gitcmd.Repo), gitcmd.Repo, s.config.DefaultBranch, s.config)
 						if err != nil {
-							logError("repo-init", err)
+							s.logger().Errorf("ssh: repo-init: %v", err)
 							return
 						}
 					}
 
 					cmd := exec.Command(gitcmd.Command, gitcmd.Repo)
+					if s.config.FsckOnReceive && strings.HasSuffix(gitcmd.Command, "receive-pack") {
+						// Options on the command line keep the GIT_CONFIG_* of the server
+						cmd = exec.Command(s.config.GitPath, "-c", "receive.fsckObjects=true", "receive-pack", gitcmd.Repo)
+					}
 					cmd.Dir = s.config.Dir
 					cmd.Env = append(os.Environ(), "GITKIT_KEY="+keyID)
 					// cmd.Env = append(os.Environ(), "SSH_ORIGINAL_COMMAND="+cmdName)
 
 					stdout, err := cmd.StdoutPipe()
 					if err != nil {
-						log.Printf("ssh: cant open stdout pipe: %v", err)
+						s.logger().Errorf("ssh: cant open stdout pipe: %v", err)
 						return
 					}
 
 					stderr, err := cmd.StderrPipe()
 					if err != nil {
-						log.Printf("ssh: cant open stderr pipe: %v", err)
+						s.logger().Errorf("ssh: cant open stderr pipe: %v", err)
 						return
 					}
 
 					input, err := cmd.StdinPipe()
 					if err != nil {
-						log.Printf("ssh: cant open stdin pipe: %v", err)
+						s.logger().Errorf("ssh: cant open stdin pipe: %v", err)
 						return
 					}
 
 					if err = cmd.Start(); err != nil {
-						log.Printf("ssh: start error: %v", err)
+						s.logger().Errorf("ssh: start error: %v", err)
 						return
 					}
 
@@ -179,7 +196,7 @@ func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel) {
 					io.Copy(ch.Stderr(), stderr)
 
 					if err = cmd.Wait(); err != nil {
-						log.Printf("ssh: command failed: %v", err)
+						s.logger().Errorf("ssh: command failed: %v", err)
 						return
 					}
 
@@ -187,7 +204,7 @@ func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel) {
 					return
 				default:
 					ch.Write([]byte("Unsupported request type.\r\n"))
-					log.Println("ssh: unsupported req type:", req.Type)
+					s.logger().Errorf("ssh: unsupported req type: %s", req.Type)
 					return
 				}
 			}
@@ -320,19 +337,19 @@ func (s *SSH) Serve() error {
 		}
 
 		go func() {
-			log.Printf("ssh: handshaking for %s", conn.RemoteAddr())
+			s.logger().Infof("ssh: handshaking for %s", conn.RemoteAddr())
 
 			sConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshconfig)
 			if err != nil {
 				if err == io.EOF {
-					log.Printf("ssh: handshaking was terminated: %v", err)
+					s.logger().Infof("ssh: handshaking was terminated: %v", err)
 				} else {
-					log.Printf("ssh: error on handshaking: %v", err)
+					s.logger().Errorf("ssh: error on handshaking: %v", err)
 				}
 				return
 			}
 
-			log.Printf("ssh: connection from %s (%s)", sConn.RemoteAddr(), sConn.ClientVersion())
+			s.logger().Infof("ssh: connection from %s (%s)", sConn.RemoteAddr(), sConn.ClientVersion())
 
 			if s.config.Auth && s.config.GitUser != "" && sConn.User() != s.config.GitUser {
 				sConn.Close()
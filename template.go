@@ -0,0 +1,92 @@
+package gitkit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// templatePath returns the directory of a repository template. ok is false
+// if templates are not configured, the name is not a plain directory name or
+// the template does not exist.
+func (s *Server) templatePath(name string) (string, bool) {
+	if s.config.TemplateDir == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", false
+	}
+
+	p := filepath.Join(s.config.TemplateDir, name)
+	info, err := os.Stat(p)
+	if err != nil || !info.IsDir() {
+		return "", false
+	}
+	return p, true
+}
+
+// seedRepo commits the files of a template directory to the branch HEAD of
+// the bare repository points to. Empty templates leave the repository empty.
+func seedRepo(config *Config, repoPath string, templatePath string) error {
+	files, err := ioutil.ReadDir(templatePath)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	// Stage the files in a throwaway index, the repository has no work tree.
+	// Everything but the command goes in the environment, so errors name it.
+	tmp, err := ioutil.TempDir("", "gitkit-template")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if cred := config.credential(); cred != nil {
+		if err := os.Chown(tmp, int(cred.Uid), int(cred.Gid)); err != nil {
+			return err
+		}
+	}
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command(config.GitPath, append([]string{"--git-dir", repoPath}, args...)...)
+		cmd.Dir = templatePath
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: config.credential()}
+		cmd.Env = append(os.Environ(),
+			"GIT_INDEX_FILE="+filepath.Join(tmp, "index"),
+			"GIT_WORK_TREE="+templatePath,
+			"GIT_AUTHOR_NAME=gitkit", "GIT_AUTHOR_EMAIL=gitkit@localhost",
+			"GIT_COMMITTER_NAME=gitkit", "GIT_COMMITTER_EMAIL=gitkit@localhost",
+		)
+
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	if _, err := git("add", "--all", "."); err != nil {
+		return err
+	}
+
+	tree, err := git("write-tree")
+	if err != nil {
+		return err
+	}
+
+	commit, err := git("commit-tree", tree, "-m", "Initial commit")
+	if err != nil {
+		return err
+	}
+
+	branch, err := git("symbolic-ref", "HEAD")
+	if err != nil {
+		return err
+	}
+
+	_, err = git("update-ref", branch, commit)
+	return err
+}
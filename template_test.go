@@ -0,0 +1,69 @@
+package gitkit
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateRepoFromTemplate(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	templates := filepath.Join(dir, "templates")
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(templates, "service", "docs"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(templates, "empty"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(templates, "service", "README"), []byte("hello"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(templates, "service", "docs", "guide.md"), []byte("# Guide"), 0644))
+
+	server := New(Config{Dir: repos, TemplateDir: templates})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	create := func(name string, body string) int {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("POST", "/"+name+"/repo", strings.NewReader(body)))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusCreated, create("seeded.git", `{"template": "service", "defaultBranch": "main"}`))
+	out, err := runGit(dir, "clone", "-q", ts.URL+"/seeded.git", "clone")
+	assert.NoError(t, err, out)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "clone", "docs", "guide.md"))
+	assert.NoError(t, err)
+	assert.Equal(t, "# Guide", string(data))
+	branch, err := runGit(filepath.Join(dir, "clone"), "rev-parse", "--abbrev-ref", "HEAD")
+	assert.NoError(t, err, branch)
+	assert.Equal(t, "main", strings.TrimSpace(branch))
+
+	// Empty templates create empty repositories
+	assert.Equal(t, http.StatusCreated, create("empty.git", `{"template": "empty"}`))
+	refs, err := runGit(dir, "--git-dir", filepath.Join(repos, "empty.git"), "for-each-ref")
+	assert.NoError(t, err, refs)
+	assert.Equal(t, "", refs)
+
+	for _, name := range []string{"missing", "../templates/service", "."} {
+		assert.Equal(t, http.StatusBadRequest, create("invalid.git", `{"template": "`+name+`"}`), name)
+	}
+	assert.False(t, repoExists(filepath.Join(repos, "invalid.git")))
+
+	// Templates have to be configured to be used
+	server = New(Config{Dir: repos})
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/other.git/repo", strings.NewReader(`{"template": "service"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Errors name the git command that failed
+	gitPath := writeGitStub(t, dir, "echo broken >&2\nexit 1\n")
+	err = seedRepo(&Config{GitPath: gitPath}, filepath.Join(repos, "empty.git"), filepath.Join(templates, "service"))
+	if assert.Error(t, err) {
+		assert.Equal(t, "git add: exit status 1: broken", err.Error())
+	}
+}
@@ -0,0 +1,61 @@
+package gitkit
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// throttle limits writes to w to Config.MaxBytesPerSec, w is returned as is
+// without a limit. Writes stop waiting as soon as ctx is done.
+func (s *Server) throttle(ctx context.Context, w io.Writer) io.Writer {
+	if s.config.MaxBytesPerSec <= 0 {
+		return w
+	}
+	return &throttledWriter{w: w, ctx: ctx, rate: s.config.MaxBytesPerSec, start: time.Now()}
+}
+
+// throttledWriter paces writes so that no more than rate bytes per second
+// have been written on average since start
+type throttledWriter struct {
+	w       io.Writer
+	ctx     context.Context
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	// Chunks of a tenth of a second keep the output smooth
+	chunk := int(t.rate / 10)
+	if chunk < 1 {
+		chunk = 1
+	}
+
+	n := 0
+	for n < len(p) {
+		end := n + chunk
+		if end > len(p) {
+			end = len(p)
+		}
+
+		m, err := t.w.Write(p[n:end])
+		n += m
+		t.written += int64(m)
+		if err != nil {
+			return n, err
+		}
+
+		due := t.start.Add(time.Duration(float64(t.written) / float64(t.rate) * float64(time.Second)))
+		if wait := time.Until(due); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-t.ctx.Done():
+				timer.Stop()
+				return n, t.ctx.Err()
+			}
+		}
+	}
+	return n, nil
+}
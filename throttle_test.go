@@ -0,0 +1,61 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottledWriter(t *testing.T) {
+	server := New(Config{MaxBytesPerSec: 10000})
+	out := &bytes.Buffer{}
+	w := server.throttle(context.Background(), out)
+
+	start := time.Now()
+	n, err := w.Write(make([]byte, 3000))
+	assert.NoError(t, err)
+	assert.Equal(t, 3000, n)
+	assert.Equal(t, 3000, out.Len())
+	assert.True(t, time.Since(start) >= 300*time.Millisecond, time.Since(start).String())
+
+	// Without a limit the writer is used as is
+	assert.Equal(t, out, New(Config{}).throttle(context.Background(), out))
+}
+
+func TestThrottledWriterCancel(t *testing.T) {
+	server := New(Config{MaxBytesPerSec: 100})
+	ctx, cancel := context.WithCancel(context.Background())
+	w := server.throttle(ctx, &bytes.Buffer{})
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	n, err := w.Write(make([]byte, 1000))
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, n < 1000)
+	assert.True(t, time.Since(start) < time.Second, time.Since(start).String())
+}
+
+func TestMaxBytesPerSec(t *testing.T) {
+	dir := t.TempDir()
+	makeRepo(t, dir, "test.git")
+
+	for _, rate := range []int64{0, 500} {
+		server := New(Config{Dir: dir, MaxBytesPerSec: rate})
+
+		start := time.Now()
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/test.git/info/refs?service=git-upload-pack", nil))
+		elapsed := time.Since(start)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		if rate > 0 {
+			min := time.Duration(w.Body.Len()) * time.Second / time.Duration(rate)
+			assert.True(t, elapsed >= min, elapsed.String()+" for "+w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package gitkit
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// postUploadArchive serves POST /git-upload-archive when
+// Config.AllowUploadArchive is set. The request body holds the arguments of
+// git archive --remote as pkt-lines and the response is the output of git
+// upload-archive: its status followed by the archive on the side-band. Git
+// itself only speaks this service over SSH and git://, the endpoint is meant
+// for clients that frame the exchange themselves.
+func (s *Server) postUploadArchive(_ string, w http.ResponseWriter, r *Request) error {
+	context := "upload-archive"
+
+	// The arguments are small and read before git starts, HTTP/1 servers may
+	// close the request body once the response has started
+	args, err := ioutil.ReadAll(io.LimitReader(r.Body, maxUploadArchiveArgs))
+	if err != nil {
+		s.fail500(w, r.Request, context, err)
+		return err
+	}
+
+	cmd, pipe, stderr := s.gitCommand(r, "upload-archive", r.RepoPath)
+	defer pipe.Close()
+	cmd.Stdin = bytes.NewReader(args)
+
+	if err := s.startCommand(cmd); err != nil {
+		s.fail500(w, r.Request, context, err)
+		return err
+	}
+	defer s.releaseCommand(cmd)
+	defer cleanUpProcessGroup(cmd)
+	defer watchProcessGroup(r.Context(), cmd)()
+
+	w.Header().Add("Content-Type", "application/x-git-upload-archive-result")
+	w.Header().Add("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(newWriteFlusher(w), pipe); err != nil {
+		s.logError(r.Request, context, err)
+		return err
+	}
+
+	if err := cmd.Wait(); err != nil {
+		err = commandError(err, stderr)
+		s.logError(r.Request, context, err)
+		return err
+	}
+	return nil
+}
+
+// Git accepts at most 64 arguments of a pkt-line each
+const maxUploadArchiveArgs = 64 * 65520
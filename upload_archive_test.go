@@ -0,0 +1,87 @@
+package gitkit
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// uploadArchive asks the server for an archive of ref and returns the
+// response and the archive sent on the first band
+func uploadArchive(t *testing.T, url string, ref string) (*http.Response, []byte) {
+	body := &bytes.Buffer{}
+	assert.NoError(t, packLine(body, "argument --format=tar\n"))
+	assert.NoError(t, packLine(body, "argument "+ref+"\n"))
+	assert.NoError(t, packFlush(body))
+
+	res, err := http.Post(url+"/git-upload-archive", "application/x-git-upload-archive-request", body)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return res, nil
+	}
+
+	status, err := readPktSection(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "ACK\n", string(status[0].payload()))
+
+	archive := &bytes.Buffer{}
+	for {
+		line, err := readPktLine(res.Body)
+		if err == io.EOF || line.isFlush() {
+			break
+		}
+		assert.NoError(t, err)
+		if data := line.payload(); len(data) > 0 && data[0] == 1 {
+			archive.Write(data[1:])
+		}
+	}
+	return res, archive.Bytes()
+}
+
+func TestUploadArchive(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true, AllowUploadArchive: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+
+	res, archive := uploadArchive(t, ts.URL+"/test.git", "master")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/x-git-upload-archive-result", res.Header.Get("Content-Type"))
+
+	tr := tar.NewReader(bytes.NewReader(archive))
+	files := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			content, _ := ioutil.ReadAll(tr)
+			files[hdr.Name] = string(content)
+		}
+	}
+	assert.Equal(t, map[string]string{"README": "hello"}, files)
+}
+
+func TestUploadArchiveDisabled(t *testing.T) {
+	dir := t.TempDir()
+	server := New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+
+	res, _ := uploadArchive(t, ts.URL+"/test.git", "master")
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
@@ -1,42 +1,142 @@
 package gitkit
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var reSlashDedup = regexp.MustCompile(`\/{2,}`)
 
-func fail500(w http.ResponseWriter, context string, err error) {
-	http.Error(w, "Internal server error", 500)
-	logError(context, err)
-}
+// clientIP returns the address of the client. Behind a proxy trusted with
+// Config.TrustProxy it is the last address of X-Forwarded-For, the one the
+// proxy saw, or X-Real-IP. Clients could set these headers themselves
+// otherwise.
+func (s *Server) clientIP(r *http.Request) string {
+	if s.config.TrustProxy {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if ip := strings.TrimSpace(forwarded[len(forwarded)-1]); ip != "" {
+			return ip
+		}
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+			return ip
+		}
+	}
 
-func formatResponse(w http.ResponseWriter, body interface{}, code int) {
-	w.Header().Add("Content-Type", "application/json")
-	w.Header().Add("Cache-Control", "no-cache")
-	w.WriteHeader(code)
-	data, err := json.Marshal(body)
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		fail500(w, "marshal response", err)
-		return
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientURL returns the scheme and host of the server as the client sees
+// them. Behind a proxy trusted with Config.TrustProxy they come from the
+// last values of X-Forwarded-Proto and X-Forwarded-Host, the ones the proxy
+// set, as the proxy may terminate TLS.
+func (s *Server) clientURL(r *http.Request) (string, string) {
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	if s.config.TrustProxy {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")
+		if proto := strings.ToLower(strings.TrimSpace(forwarded[len(forwarded)-1])); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		forwarded = strings.Split(r.Header.Get("X-Forwarded-Host"), ",")
+		if forwardedHost := strings.TrimSpace(forwarded[len(forwarded)-1]); forwardedHost != "" {
+			host = forwardedHost
+		}
+	}
+	return scheme, host
+}
+
+// acceptsGzip reports whether the client accepts gzip encoded responses
+func acceptsGzip(req *http.Request) bool {
+	for _, encoding := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(encoding, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "gzip") {
+			continue
+		}
+
+		for _, param := range params[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+				if weight, err := strconv.ParseFloat(q[2:], 64); err == nil && weight == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// queryInt parses a non-negative integer query parameter, defaulting to 0
+func queryInt(query url.Values, name string) (int, error) {
+	value := query.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s parameter: %q", name, value)
+	}
+	return n, nil
+}
+
+// errBodyTooLarge is returned by maxSizeReader, see Config.MaxPushSize and
+// Config.MaxGzipRequestSize
+var errBodyTooLarge = errors.New("request body exceeds the maximum size")
+
+// errEmptyBody is logged for pushes without a body
+var errEmptyBody = errors.New("empty request body")
+
+// maxSizeReader fails with errBodyTooLarge once more than n bytes are read
+type maxSizeReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errBodyTooLarge
 	}
-	w.Write(data)
+	return n, err
 }
 
-func logError(context string, err error) {
-	log.Printf("%s: %v\n", context, err)
+// commandError adds what a failed git process wrote to stderr to its error
+func commandError(err error, stderr *bytes.Buffer) error {
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("%v: %s", err, msg)
+	}
+	return err
 }
 
-func logInfo(context string, message string) {
-	log.Printf("%s: %s\n", context, message)
+// gitStartError points out a missing git binary, which otherwise shows up as
+// a cryptic exec error
+func gitStartError(gitPath string, err error) error {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("git binary %q not found, check Config.GitPath: %v", gitPath, err)
+	}
+	return err
 }
 
 func cleanUpProcessGroup(cmd *exec.Cmd) {
@@ -44,12 +144,29 @@ func cleanUpProcessGroup(cmd *exec.Cmd) {
 		return
 	}
 
+	killProcessGroup(cmd)
+	go cmd.Wait()
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
 	process := cmd.Process
 	if process != nil && process.Pid > 0 {
 		syscall.Kill(-process.Pid, syscall.SIGTERM)
 	}
+}
 
-	go cmd.Wait()
+// watchProcessGroup terminates the process group of a started command as soon
+// as ctx is done. Calling the returned func stops the watcher.
+func watchProcessGroup(ctx context.Context, cmd *exec.Cmd) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
 }
 
 func packLine(w io.Writer, s string) error {
@@ -62,29 +179,99 @@ func packFlush(w io.Writer) error {
 	return err
 }
 
+// keepAliveArgs returns the options setting the interval of the keepalive
+// packets git sends over the side-band while it is quiet, see
+// Config.KeepAlive
+func (s *Server) keepAliveArgs(rpc string) []string {
+	if s.config.KeepAlive == 0 {
+		return nil
+	}
+
+	key := "uploadpack.keepAlive"
+	if rpc == "git-receive-pack" {
+		key = "receive.keepAlive"
+	}
+
+	// Git counts whole seconds, zero turns keepalives off
+	seconds := 0
+	if s.config.KeepAlive > 0 {
+		seconds = int((s.config.KeepAlive + time.Second - 1) / time.Second)
+	}
+	return []string{"-c", fmt.Sprintf("%s=%d", key, seconds)}
+}
+
+// filterArgs returns the options letting upload-pack serve partial clones,
+// see Config.DisablePartialClone. They are only offered over protocol v2:
+// v0 clients fetch the missing objects of partial clones by id, which
+// upload-pack only serves for advertised tips.
+func (s *Server) filterArgs(rpc string, protocolV2 bool) []string {
+	if rpc != "git-upload-pack" || !protocolV2 || s.config.DisablePartialClone {
+		return nil
+	}
+	return []string{"-c", "uploadpack.allowFilter=true"}
+}
+
+// fsckArgs returns the options making receive-pack check pushed objects, see
+// Config.FsckOnReceive
+func (s *Server) fsckArgs(rpc string) []string {
+	if rpc != "git-receive-pack" || !s.config.FsckOnReceive {
+		return nil
+	}
+	return []string{"-c", "receive.fsckObjects=true"}
+}
+
+// Permissions git init --shared accepts besides octal modes
+var sharedRepoValues = map[string]bool{
+	"false": true, "umask": true,
+	"true": true, "group": true,
+	"all": true, "world": true, "everybody": true,
+}
+
+var sharedRepoModeRegex = regexp.MustCompile(`^0[0-7]{3}$`)
+
+// validSharedRepo reports whether git init accepts the value of --shared
+func validSharedRepo(value string) bool {
+	return sharedRepoValues[value] || sharedRepoModeRegex.MatchString(value)
+}
+
 func subCommand(rpc string) string {
 	return strings.TrimPrefix(rpc, "git-")
 }
 
-// Parse out namespace and repository name from the path.
+// isSubPath reports whether p is located strictly inside the root directory
+func isSubPath(root string, p string) bool {
+	rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(p))
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// ParseRepoPath splits the repository part of a request path into the
+// namespace and the repository name, the way the server does. Repeated
+// slashes count as one and a leading one is dropped. The last segment is the
+// repository, kept as is with or without a ".git" suffix, so a trailing slash
+// leaves it empty. The namespace is made of the segments before it. Names are
+// not checked, e.g. for "..", see Config.RepoNamePattern.
 // Examples:
 // repo -> "", "repo"
-// org/repo -> "org", "repo"
-// org/suborg/rpeo -> "org/suborg", "repo"
-func getNamespaceAndRepo(input string) (string, string) {
-	if input == "" || input == "/" {
+// org/repo.git -> "org", "repo.git"
+// org/suborg/repo -> "org/suborg", "repo"
+// org/repo/ -> "org/repo", ""
+func ParseRepoPath(urlPath string) (namespace, repo string) {
+	if urlPath == "" || urlPath == "/" {
 		return "", ""
 	}
 
 	// Remove duplicate slashes
-	input = reSlashDedup.ReplaceAllString(input, "/")
+	urlPath = reSlashDedup.ReplaceAllString(urlPath, "/")
 
 	// Remove leading slash
-	if input[0] == '/' && input != "/" {
-		input = input[1:]
+	if urlPath[0] == '/' && urlPath != "/" {
+		urlPath = urlPath[1:]
 	}
 
-	blocks := strings.Split(input, "/")
+	blocks := strings.Split(urlPath, "/")
 	num := len(blocks)
 
 	if num < 2 {
@@ -93,3 +280,34 @@ func getNamespaceAndRepo(input string) (string, string) {
 
 	return strings.Join(blocks[0:num-1], "/"), blocks[num-1]
 }
+
+// getNamespaceAndRepo parses out namespace and repository name from the
+// path, see ParseRepoPath
+func getNamespaceAndRepo(input string) (string, string) {
+	return ParseRepoPath(input)
+}
+
+// refsModTime returns when the refs of a repository last changed, judging by
+// the files git keeps them in: loose refs, packed-refs and FETCH_HEAD
+func refsModTime(repoPath string) time.Time {
+	var latest time.Time
+	update := func(info os.FileInfo) {
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	// Directories count too, they change when refs are deleted
+	filepath.Walk(filepath.Join(repoPath, "refs"), func(_ string, info os.FileInfo, err error) error {
+		if err == nil {
+			update(info)
+		}
+		return nil
+	})
+	for _, name := range []string{"packed-refs", "FETCH_HEAD"} {
+		if info, err := os.Stat(filepath.Join(repoPath, name)); err == nil {
+			update(info)
+		}
+	}
+	return latest
+}
@@ -2,7 +2,9 @@ package gitkit
 
 import (
 	"bytes"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -75,3 +77,137 @@ func Test_getNamespaceAndRepo(t *testing.T) {
 		assert.Equal(t, expected[1], repo)
 	}
 }
+
+func TestParseRepoPath(t *testing.T) {
+	cases := map[string][]string{
+		// Single level
+		"repo":      {"", "repo"},
+		"/repo.git": {"", "repo.git"},
+		// Multiple levels
+		"org/repo.git":          {"org", "repo.git"},
+		"/org/suborg/repo":      {"org/suborg", "repo"},
+		"/org/suborg/team/repo": {"org/suborg/team", "repo"},
+		// Malformed
+		"/org/repo/":  {"org/repo", ""},
+		"org//":       {"org", ""},
+		"/../repo":    {"..", "repo"},
+		"/org/./repo": {"org/.", "repo"},
+	}
+
+	for example, expected := range cases {
+		namespace, repo := ParseRepoPath(example)
+
+		assert.Equal(t, expected[0], namespace, example)
+		assert.Equal(t, expected[1], repo, example)
+	}
+}
+
+func Test_isSubPath(t *testing.T) {
+	cases := map[string]bool{
+		"/repos/repo.git":        true,
+		"/repos/org/repo.git":    true,
+		"/repos/../repo.git":     false,
+		"/repos/..repo.git":      true,
+		"/repos":                 false,
+		"/repos/":                false,
+		"/etc/passwd":            false,
+		"/repos/org/../../other": false,
+	}
+
+	for example, expected := range cases {
+		assert.Equal(t, expected, isSubPath("/repos", example), example)
+	}
+}
+
+func Test_acceptsGzip(t *testing.T) {
+	cases := map[string]bool{
+		"":                    false,
+		"gzip":                true,
+		"deflate, gzip":       true,
+		"GZIP":                true,
+		"gzip;q=0.5":          true,
+		"gzip; q=0":           false,
+		"deflate":             false,
+		"x-gzip, identity":    false,
+		"deflate, gzip;q=1.0": true,
+	}
+
+	for header, expected := range cases {
+		req, _ := http.NewRequest("GET", "http://localhost", nil)
+		req.Header.Set("Accept-Encoding", header)
+		assert.Equal(t, expected, acceptsGzip(req), header)
+	}
+}
+
+func Test_clientIP(t *testing.T) {
+	cases := []struct {
+		trustProxy bool
+		header     map[string]string
+		expected   string
+	}{
+		{false, nil, "10.0.0.1"},
+		{false, map[string]string{"X-Forwarded-For": "203.0.113.7"}, "10.0.0.1"},
+		{true, nil, "10.0.0.1"},
+		{true, map[string]string{"X-Forwarded-For": "203.0.113.7"}, "203.0.113.7"},
+		{true, map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{true, map[string]string{"X-Real-IP": "203.0.113.8"}, "203.0.113.8"},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "http://localhost", nil)
+		req.RemoteAddr = "10.0.0.1:52100"
+		for key, value := range c.header {
+			req.Header.Set(key, value)
+		}
+
+		server := New(Config{TrustProxy: c.trustProxy})
+		assert.Equal(t, c.expected, server.clientIP(req), c.header)
+	}
+}
+
+func Test_clientURL(t *testing.T) {
+	cases := []struct {
+		trustProxy bool
+		header     map[string]string
+		scheme     string
+		host       string
+	}{
+		{false, nil, "http", "localhost"},
+		{false, map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "git.example.com"}, "http", "localhost"},
+		{true, nil, "http", "localhost"},
+		{true, map[string]string{"X-Forwarded-Proto": "https"}, "https", "localhost"},
+		{true, map[string]string{"X-Forwarded-Proto": "http, HTTPS", "X-Forwarded-Host": "a.example.com, git.example.com"}, "https", "git.example.com"},
+		{true, map[string]string{"X-Forwarded-Proto": "ftp"}, "http", "localhost"},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "http://localhost", nil)
+		for key, value := range c.header {
+			req.Header.Set(key, value)
+		}
+
+		server := New(Config{TrustProxy: c.trustProxy})
+		scheme, host := server.clientURL(req)
+		assert.Equal(t, c.scheme, scheme, c.header)
+		assert.Equal(t, c.host, host, c.header)
+	}
+}
+
+func Test_keepAliveArgs(t *testing.T) {
+	tests := []struct {
+		keepAlive time.Duration
+		rpc       string
+		args      []string
+	}{
+		{0, "git-upload-pack", nil},
+		{2 * time.Second, "git-upload-pack", []string{"-c", "uploadpack.keepAlive=2"}},
+		{1500 * time.Millisecond, "git-upload-pack", []string{"-c", "uploadpack.keepAlive=2"}},
+		{10 * time.Second, "git-receive-pack", []string{"-c", "receive.keepAlive=10"}},
+		{-1, "git-receive-pack", []string{"-c", "receive.keepAlive=0"}},
+	}
+
+	for _, test := range tests {
+		server := New(Config{KeepAlive: test.keepAlive})
+		assert.Equal(t, test.args, server.keepAliveArgs(test.rpc), test.keepAlive)
+	}
+}
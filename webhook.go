@@ -0,0 +1,122 @@
+package gitkit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Events webhooks can subscribe to
+const (
+	WebhookEventPush = "push"
+)
+
+// WebhookConfig describes an endpoint notified of repository events
+type WebhookConfig struct {
+	URL    string
+	Secret string   // Key of the HMAC-SHA256 payload signature, none if empty
+	Events []string // Events to send, all of them if empty
+}
+
+// WebhookPayload is the JSON body sent to webhooks
+type WebhookPayload struct {
+	Event   string      `json:"event"`
+	Repo    string      `json:"repo"`
+	Updates []RefUpdate `json:"updates"`
+}
+
+var (
+	webhookAttempts   = 3
+	webhookRetryDelay = time.Second
+	webhookClient     = &http.Client{Timeout: 10 * time.Second}
+)
+
+func (c WebhookConfig) wants(event string) bool {
+	if len(c.Events) == 0 {
+		return true
+	}
+	for _, e := range c.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatchWebhooks notifies the configured webhooks of an event in the
+// background. Deliveries are retried a few times, failures are only logged.
+func (s *Server) dispatchWebhooks(r *Request, event string, updates []RefUpdate) {
+	payload, err := json.Marshal(WebhookPayload{
+		Event:   event,
+		Repo:    r.RepoName,
+		Updates: updates,
+	})
+	if err != nil {
+		s.logError(r.Request, "webhook", err)
+		return
+	}
+
+	for _, hook := range s.config.Webhooks {
+		if !hook.wants(event) {
+			continue
+		}
+
+		// Called while serving a request, so Shutdown waits for deliveries
+		s.active.Add(1)
+		go func(hook WebhookConfig) {
+			defer s.active.Done()
+			s.deliverWebhook(r.Request, hook, event, payload)
+		}(hook)
+	}
+}
+
+// deliverWebhook posts the payload to the webhook, r is the request that
+// triggered the event, its ID tags the logs
+func (s *Server) deliverWebhook(r *http.Request, hook WebhookConfig, event string, payload []byte) {
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(webhookRetryDelay * time.Duration(attempt-1))
+		}
+
+		if err = postWebhook(hook, event, payload); err == nil {
+			return
+		}
+	}
+	s.logError(r, "webhook", fmt.Errorf("%s: giving up after %d attempts: %v", hook.URL, webhookAttempts, err))
+}
+
+func postWebhook(hook WebhookConfig, event string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gitkit-Event", event)
+	if hook.Secret != "" {
+		req.Header.Set("X-Gitkit-Signature", "sha256="+signPayload(hook.Secret, payload))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of payload
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
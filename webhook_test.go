@@ -0,0 +1,102 @@
+package gitkit
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhooks(t *testing.T) {
+	defer func(delay time.Duration) { webhookRetryDelay = delay }(webhookRetryDelay)
+	webhookRetryDelay = 10 * time.Millisecond
+
+	var lock sync.Mutex
+	attempts := map[string]int{}
+	deliveries := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+
+	hooks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		attempts[r.URL.Path]++
+		n := attempts[r.URL.Path]
+		lock.Unlock()
+
+		// The first delivery fails and is retried
+		if r.URL.Path == "/broken" || n == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		deliveries <- r
+		bodies <- body
+	}))
+	defer hooks.Close()
+
+	dir := t.TempDir()
+	logger := &testLogger{}
+	server := New(Config{
+		Dir:        filepath.Join(dir, "repos"),
+		AutoCreate: true,
+		Webhooks: []WebhookConfig{
+			{URL: hooks.URL + "/push", Secret: "s3cret", Events: []string{WebhookEventPush}},
+			{URL: hooks.URL + "/other", Events: []string{"other"}},
+			{URL: hooks.URL + "/broken"},
+		},
+	})
+	server.Logger = logger
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	pushSampleCommit(t, dir, ts.URL+"/test.git")
+	head, err := runGit(filepath.Join(dir, "work"), "rev-parse", "HEAD")
+	assert.NoError(t, err, head)
+
+	var req *http.Request
+	var body []byte
+	select {
+	case req = <-deliveries:
+		body = <-bodies
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+
+	assert.Equal(t, "/push", req.URL.Path)
+	assert.Equal(t, WebhookEventPush, req.Header.Get("X-Gitkit-Event"))
+	assert.Equal(t, "sha256="+signPayload("s3cret", body), req.Header.Get("X-Gitkit-Signature"))
+
+	payload := WebhookPayload{}
+	assert.NoError(t, json.Unmarshal(body, &payload))
+	assert.Equal(t, WebhookPayload{
+		Event: WebhookEventPush,
+		Repo:  "test.git",
+		Updates: []RefUpdate{
+			{OldSHA: strings.Repeat("0", 40), NewSHA: strings.TrimSpace(head), Ref: "refs/heads/master"},
+		},
+	}, payload)
+
+	// Shutdown waits for the remaining deliveries
+	assert.NoError(t, server.Shutdown(context.Background()))
+
+	lock.Lock()
+	assert.Equal(t, 2, attempts["/push"])
+	assert.Equal(t, 0, attempts["/other"])
+	assert.Equal(t, webhookAttempts, attempts["/broken"])
+	lock.Unlock()
+
+	logger.Lock()
+	defer logger.Unlock()
+	found := false
+	for _, msg := range logger.errors {
+		found = found || strings.Contains(msg, "/broken: giving up")
+	}
+	assert.True(t, found, logger.errors)
+}
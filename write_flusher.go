@@ -5,21 +5,41 @@ import (
 	"net/http"
 )
 
+// newWriteFlusher returns a writer flushing w after every write, so that git
+// output reaches clients as it comes, over HTTP/1 and HTTP/2 alike. Writers of
+// middlewares that do not flush themselves are unwrapped to find one that
+// does, like http.ResponseController does. Output is buffered by the server
+// if there is none.
 func newWriteFlusher(w http.ResponseWriter) io.Writer {
-	return writeFlusher{w.(interface {
-		io.Writer
-		http.Flusher
-	})}
+	for rw := w; ; {
+		if f, ok := rw.(http.Flusher); ok {
+			return writeFlusher{w, f}
+		}
+		u, ok := rw.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return w
+		}
+		rw = u.Unwrap()
+	}
 }
 
 type writeFlusher struct {
-	wf interface {
-		io.Writer
-		http.Flusher
-	}
+	w io.Writer
+	f http.Flusher
 }
 
 func (w writeFlusher) Write(p []byte) (int, error) {
-	defer w.wf.Flush()
-	return w.wf.Write(p)
+	defer w.f.Flush()
+	return w.w.Write(p)
+}
+
+// enableFullDuplex allows reading the request body after the response has
+// started, which HTTP/1 servers do not by default. HTTP/2 requests always
+// allow it. It reports false if the server does not support it.
+func enableFullDuplex(w http.ResponseWriter, r *http.Request) bool {
+	if r != nil && r.ProtoMajor >= 2 {
+		return true
+	}
+	fd, ok := w.(interface{ EnableFullDuplex() error })
+	return ok && fd.EnableFullDuplex() == nil
 }
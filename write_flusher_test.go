@@ -0,0 +1,39 @@
+package gitkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// wrappedWriter hides the http.Flusher of the writer it wraps, like many
+// middlewares do
+type wrappedWriter struct {
+	http.ResponseWriter
+}
+
+func (w wrappedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func Test_newWriteFlusher(t *testing.T) {
+	for _, wrap := range []bool{false, true} {
+		rec := httptest.NewRecorder()
+		var w http.ResponseWriter = rec
+		if wrap {
+			w = wrappedWriter{rec}
+		}
+
+		_, err := newWriteFlusher(w).Write([]byte("0000"))
+		assert.NoError(t, err)
+		assert.True(t, rec.Flushed, "wrapped: %v", wrap)
+		assert.Equal(t, "0000", rec.Body.String())
+	}
+
+	// Writers that cannot flush are written to as they are
+	w := struct{ http.ResponseWriter }{httptest.NewRecorder()}
+	_, err := newWriteFlusher(w).Write([]byte("0000"))
+	assert.NoError(t, err)
+}